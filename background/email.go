@@ -0,0 +1,208 @@
+package background
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/chiefsend/api/config"
+	"github.com/chiefsend/api/logging"
+	m "github.com/chiefsend/api/models"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// email templates
+const (
+	EmailShared     = "shared"     // link to the recipients of a share
+	EmailDownloaded = "downloaded" // owner, on the first download
+	EmailExpiring   = "expiring"   // owner, before the share expires
+)
+
+var ErrMailNotConfigured = errors.New("SMTP is not configured")
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+var (
+	textTemplates = template.Must(template.ParseFS(templateFS, "templates/*.txt.tmpl"))
+	htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(templateFS, "templates/*.html.tmpl"))
+)
+
+// MailConfigured returns true if emails can be sent
+func MailConfigured() bool {
+	return conf.SMTP.Host != ""
+}
+
+func NewNotifyEmailTask(tmpl, to string, share m.Share, details bool) *asynq.Task {
+	payload := map[string]interface{}{"template": tmpl, "to": to, "share_id": share.ID.String(), "details": details}
+	return asynq.NewTask(NotifyEmail, payload)
+}
+
+// SendEmail enqueues one email per recipient. Does nothing if SMTP isn't configured.
+func SendEmail(ctx context.Context, tmpl string, to []string, share m.Share, details bool) error {
+	if !MailConfigured() {
+		return nil
+	}
+	for _, addr := range to {
+		if _, err := enqueue(ctx, NewNotifyEmailTask(tmpl, addr, share, details), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleNotifyEmailTask renders the template for the share and sends it
+func HandleNotifyEmailTask(ctx context.Context, t *asynq.Task) error {
+	if !MailConfigured() {
+		return ErrMailNotConfigured
+	}
+	db, err := m.GetDatabaseContext(ctx)
+	if err != nil {
+		return err
+	}
+	tmpl, err := t.Payload.GetString("template")
+	if err != nil {
+		return err
+	}
+	to, err := t.Payload.GetString("to")
+	if err != nil {
+		return err
+	}
+	id, err := t.Payload.GetString("share_id")
+	if err != nil {
+		return err
+	}
+	details, _ := t.Payload.GetBool("details")
+	// get share
+	var share m.Share
+	err = db.Where("id = ?", id).First(&share).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil // deleted in the meantime
+	}
+	if err != nil {
+		return err
+	}
+	// render and send
+	msg, err := renderEmail(conf, tmpl, to, share, details)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if conf.SMTP.Username != "" {
+		auth = smtp.PlainAuth("", conf.SMTP.Username, conf.SMTP.Password, conf.SMTP.Host)
+	}
+	addr := net.JoinHostPort(conf.SMTP.Host, strconv.Itoa(conf.SMTP.Port))
+	return smtp.SendMail(addr, auth, conf.SMTP.From, []string{to}, msg)
+}
+
+// renderEmail returns the multipart/alternative message with the plain text and the HTML version of tmpl
+func renderEmail(conf config.Config, tmpl, to string, share m.Share, details bool) ([]byte, error) {
+	data := struct {
+		Share   m.Share
+		Link    string
+		Details bool
+	}{share, fmt.Sprintf("%s/share/%s", strings.TrimSuffix(conf.PublicURL, "/"), share.ID), details}
+
+	var subject, text, html bytes.Buffer
+	t := textTemplates.Lookup(tmpl + ".txt.tmpl")
+	if t == nil {
+		return nil, fmt.Errorf("unknown email template %q", tmpl)
+	}
+	if err := t.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := t.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := htmlTemplates.ExecuteTemplate(&html, tmpl+".html.tmpl", data); err != nil {
+		return nil, err
+	}
+
+	var head, msg bytes.Buffer
+	body := multipart.NewWriter(&msg)
+	for _, h := range [][2]string{
+		{"From", conf.SMTP.From},
+		{"To", to},
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String()))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", uuid.New(), conf.SMTP.Host)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + body.Boundary()},
+	} {
+		fmt.Fprintf(&head, "%s: %s\r\n", h[0], h[1])
+	}
+	head.WriteString("\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{{"text/plain; charset=utf-8", text.Bytes()}, {"text/html; charset=utf-8", html.Bytes()}} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return append(head.Bytes(), msg.Bytes()...), nil
+}
+
+// HandleExpiryReminderTask reminds owners of shares which expire within jobs.expiry_reminder
+func HandleExpiryReminderTask(ctx context.Context, t *asynq.Task) error {
+	if !MailConfigured() {
+		return nil
+	}
+	db, err := m.GetDatabaseContext(ctx)
+	if err != nil {
+		return err
+	}
+	window := conf.Jobs.ExpiryReminder
+	now := time.Now()
+	var shares []m.Share
+	err = db.Where("is_temporary = ? AND reminder_sent = ? AND owner_email IS NOT NULL AND expires > ? AND expires <= ?",
+		false, false, now, now.Add(window)).Find(&shares).Error
+	if err != nil {
+		return err
+	}
+	for _, sh := range shares {
+		if err := SendEmail(ctx, EmailExpiring, []string{sh.OwnerEmail.String}, sh, false); err != nil {
+			return err
+		}
+		if err := db.Model(&sh).UpdateColumn("reminder_sent", true).Error; err != nil {
+			return err
+		}
+	}
+	if len(shares) > 0 {
+		logging.FromContext(ctx).Info("sent expiry reminders", "count", len(shares))
+	}
+	return nil
+}
+
+func NewExpiryReminderTask() *asynq.Task {
+	return asynq.NewTask(ExpiryReminder, map[string]interface{}{})
+}
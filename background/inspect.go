@@ -0,0 +1,306 @@
+package background
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	m "github.com/chiefsend/api/models"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"github.com/hibiken/asynq/inspeq"
+	"gopkg.in/guregu/null.v4"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// states of tasks which can be listed
+const (
+	StateScheduled = "scheduled"
+	StatePending   = "pending"
+	StateActive    = "active"
+	StateRetry     = "retry"
+	StateDead      = "dead" // archived by asynq after all retries failed
+)
+
+const defaultQueue = "default"
+
+var (
+	ErrNotConfigured = errors.New("redis is not configured")
+	ErrInvalidState  = errors.New("invalid task state")
+	ErrNoDeletion    = errors.New("share has no scheduled deletion")
+	ErrTaskNotFound  = errors.New("task not found")
+)
+
+// TaskInfo describes a task in one of the queues
+type TaskInfo struct {
+	ID            string        `json:"id"`
+	Key           string        `json:"key,omitempty"` // used to cancel or run the task, active tasks don't have one
+	Type          string        `json:"type"`
+	Payload       asynq.Payload `json:"payload"`
+	Queue         string        `json:"queue"`
+	State         string        `json:"state"`
+	MaxRetry      int           `json:"max_retry"`
+	Retried       int           `json:"retried"`
+	LastError     string        `json:"last_error,omitempty"`
+	NextProcessAt *time.Time    `json:"next_process_at,omitempty"`
+	LastFailedAt  *time.Time    `json:"last_failed_at,omitempty"`
+}
+
+func inspector() (*inspeq.Inspector, error) {
+	if redis == nil {
+		return nil, ErrNotConfigured
+	}
+	return inspeq.New(redis), nil
+}
+
+// ListTasks returns one page (starting at 1) of the tasks in the given state of a queue
+func ListTasks(queue, state string, page, size int) ([]TaskInfo, error) {
+	i, err := inspector()
+	if err != nil {
+		return nil, err
+	}
+	defer i.Close()
+	if queue == "" {
+		queue = defaultQueue
+	}
+	opts := []inspeq.ListOption{inspeq.Page(page), inspeq.PageSize(size)}
+
+	res := []TaskInfo{}
+	// queues only exist in redis after the first task was enqueued
+	queues, err := i.Queues()
+	if err != nil {
+		return nil, err
+	}
+	if !contains(queues, queue) {
+		if !contains([]string{StateScheduled, StatePending, StateActive, StateRetry, StateDead}, state) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidState, state)
+		}
+		return res, nil
+	}
+	switch state {
+	case StateScheduled:
+		tasks, err := i.ListScheduledTasks(queue, opts...)
+		for _, t := range tasks {
+			next := t.NextProcessAt
+			res = append(res, TaskInfo{ID: t.ID, Key: t.Key(), Type: t.Type, Payload: t.Payload, Queue: t.Queue, State: state,
+				MaxRetry: t.MaxRetry, Retried: t.Retried, LastError: t.LastError, NextProcessAt: &next})
+		}
+		return res, err
+	case StatePending:
+		tasks, err := i.ListPendingTasks(queue, opts...)
+		for _, t := range tasks {
+			res = append(res, TaskInfo{ID: t.ID, Key: t.Key(), Type: t.Type, Payload: t.Payload, Queue: t.Queue, State: state,
+				MaxRetry: t.MaxRetry, Retried: t.Retried, LastError: t.LastError})
+		}
+		return res, err
+	case StateActive:
+		tasks, err := i.ListActiveTasks(queue, opts...)
+		for _, t := range tasks {
+			res = append(res, TaskInfo{ID: t.ID, Type: t.Type, Payload: t.Payload, Queue: t.Queue, State: state,
+				MaxRetry: t.MaxRetry, Retried: t.Retried, LastError: t.LastError})
+		}
+		return res, err
+	case StateRetry:
+		tasks, err := i.ListRetryTasks(queue, opts...)
+		for _, t := range tasks {
+			next := t.NextProcessAt
+			res = append(res, TaskInfo{ID: t.ID, Key: t.Key(), Type: t.Type, Payload: t.Payload, Queue: t.Queue, State: state,
+				MaxRetry: t.MaxRetry, Retried: t.Retried, LastError: t.LastError, NextProcessAt: &next})
+		}
+		return res, err
+	case StateDead:
+		tasks, err := i.ListArchivedTasks(queue, opts...)
+		for _, t := range tasks {
+			failed := t.LastFailedAt
+			res = append(res, TaskInfo{ID: t.ID, Key: t.Key(), Type: t.Type, Payload: t.Payload, Queue: t.Queue, State: state,
+				MaxRetry: t.MaxRetry, Retried: t.Retried, LastError: t.LastError, LastFailedAt: &failed})
+		}
+		return res, err
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidState, state)
+	}
+}
+
+// GetQueueStats returns the current statistics of all queues
+func GetQueueStats() ([]*inspeq.QueueStats, error) {
+	i, err := inspector()
+	if err != nil {
+		return nil, err
+	}
+	defer i.Close()
+	queues, err := i.Queues()
+	if err != nil {
+		return nil, err
+	}
+	res := []*inspeq.QueueStats{}
+	for _, q := range queues {
+		st, err := i.CurrentStats(q)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, st)
+	}
+	return res, nil
+}
+
+// CancelTask deletes a scheduled, pending, retry or dead task
+func CancelTask(queue, key string) error {
+	i, err := inspector()
+	if err != nil {
+		return err
+	}
+	defer i.Close()
+	if queue == "" {
+		queue = defaultQueue
+	}
+	if !validKey(key) {
+		return fmt.Errorf("%w: invalid key %q", ErrTaskNotFound, key)
+	}
+	return lookup(i, i.DeleteTaskByKey(queue, key))
+}
+
+// RunTask moves a scheduled, retry or dead task to pending, so it is processed right away
+func RunTask(queue, key string) error {
+	i, err := inspector()
+	if err != nil {
+		return err
+	}
+	defer i.Close()
+	if queue == "" {
+		queue = defaultQueue
+	}
+	if !validKey(key) {
+		return fmt.Errorf("%w: invalid key %q", ErrTaskNotFound, key)
+	}
+	return lookup(i, i.RunTaskByKey(queue, key))
+}
+
+// FindShareDeletion returns the scheduled deletion task of a share
+func FindShareDeletion(share m.Share) (*TaskInfo, error) {
+	for page := 1; ; page++ {
+		tasks, err := ListTasks(defaultQueue, StateScheduled, page, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tasks {
+			if id, err := t.Payload.GetString("share_id"); err == nil && t.Type == DeleteShare && id == share.ID.String() {
+				return &t, nil
+			}
+		}
+		if len(tasks) < 100 {
+			return nil, ErrNoDeletion
+		}
+	}
+}
+
+// AdoptShareDeletion stores the key of the scheduled deletion of a share finalized before the keys were stored, it
+// scans the queue for it. Shares with a key or without a deletion are left alone.
+func AdoptShareDeletion(share *m.Share) error {
+	if share.DeletionTask.Valid {
+		return nil
+	}
+	t, err := FindShareDeletion(*share)
+	if errors.Is(err, ErrNoDeletion) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return setDeletionTask(share, null.StringFrom(t.Key))
+}
+
+// CancelShareDeletion removes the scheduled deletion of a share
+func CancelShareDeletion(share *m.Share) error {
+	key := share.DeletionTask.ValueOrZero()
+	if key == "" {
+		return ErrNoDeletion
+	}
+	err := CancelTask(defaultQueue, key)
+	if errors.Is(err, ErrTaskNotFound) {
+		err = ErrNoDeletion // already processed
+	}
+	if err != nil && !errors.Is(err, ErrNoDeletion) {
+		return err
+	}
+	if e := setDeletionTask(share, null.String{}); e != nil {
+		return e
+	}
+	return err
+}
+
+// RescheduleShareDeletion replaces the scheduled deletion of a share with one at the given time.
+// The share is deleted then, no matter what its expiry says.
+func RescheduleShareDeletion(ctx context.Context, share *m.Share, at time.Time) error {
+	if err := AdoptShareDeletion(share); err != nil {
+		return err
+	}
+	if err := CancelShareDeletion(share); err != nil && !errors.Is(err, ErrNoDeletion) {
+		return err
+	}
+	key, err := enqueue(ctx, NewDeleteShareTask(*share), &at)
+	if err != nil {
+		return err
+	}
+	return setDeletionTask(share, null.StringFrom(key))
+}
+
+// ScheduleShareDeletion (re)schedules the deletion of a finalized share at its expiry. Call it whenever the expiry changes.
+func ScheduleShareDeletion(ctx context.Context, share *m.Share) error {
+	if err := CancelShareDeletion(share); err != nil && !errors.Is(err, ErrNoDeletion) {
+		return err
+	}
+	if share.IsTemporary || !share.Expires.Valid {
+		return nil
+	}
+	// asynq works with whole seconds, don't run before the share is expired
+	at := share.Expires.Time.Truncate(time.Second).Add(time.Second)
+	key, err := enqueue(ctx, NewExpireShareTask(*share), &at)
+	if err != nil {
+		return err
+	}
+	return setDeletionTask(share, null.StringFrom(key))
+}
+
+func setDeletionTask(share *m.Share, key null.String) error {
+	db, err := m.GetDatabase()
+	if err != nil {
+		return err
+	}
+	share.DeletionTask = key
+	return db.Model(share).UpdateColumn("deletion_task", key).Error
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validKey reports whether key has the form of the keys of asynq, <state prefix>:<task id>:<score>
+func validKey(key string) bool {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 || len(parts[0]) != 1 || !strings.Contains("psra", parts[0]) {
+		return false
+	}
+	if _, err := uuid.Parse(parts[1]); err != nil {
+		return false
+	}
+	_, err := strconv.ParseInt(parts[2], 10, 64)
+	return err == nil
+}
+
+// lookup translates the errors of an operation on a task by key. asynq doesn't export its not found error, so every
+// failure is a missing task as long as redis answers.
+func lookup(i *inspeq.Inspector, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, e := i.Queues(); e != nil {
+		return e
+	}
+	return fmt.Errorf("%w: %v", ErrTaskNotFound, err)
+}
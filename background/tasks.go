@@ -2,14 +2,27 @@ package background
 
 import (
 	"context"
+	"errors"
+	"github.com/chiefsend/api/logging"
 	m "github.com/chiefsend/api/models"
+	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
+	"gopkg.in/guregu/null.v4"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 // A list of task types.
 const (
 	DeleteShare      = "share:delete"
 	ContinuousDelete = "continuous:delete"
+	DeliverWebhook   = "webhook:deliver"
+	NotifyEmail      = "notify:email"
+	ExpiryReminder   = "notify:expiring"
+	AuditRetention   = "audit:retention"
 )
 
 // Tasks
@@ -18,13 +31,23 @@ func NewDeleteShareTask(share m.Share) *asynq.Task {
 	return asynq.NewTask(DeleteShare, payload)
 }
 
+// NewExpireShareTask deletes the share only if it is expired when the task runs
+func NewExpireShareTask(share m.Share) *asynq.Task {
+	payload := map[string]interface{}{"share_id": share.ID.String(), "expiry": true}
+	return asynq.NewTask(DeleteShare, payload)
+}
+
 func NewContinuousDeleteTask() *asynq.Task {
 	return asynq.NewTask(ContinuousDelete, map[string]interface{}{})
 }
 
+func NewAuditRetentionTask() *asynq.Task {
+	return asynq.NewTask(AuditRetention, map[string]interface{}{})
+}
+
 // Handlers
 func HandleDeleteShareTask(ctx context.Context, t *asynq.Task) error {
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -33,28 +56,153 @@ func HandleDeleteShareTask(ctx context.Context, t *asynq.Task) error {
 	if err != nil {
 		return err
 	}
-	return db.Where("ID = ?", id).Delete(&m.Share{}).Error
+	expiry, _ := t.Payload.GetBool("expiry")
+	var deleted *m.Share
+	err = m.Transaction(db, func(uow *m.UnitOfWork) error {
+		var share m.Share
+		err := uow.DB().Where("ID = ?", id).First(&share).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil // already gone
+		}
+		if err != nil {
+			return err
+		}
+		// the expiry might have changed since the task was enqueued
+		if expiry && !share.IsExpired(time.Now()) {
+			logging.FromContext(ctx).Info("share is not expired anymore, not deleting it", "share", share.ID)
+			return nil
+		}
+		if err := uow.DB().Delete(&share).Error; err != nil {
+			return err
+		}
+		deleted = &share
+		action := m.AuditShareDeleted
+		if expiry {
+			action = m.AuditShareExpired
+		}
+		return auditDeletion(ctx, uow.DB(), action, share)
+	})
+	if err != nil || deleted == nil {
+		return err
+	}
+	// notify
+	if expiry {
+		EmitEvent(ctx, m.EventShareExpired, *deleted)
+	}
+	EmitEvent(ctx, m.EventShareDeleted, *deleted)
+	return nil
 }
 
+// HandleContinuousDeleteTask reaps temporary shares older than jobs.temporary_share_ttl and temp directories without a share
+// and schedules the missing deletions of finalized shares
 func HandleContinuousDeleteTask(ctx context.Context, t *asynq.Task) error {
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(ctx)
 	if err != nil {
 		return err
 	}
+	deadline := time.Now().Add(-conf.Jobs.TemporaryShareTTL)
 
-	//var tm = time.Now()
+	// abandoned uploads
 	var shares []m.Share
-	if err := db.Find(&shares).Error; err != nil {
+	if err := db.Where("is_temporary = ? AND created_at < ?", true, deadline).Find(&shares).Error; err != nil {
 		return err
 	}
-
 	for _, sh := range shares {
-		if sh.IsTemporary { // && tm.After(sh.CreatedAt.Add(24*time.Hour)) { // only delete open jobs if older than one day FIXME
-			if err := db.Delete(&sh).Error; err != nil {
+		err := m.Transaction(db, func(uow *m.UnitOfWork) error {
+			if err := uow.DB().Delete(&sh).Error; err != nil {
+				return err
+			}
+			return auditDeletion(ctx, uow.DB(), m.AuditShareCleanup, sh)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// orphaned directories (only old ones, BeforeCreate makes the directory before the row exists)
+	tempDir := filepath.Join(m.MediaDir(), "temp")
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var orphans int
+	for _, e := range entries {
+		id, err := uuid.Parse(e.Name())
+		if err != nil || !e.IsDir() || e.ModTime().After(deadline) {
+			continue
+		}
+		var count int64
+		if err := db.Model(&m.Share{}).Where("id = ?", id.String()).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			if err := os.RemoveAll(filepath.Join(tempDir, e.Name())); err != nil {
+				return err
+			}
+			orphans++
+		}
+	}
+
+	// leftovers of units of work that crashed midway
+	stagingDir := filepath.Join(m.MediaDir(), "staging")
+	staged, err := ioutil.ReadDir(stagingDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range staged {
+		if e.ModTime().Before(deadline) {
+			if err := os.RemoveAll(filepath.Join(stagingDir, e.Name())); err != nil {
 				return err
 			}
 		}
 	}
 
+	// finalized shares whose deletion couldn't be scheduled
+	var unscheduled []m.Share
+	err = db.Where("is_temporary = ? AND expires IS NOT NULL AND (deletion_task IS NULL OR deletion_task = ?)", false, "").
+		Find(&unscheduled).Error
+	if err != nil {
+		return err
+	}
+	for i := range unscheduled {
+		if err := ScheduleShareDeletion(ctx, &unscheduled[i]); err != nil {
+			return err
+		}
+	}
+
+	logging.FromContext(ctx).Info("continuous delete done", "temporary_shares", len(shares), "orphaned_dirs", orphans,
+		"scheduled_deletions", len(unscheduled))
+	return nil
+}
+
+// auditDeletion records the deletion of the share by the workers, with the id of the request which asked for it
+func auditDeletion(ctx context.Context, tx *gorm.DB, action string, share m.Share) error {
+	changes, err := m.ShareDiff(&share, nil)
+	if err != nil {
+		return err
+	}
+	entry := m.AuditEntry{Actor: m.ActorSystem, Action: action, ShareID: share.ID, Changes: changes}
+	if id := logging.RequestID(ctx); id != "" {
+		entry.RequestID = null.StringFrom(id)
+	}
+	return m.Audit(tx, entry)
+}
+
+// HandleAuditRetentionTask deletes the audit log entries older than jobs.audit_retention
+func HandleAuditRetentionTask(ctx context.Context, t *asynq.Task) error {
+	if conf.Jobs.AuditRetention == 0 {
+		return nil
+	}
+	db, err := m.GetDatabaseContext(ctx)
+	if err != nil {
+		return err
+	}
+	n, err := m.PruneAuditLog(db, conf.Jobs.AuditRetention)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		logging.FromContext(ctx).Info("pruned audit log", "entries", n)
+	}
 	return nil
 }
@@ -1,12 +1,35 @@
 package background
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/chiefsend/api/config"
+	"github.com/chiefsend/api/logging"
 	"github.com/chiefsend/api/models"
+	"github.com/chiefsend/api/tracing"
 	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"gopkg.in/guregu/null.v4"
 	"gorm.io/gorm"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,13 +37,20 @@ import (
 var db *gorm.DB
 
 func TestMain(m *testing.M) {
+	c, err := config.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	models.Configure(c)
+	Configure(c)
 	dab, err := models.GetDatabase()
 	if err != nil {
 		log.Fatal("database brok")
 	}
 	db = dab
-	_ = db.AutoMigrate(&models.Share{})
-	_ = db.AutoMigrate(&models.Attachment{})
+	if _, err := models.MigrateUp(db); err != nil {
+		log.Fatal(err)
+	}
 
 	os.Exit(m.Run())
 }
@@ -33,18 +63,131 @@ func TestHandleDeleteShareTask(t *testing.T) {
 	}
 	db.Create(&share)
 	defer db.Delete(&share)
-	go StartBackgroundWorkers()
-	defer StopBackgroundWorkers()
+	if err := StartBackgroundWorkers(); err != nil {
+		t.Fatal(err)
+	}
+	defer StopBackgroundWorkers(context.Background())
 
 	t.Run("happy path", func(t *testing.T) {
 		task := NewDeleteShareTask(share)
-		err := EnqueueJob(task, nil)
+		err := EnqueueJob(context.Background(), task, nil)
 		assert.Nil(t, err)
 		time.Sleep(time.Second)
 		// check
 		var sh models.Share
 		err = db.Where("ID = ?", share.ID.String()).First(&sh).Error
 		assert.Error(t, gorm.ErrRecordNotFound, err)
+		// audited
+		var entries []models.AuditEntry
+		db.Where("share_id = ?", share.ID.String()).Find(&entries)
+		defer db.Where("share_id = ?", share.ID.String()).Delete(&models.AuditEntry{})
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, models.ActorSystem, entries[0].Actor)
+			assert.Equal(t, models.AuditShareDeleted, entries[0].Action)
+			assert.Contains(t, entries[0].Changes, "id")
+		}
+	})
+}
+
+func TestHandleAuditRetentionTask(t *testing.T) {
+	shareID := uuid.MustParse("3b7e9c1d-2a4f-4d6b-8e0c-5f1a3b7d9e02")
+	old := models.AuditEntry{CreatedAt: time.Now().Add(-conf.Jobs.AuditRetention - time.Hour), Actor: models.ActorAdmin, Action: models.AuditShareUpdate, ShareID: shareID}
+	recent := models.AuditEntry{Actor: models.ActorAdmin, Action: models.AuditShareDelete, ShareID: shareID}
+	db.Create(&old)
+	db.Create(&recent)
+	defer db.Where("share_id = ?", shareID.String()).Delete(&models.AuditEntry{})
+
+	err := HandleAuditRetentionTask(context.Background(), NewAuditRetentionTask())
+	assert.Nil(t, err)
+	var entries []models.AuditEntry
+	db.Where("share_id = ?", shareID.String()).Find(&entries)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, recent.ID, entries[0].ID)
+	}
+}
+
+func TestEnqueueJob(t *testing.T) {
+	t.Run("without workers", func(t *testing.T) {
+		task := NewDeleteShareTask(models.Share{ID: uuid.New()})
+		at := time.Now().Add(time.Hour)
+		key, err := enqueue(context.Background(), task, &at)
+		assert.Nil(t, err)
+		defer CancelTask(defaultQueue, key)
+		assert.Nil(t, Ping())
+	})
+
+	t.Run("request id", func(t *testing.T) {
+		share := models.Share{ID: uuid.New()}
+		at := time.Now().Add(time.Hour)
+		key, err := enqueue(logging.WithRequestID(context.Background(), "req-1"), NewDeleteShareTask(share), &at)
+		assert.Nil(t, err)
+		defer CancelTask(defaultQueue, key)
+		tasks, err := ListTasks(defaultQueue, StateScheduled, 0, 100)
+		assert.Nil(t, err)
+		var found bool
+		for _, task := range tasks {
+			if task.Key == key {
+				found = true
+				id, _ := task.Payload.GetString("request_id")
+				assert.Equal(t, "req-1", id)
+				shareID, _ := task.Payload.GetString("share_id")
+				assert.Equal(t, share.ID.String(), shareID)
+			}
+		}
+		assert.True(t, found)
+	})
+
+	t.Run("trace context", func(t *testing.T) {
+		rec := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+		defer otel.SetTracerProvider(noop.NewTracerProvider())
+		ctx, request := tracing.Start(context.Background(), "POST /share/{id}")
+		at := time.Now().Add(time.Hour)
+		key, err := enqueue(ctx, NewDeleteShareTask(models.Share{ID: uuid.New()}), &at)
+		assert.Nil(t, err)
+		defer CancelTask(defaultQueue, key)
+		request.End()
+		tasks, err := ListTasks(defaultQueue, StateScheduled, 0, 100)
+		assert.Nil(t, err)
+		var carrier map[string]string
+		for _, task := range tasks {
+			if task.Key == key {
+				carrier, _ = task.Payload.GetStringMapString("trace")
+			}
+		}
+		// handle it
+		handler := traceTasks(asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error { return nil }))
+		err = handler.ProcessTask(context.Background(), asynq.NewTask(DeleteShare, map[string]interface{}{"trace": carrier}))
+		assert.Nil(t, err)
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range rec.Ended() {
+			spans[span.Name()] = span
+		}
+		if assert.Contains(t, spans, "enqueue "+DeleteShare) && assert.Contains(t, spans, DeleteShare) {
+			enqueued, handled := spans["enqueue "+DeleteShare], spans[DeleteShare]
+			assert.Equal(t, request.SpanContext().SpanID(), enqueued.Parent().SpanID())
+			assert.Equal(t, enqueued.SpanContext().SpanID(), handled.Parent().SpanID())
+			assert.Equal(t, request.SpanContext().TraceID(), handled.SpanContext().TraceID())
+		}
+	})
+
+	t.Run("redis unreachable", func(t *testing.T) {
+		defer Configure(conf)
+		c := conf
+		c.Redis.URI = "127.0.0.1:1"
+		Configure(c)
+		err := EnqueueJob(context.Background(), NewDeleteShareTask(models.Share{ID: uuid.New()}), nil)
+		assert.NotNil(t, err)
+		assert.NotNil(t, Ping())
+	})
+
+	t.Run("not configured", func(t *testing.T) {
+		defer Configure(conf)
+		c := conf
+		c.Redis.URI = ""
+		Configure(c)
+		err := EnqueueJob(context.Background(), NewDeleteShareTask(models.Share{ID: uuid.New()}), nil)
+		assert.ErrorIs(t, err, ErrNotConfigured)
 	})
 }
 
@@ -60,21 +203,469 @@ func TestHandleContinuousDeleteTask(t *testing.T) {
 			CreatedAt:   time.Now().Add(-10 * time.Hour), // should not be deleted
 			IsTemporary: true,
 		},
+		{
+			ID:          uuid.MustParse("0f8e7d92-5a39-4c29-9d43-43e3d1ad3a8f"),
+			CreatedAt:   time.Now().Add(-30 * time.Hour), // should not be deleted (finalized)
+			IsTemporary: false,
+		},
+		{
+			ID:          uuid.MustParse("3c9d2b1a-6e4f-4a87-b0c5-d8e7f6a5b403"),
+			Expires:     null.TimeFrom(time.Now().Add(time.Hour)), // finalized without a deletion, should get one
+			IsTemporary: false,
+		},
 	}
-	for _, sh := range shares {
-		db.Create(&sh)
-		defer db.Delete(&sh)
+	for i := range shares {
+		db.Create(&shares[i])
+		defer db.Delete(&shares[i])
 	}
+	if redis == nil {
+		redis = &asynq.RedisClientOpt{Addr: os.Getenv("REDIS_URI")}
+	}
+	// orphaned directories
+	old := filepath.Join(os.Getenv("MEDIA_DIR"), "temp", "6ad7c4a5-2f4e-4b8c-8f43-7c0b0c1f4a11")
+	recent := filepath.Join(os.Getenv("MEDIA_DIR"), "temp", "d3f1a0f2-81f7-4b64-a6e2-52f2b9a64e3c")
+	_ = os.MkdirAll(old, os.ModePerm)
+	_ = os.MkdirAll(recent, os.ModePerm)
+	_ = os.Chtimes(old, time.Now().Add(-30*time.Hour), time.Now().Add(-30*time.Hour))
+	defer os.RemoveAll(recent)
 
 	t.Run("happy path", func(t *testing.T) {
-		task := NewContinuousDeleteTask()
-		err := EnqueueJob(task, nil)
+		err := HandleContinuousDeleteTask(context.Background(), NewContinuousDeleteTask())
 		assert.Nil(t, err)
-		time.Sleep(time.Second)
 		// assertions
 		var actual []models.Share
-		err = db.Find(&actual).Error
+		err = db.Where("id IN ?", []string{shares[0].ID.String(), shares[1].ID.String(), shares[2].ID.String()}).Find(&actual).Error
+		assert.Nil(t, err)
+		assert.Len(t, actual, 2)
+		var scheduled models.Share
+		db.Where("id = ?", shares[3].ID.String()).First(&scheduled)
+		assert.True(t, scheduled.DeletionTask.Valid)
+		assert.Nil(t, CancelShareDeletion(&scheduled))
+		for _, sh := range actual {
+			assert.NotEqual(t, shares[0].ID, sh.ID)
+		}
+		assert.NoDirExists(t, filepath.Join(os.Getenv("MEDIA_DIR"), "temp", shares[0].ID.String()))
+		assert.DirExists(t, filepath.Join(os.Getenv("MEDIA_DIR"), "temp", shares[1].ID.String()))
+		assert.NoDirExists(t, old)
+		assert.DirExists(t, recent)
+	})
+}
+
+func TestShareDeletion(t *testing.T) {
+	var share = models.Share{
+		ID:      uuid.MustParse("c0a5b1e4-7d2f-4f36-9a8e-0b6f3e2d1c57"),
+		Expires: null.TimeFrom(time.Now().Add(time.Hour)),
+	}
+	db.Create(&share)
+	defer db.Delete(&share)
+	if redis == nil {
+		redis = &asynq.RedisClientOpt{Addr: os.Getenv("REDIS_URI")}
+	}
+	at := share.Expires.Time
+	assert.Nil(t, EnqueueJob(context.Background(), NewDeleteShareTask(share), &at))
+
+	t.Run("find", func(t *testing.T) {
+		task, err := FindShareDeletion(share)
+		assert.Nil(t, err)
+		assert.Equal(t, DeleteShare, task.Type)
+		assert.Equal(t, StateScheduled, task.State)
+		assert.WithinDuration(t, at, *task.NextProcessAt, time.Second)
+	})
+
+	t.Run("reschedule", func(t *testing.T) {
+		later := time.Now().Add(2 * time.Hour)
+		err := RescheduleShareDeletion(context.Background(), &share, later)
+		assert.Nil(t, err)
+		task, err := FindShareDeletion(share)
+		assert.Nil(t, err)
+		assert.WithinDuration(t, later, *task.NextProcessAt, time.Second)
+		// the old one is gone
+		tasks, err := ListTasks("", StateScheduled, 1, 100)
+		assert.Nil(t, err)
+		var n int
+		for _, tk := range tasks {
+			if id, _ := tk.Payload.GetString("share_id"); id == share.ID.String() {
+				n++
+			}
+		}
+		assert.Equal(t, 1, n)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		err := CancelShareDeletion(&share)
+		assert.Nil(t, err)
+		_, err = FindShareDeletion(share)
+		assert.True(t, errors.Is(err, ErrNoDeletion))
+		err = CancelShareDeletion(&share)
+		assert.True(t, errors.Is(err, ErrNoDeletion))
+	})
+
+	t.Run("unknown task", func(t *testing.T) {
+		err := CancelTask("", "s:"+uuid.New().String()+":1")
+		assert.True(t, errors.Is(err, ErrTaskNotFound))
+		err = RunTask("", "s:"+uuid.New().String()+":1")
+		assert.True(t, errors.Is(err, ErrTaskNotFound))
+		err = CancelTask("", "garbage")
+		assert.True(t, errors.Is(err, ErrTaskNotFound))
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		share.DeletionTask = null.StringFrom("s:garbage")
+		err := CancelShareDeletion(&share)
+		assert.True(t, errors.Is(err, ErrNoDeletion))
+		assert.False(t, share.DeletionTask.Valid)
+	})
+
+	t.Run("without key", func(t *testing.T) {
+		// deletions of shares finalized before the keys were stored are only cancelled on request
+		assert.Nil(t, EnqueueJob(context.Background(), NewDeleteShareTask(share), &at))
+		err := CancelShareDeletion(&share)
+		assert.True(t, errors.Is(err, ErrNoDeletion))
+		_, err = FindShareDeletion(share)
+		assert.Nil(t, err)
+		assert.Nil(t, AdoptShareDeletion(&share))
+		assert.True(t, share.DeletionTask.Valid)
+		assert.Nil(t, CancelShareDeletion(&share))
+		_, err = FindShareDeletion(share)
+		assert.True(t, errors.Is(err, ErrNoDeletion))
+	})
+
+	t.Run("invalid state", func(t *testing.T) {
+		_, err := ListTasks("", "sleeping", 1, 10)
+		assert.True(t, errors.Is(err, ErrInvalidState))
+	})
+
+	t.Run("queue stats", func(t *testing.T) {
+		stats, err := GetQueueStats()
+		assert.Nil(t, err)
+		assert.NotEmpty(t, stats)
+	})
+}
+
+func TestScheduleShareDeletion(t *testing.T) {
+	var share = models.Share{
+		ID:      uuid.MustParse("7b3e9f21-4c8a-4d5e-b1f6-2a9c0d8e7f34"),
+		Expires: null.TimeFrom(time.Now().Add(time.Hour)),
+	}
+	db.Create(&share)
+	defer db.Delete(&share)
+	if redis == nil {
+		redis = &asynq.RedisClientOpt{Addr: os.Getenv("REDIS_URI")}
+	}
+
+	t.Run("happy path", func(t *testing.T) {
+		err := ScheduleShareDeletion(context.Background(), &share)
+		assert.Nil(t, err)
+		assert.True(t, share.DeletionTask.Valid)
+		// the key is stored
+		var sh models.Share
+		db.Where("id = ?", share.ID).First(&sh)
+		assert.Equal(t, share.DeletionTask, sh.DeletionTask)
+	})
+
+	t.Run("expiry changed", func(t *testing.T) {
+		old := share.DeletionTask
+		share.Expires = null.TimeFrom(time.Now().Add(3 * time.Hour))
+		err := ScheduleShareDeletion(context.Background(), &share)
+		assert.Nil(t, err)
+		assert.NotEqual(t, old, share.DeletionTask)
+		task, err := FindShareDeletion(share)
+		assert.Nil(t, err)
+		assert.Equal(t, share.DeletionTask.String, task.Key)
+		assert.WithinDuration(t, share.Expires.Time, *task.NextProcessAt, 2*time.Second)
+		// the old one is cancelled
+		assert.True(t, errors.Is(CancelTask("", old.String), ErrTaskNotFound))
+	})
+
+	t.Run("expiry removed", func(t *testing.T) {
+		share.Expires = null.Time{}
+		err := ScheduleShareDeletion(context.Background(), &share)
+		assert.Nil(t, err)
+		assert.False(t, share.DeletionTask.Valid)
+		_, err = FindShareDeletion(share)
+		assert.True(t, errors.Is(err, ErrNoDeletion))
+	})
+}
+
+func TestHandleExpireShareTask(t *testing.T) {
+	var shares = []models.Share{
+		{
+			ID:      uuid.MustParse("2f6a1c9e-8b3d-4e7f-a5c2-9d0b4e6f1a38"),
+			Expires: null.TimeFrom(time.Now().Add(time.Hour)), // extended, should not be deleted
+		},
+		{
+			ID:      uuid.MustParse("95d2e7b4-1a6c-4f38-8e9d-3c7b0a5f2e61"),
+			Expires: null.TimeFrom(time.Now().Add(-time.Minute)), // should be deleted
+		},
+	}
+	for i := range shares {
+		db.Create(&shares[i])
+		defer db.Delete(&shares[i])
+	}
+
+	t.Run("happy path", func(t *testing.T) {
+		for _, sh := range shares {
+			err := HandleDeleteShareTask(context.Background(), NewExpireShareTask(sh))
+			assert.Nil(t, err)
+		}
+		// assertions
+		var actual []models.Share
+		err := db.Where("id IN ?", []string{shares[0].ID.String(), shares[1].ID.String()}).Find(&actual).Error
 		assert.Nil(t, err)
 		assert.Len(t, actual, 1)
+		assert.Equal(t, shares[0].ID, actual[0].ID)
+	})
+}
+
+func TestHandleDeliverWebhookTask(t *testing.T) {
+	var received *http.Request
+	var receivedBody []byte
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	wh := models.Webhook{URL: ts.URL, Events: models.EventList{models.EventShareFinalized}, Active: true}
+	db.Create(&wh)
+	defer db.Where("webhook_id = ?", wh.ID).Delete(&models.WebhookDelivery{})
+	defer db.Delete(&wh)
+	ev := Event{ID: uuid.New(), Type: models.EventShareFinalized, Share: models.Share{ID: uuid.New()}}
+	body, _ := json.Marshal(ev)
+
+	t.Run("happy path", func(t *testing.T) {
+		err := HandleDeliverWebhookTask(context.Background(), NewDeliverWebhookTask(wh, ev, body))
+		assert.Nil(t, err)
+		// assertions
+		assert.Equal(t, body, receivedBody)
+		assert.Equal(t, models.EventShareFinalized, received.Header.Get("X-ChiefSend-Event"))
+		assert.Equal(t, ev.ID.String(), received.Header.Get("X-ChiefSend-Delivery"))
+		timestamp, _ := strconv.ParseInt(received.Header.Get("X-ChiefSend-Timestamp"), 10, 64)
+		assert.Equal(t, Signature(wh.Secret, timestamp, body), received.Header.Get("X-ChiefSend-Signature"))
+		var deliveries []models.WebhookDelivery
+		db.Where("webhook_id = ?", wh.ID).Find(&deliveries)
+		assert.Len(t, deliveries, 1)
+		assert.Equal(t, http.StatusOK, deliveries[0].StatusCode)
+		assert.Equal(t, 1, deliveries[0].Attempt)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		err := HandleDeliverWebhookTask(context.Background(), NewDeliverWebhookTask(wh, ev, body))
+		assert.Error(t, err)
+		var d models.WebhookDelivery
+		db.Where("webhook_id = ? AND status_code = ?", wh.ID, 500).First(&d)
+		assert.Equal(t, ev.ID, d.EventID)
+		assert.NotEmpty(t, d.Error)
+	})
+
+	t.Run("webhook deleted", func(t *testing.T) {
+		gone := models.Webhook{ID: uuid.New(), URL: ts.URL}
+		err := HandleDeliverWebhookTask(context.Background(), NewDeliverWebhookTask(gone, ev, body))
+		assert.Nil(t, err)
+	})
+
+	t.Run("invalid event id", func(t *testing.T) {
+		task := asynq.NewTask(DeliverWebhook, map[string]interface{}{
+			"webhook_id": wh.ID.String(), "event_id": "kekw", "event": ev.Type, "body": string(body)})
+		err := HandleDeliverWebhookTask(context.Background(), task)
+		assert.ErrorIs(t, err, asynq.SkipRetry)
+	})
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookBackoff(0))
+	assert.Equal(t, time.Minute, webhookBackoff(1))
+	assert.Equal(t, 8*time.Minute, webhookBackoff(4))
+	assert.Equal(t, 6*time.Hour, webhookBackoff(10))
+	assert.Equal(t, 6*time.Hour, webhookBackoff(100))
+	// used for deliveries only
+	task := NewDeliverWebhookTask(models.Webhook{}, Event{}, nil)
+	assert.Equal(t, webhookBackoff(3), retryDelay(3, nil, task))
+}
+
+func TestEmitEvent(t *testing.T) {
+	webhooks := []models.Webhook{
+		{URL: "https://example.com/a", Events: models.EventList{models.EventShareFinalized}, Active: true},
+		{URL: "https://example.com/b", Events: models.EventList{models.EventShareDeleted}, Active: true}, // not subscribed
+	}
+	for i := range webhooks {
+		db.Create(&webhooks[i])
+		defer db.Delete(&webhooks[i])
+	}
+	if redis == nil {
+		redis = &asynq.RedisClientOpt{Addr: os.Getenv("REDIS_URI")}
+	}
+
+	t.Run("happy path", func(t *testing.T) {
+		EmitEvent(context.Background(), models.EventShareFinalized, models.Share{ID: uuid.New(), Password: null.StringFrom("hash")})
+		// assertions
+		tasks, err := ListTasks("", StatePending, 1, 100)
+		assert.Nil(t, err)
+		found := map[string]string{}
+		for _, tk := range tasks {
+			if tk.Type == DeliverWebhook {
+				id, _ := tk.Payload.GetString("webhook_id")
+				found[id], _ = tk.Payload.GetString("body")
+			}
+		}
+		assert.Contains(t, found, webhooks[0].ID.String())
+		assert.NotContains(t, found, webhooks[1].ID.String())
+		assert.NotContains(t, found[webhooks[0].ID.String()], "hash")
+	})
+}
+
+// smtpSink accepts mails on a local port and passes their data on
+func smtpSink(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				_ = tp.PrintfLine("220 localhost ESMTP sink")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+					case "DATA":
+						_ = tp.PrintfLine("354 go ahead")
+						data, _ := tp.ReadDotBytes()
+						mails <- string(data)
+						_ = tp.PrintfLine("250 ok")
+					case "QUIT":
+						_ = tp.PrintfLine("221 bye")
+						return
+					default:
+						_ = tp.PrintfLine("250 ok")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), mails
+}
+
+func TestHandleNotifyEmailTask(t *testing.T) {
+	addr, mails := smtpSink(t)
+	host, port, _ := net.SplitHostPort(addr)
+	defer Configure(conf)
+	c := conf
+	c.SMTP.Host, c.SMTP.From, c.PublicURL = host, "chiefsend@example.com", "https://send.example.com/"
+	c.SMTP.Port, _ = strconv.Atoi(port)
+	Configure(c)
+	var share = models.Share{
+		ID:            uuid.MustParse("d4c1e2a7-9f3b-4b6e-8a5d-1c7f0e3b2a96"),
+		Name:          null.StringFrom("Holiday <Photos>"),
+		Expires:       null.TimeFrom(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)),
+		DownloadLimit: null.IntFrom(3),
+	}
+	db.Create(&share)
+	defer db.Delete(&share)
+
+	read := func(t *testing.T) (*mail.Message, string, string) {
+		var raw string
+		select {
+		case raw = <-mails:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no mail received")
+		}
+		msg, err := mail.ReadMessage(strings.NewReader(raw))
+		assert.Nil(t, err)
+		_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		parts := multipart.NewReader(msg.Body, params["boundary"])
+		var bodies []string
+		for {
+			p, err := parts.NextPart()
+			if err != nil {
+				break
+			}
+			b, _ := ioutil.ReadAll(p)
+			bodies = append(bodies, string(b))
+		}
+		assert.Len(t, bodies, 2)
+		return msg, bodies[0], bodies[1]
+	}
+
+	t.Run("happy path", func(t *testing.T) {
+		err := HandleNotifyEmailTask(context.Background(), NewNotifyEmailTask(EmailShared, "bob@example.com", share, true))
+		assert.Nil(t, err)
+		msg, text, html := read(t)
+		// assertions
+		subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		assert.Equal(t, "Holiday <Photos> shared with you", subject)
+		assert.Equal(t, "bob@example.com", msg.Header.Get("To"))
+		assert.Contains(t, text, "https://send.example.com/share/"+share.ID.String())
+		assert.Contains(t, text, "3 more times")
+		assert.Contains(t, html, "Holiday &lt;Photos&gt;")
+	})
+
+	t.Run("without details", func(t *testing.T) {
+		err := HandleNotifyEmailTask(context.Background(), NewNotifyEmailTask(EmailShared, "bob@example.com", share, false))
+		assert.Nil(t, err)
+		_, text, _ := read(t)
+		assert.NotContains(t, text, "more times")
+	})
+
+	t.Run("share deleted", func(t *testing.T) {
+		err := HandleNotifyEmailTask(context.Background(), NewNotifyEmailTask(EmailShared, "bob@example.com", models.Share{ID: uuid.New()}, false))
+		assert.Nil(t, err)
+	})
+}
+
+func TestHandleExpiryReminderTask(t *testing.T) {
+	defer Configure(conf)
+	c := conf
+	c.SMTP.Host, c.SMTP.From = "127.0.0.1", "chiefsend@example.com"
+	Configure(c)
+	var shares = []models.Share{
+		{
+			ID:         uuid.MustParse("4a8e2c6f-0b1d-4e3a-9c7b-5f2d8e1a6c30"),
+			Expires:    null.TimeFrom(time.Now().Add(time.Hour)), // should be reminded
+			OwnerEmail: null.StringFrom("alice@example.com"),
+		},
+		{
+			ID:         uuid.MustParse("8c3f5a1e-6d2b-4f7c-a0e9-2b4d6f8a1c53"),
+			Expires:    null.TimeFrom(time.Now().Add(72 * time.Hour)), // not yet
+			OwnerEmail: null.StringFrom("alice@example.com"),
+		},
+	}
+	for i := range shares {
+		db.Create(&shares[i])
+		defer db.Delete(&shares[i])
+	}
+	if redis == nil {
+		redis = &asynq.RedisClientOpt{Addr: os.Getenv("REDIS_URI")}
+	}
+
+	t.Run("happy path", func(t *testing.T) {
+		err := HandleExpiryReminderTask(context.Background(), NewExpiryReminderTask())
+		assert.Nil(t, err)
+		// assertions
+		var actual []models.Share
+		db.Where("id IN ?", []string{shares[0].ID.String(), shares[1].ID.String()}).Order("expires").Find(&actual)
+		assert.True(t, actual[0].ReminderSent)
+		assert.False(t, actual[1].ReminderSent)
+		tasks, err := ListTasks("", StatePending, 1, 100)
+		assert.Nil(t, err)
+		var n int
+		for _, tk := range tasks {
+			if id, _ := tk.Payload.GetString("share_id"); tk.Type == NotifyEmail && id == shares[0].ID.String() {
+				n++
+			}
+		}
+		assert.NotZero(t, n)
 	})
 }
@@ -0,0 +1,193 @@
+package background
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/chiefsend/api/logging"
+	m "github.com/chiefsend/api/models"
+	"github.com/google/uuid"
+	"github.com/hibiken/asynq"
+	"gorm.io/gorm"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	webhookMaxRetry  = 10
+	webhookTimeout   = 10 * time.Second
+	webhookBaseDelay = 30 * time.Second
+	webhookMaxDelay  = 6 * time.Hour
+)
+
+// Event is the JSON body of a webhook delivery
+type Event struct {
+	ID        uuid.UUID `json:"id"`
+	Type      string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Share     m.Share   `json:"share"`
+}
+
+func NewDeliverWebhookTask(wh m.Webhook, event Event, body []byte) *asynq.Task {
+	payload := map[string]interface{}{
+		"webhook_id": wh.ID.String(),
+		"event_id":   event.ID.String(),
+		"event":      event.Type,
+		"body":       string(body),
+	}
+	return asynq.NewTask(DeliverWebhook, payload)
+}
+
+// EmitEvent enqueues a delivery to every active webhook subscribed to the event.
+// Events are best effort, errors are only logged.
+func EmitEvent(ctx context.Context, event string, share m.Share) {
+	if err := emitEvent(ctx, event, share); err != nil {
+		logging.FromContext(ctx).Error("can't emit event", "event", event, "share", share.ID, "error", err)
+	}
+}
+
+func emitEvent(ctx context.Context, event string, share m.Share) error {
+	db, err := m.GetDatabaseContext(ctx)
+	if err != nil {
+		return err
+	}
+	var webhooks []m.Webhook
+	if err := db.Where("active = ?", true).Find(&webhooks).Error; err != nil {
+		return err
+	}
+	share.Secure()
+	ev := Event{ID: uuid.New(), Type: event, CreatedAt: time.Now().UTC(), Share: share}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	for _, wh := range webhooks {
+		if !wh.Events.Contains(event) {
+			continue
+		}
+		if _, err := enqueue(ctx, NewDeliverWebhookTask(wh, ev, body), nil, asynq.MaxRetry(webhookMaxRetry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Signature returns the value of the X-ChiefSend-Signature header: the hex HMAC-SHA256 of "<timestamp>.<body>"
+func Signature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// HandleDeliverWebhookTask posts the event to the webhook and logs the attempt. Failed attempts get retried.
+func HandleDeliverWebhookTask(ctx context.Context, t *asynq.Task) error {
+	db, err := m.GetDatabaseContext(ctx)
+	if err != nil {
+		return err
+	}
+	id, err := t.Payload.GetString("webhook_id")
+	if err != nil {
+		return err
+	}
+	eventID, err := t.Payload.GetString("event_id")
+	if err != nil {
+		return err
+	}
+	evID, err := uuid.Parse(eventID)
+	if err != nil {
+		return fmt.Errorf("invalid event_id %q: %v: %w", eventID, err, asynq.SkipRetry) // won't get any better
+	}
+	event, err := t.Payload.GetString("event")
+	if err != nil {
+		return err
+	}
+	body, err := t.Payload.GetString("body")
+	if err != nil {
+		return err
+	}
+	// get webhook
+	var wh m.Webhook
+	err = db.Where("id = ?", id).First(&wh).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil // deleted in the meantime
+	}
+	if err != nil {
+		return err
+	}
+	if !wh.Active {
+		return nil
+	}
+	// deliver and log the attempt
+	retried, _ := asynq.GetRetryCount(ctx)
+	delivery := m.WebhookDelivery{
+		WebhookID: wh.ID,
+		EventID:   evID,
+		Event:     event,
+		Payload:   body,
+		Attempt:   retried + 1,
+	}
+	start := time.Now()
+	delivery.StatusCode, err = deliver(ctx, wh, eventID, event, []byte(body))
+	delivery.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if dbErr := db.Create(&delivery).Error; dbErr != nil {
+		logging.FromContext(ctx).Error("can't log webhook delivery", "event", event, "webhook", wh.ID, "error", dbErr)
+	}
+	return err
+}
+
+func deliver(ctx context.Context, wh m.Webhook, eventID, event string, body []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ChiefSend-Webhook")
+	req.Header.Set("X-ChiefSend-Event", event)
+	req.Header.Set("X-ChiefSend-Delivery", eventID)
+	req.Header.Set("X-ChiefSend-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-ChiefSend-Signature", Signature(wh.Secret, timestamp, body))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook answered with %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// webhookBackoff doubles the delay with every retry: 30s, 1m, 2m, ... up to 6h
+func webhookBackoff(retried int) time.Duration {
+	if retried >= 20 {
+		return webhookMaxDelay
+	}
+	if d := webhookBaseDelay << uint(retried); d < webhookMaxDelay {
+		return d
+	}
+	return webhookMaxDelay
+}
+
+// retryDelay returns the delay before a failed task is retried
+func retryDelay(n int, err error, t *asynq.Task) time.Duration {
+	if t.Type == DeliverWebhook {
+		return webhookBackoff(n)
+	}
+	return asynq.DefaultRetryDelayFunc(n, err, t)
+}
@@ -1,102 +1,277 @@
 package background
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/chiefsend/api/config"
+	"github.com/chiefsend/api/logging"
+	"github.com/chiefsend/api/metrics"
+	"github.com/chiefsend/api/tracing"
 	"github.com/hibiken/asynq"
 	"github.com/hibiken/asynq/inspeq"
-	"log"
-	"os"
-	"os/signal"
-	"strconv"
-	"syscall"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
 var redis *asynq.RedisClientOpt
+var client *asynq.Client // enqueues, works without local workers
 var srv *asynq.Server
+var scheduler *asynq.Scheduler
 
-func StartBackgroundWorkers() {
-	// create config
-	var db int
-	{
-		dbs := os.Getenv("REDIS_DB")
-		if dbs == "" {
-			db = 0
-		} else {
-			if dbi, err := strconv.Atoi(dbs); err != nil {
-				log.Fatal(err)
-			} else {
-				db = dbi
-			}
-		}
+var conf config.Config
+
+// Configure sets redis, the workers, their schedules and SMTP
+func Configure(c config.Config) {
+	conf = c
+	if client != nil {
+		_ = client.Close()
+		redis, client = nil, nil
 	}
-	password := os.Getenv("REDIS_PASSWORD")
-	if password == "" {
-		redis = &asynq.RedisClientOpt{Addr: os.Getenv("REDIS_URI"), DB: db}
-	} else {
-		redis = &asynq.RedisClientOpt{Addr: os.Getenv("REDIS_URI"), DB: db, Password: password}
+	if c.Redis.URI != "" {
+		redis = &asynq.RedisClientOpt{Addr: c.Redis.URI, DB: c.Redis.DB, Password: c.Redis.Password}
+		client = asynq.NewClient(*redis)
 	}
-	// create server
-	var workers int
-	{
-		workerCount := os.Getenv("BACKGROUND_WORKERS")
-		if workerCount == "" {
-			workers = 5
-		} else {
-			if workersInt, err := strconv.Atoi(workerCount); err != nil {
-				log.Fatal(err)
-			} else {
-				workers = workersInt
-			}
-		}
+}
+
+// Ping returns an error if redis doesn't answer
+func Ping() error {
+	i, err := inspector()
+	if err != nil {
+		return err
 	}
+	defer i.Close()
+	_, err = i.Queues()
+	return err
+}
+
+// Close closes the connections of the client enqueueing tasks
+func Close() error {
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+// StartBackgroundWorkers starts the workers and the scheduler of the periodic tasks, returns once they run
+func StartBackgroundWorkers() error {
+	if redis == nil {
+		return ErrNotConfigured
+	}
+	// create server
 	srv = asynq.NewServer(*redis, asynq.Config{
-		Concurrency: workers,
+		Concurrency:     conf.Jobs.Workers,
+		RetryDelayFunc:  retryDelay,
+		ShutdownTimeout: conf.ShutdownTimeout, // unfinished tasks go back to the queue
+		Logger:          asynqLogger{},
 	})
 	// setup tasks
 	mux := asynq.NewServeMux()
 	mux.HandleFunc(DeleteShare, HandleDeleteShareTask)
 	mux.HandleFunc(ContinuousDelete, HandleContinuousDeleteTask)
+	mux.HandleFunc(DeliverWebhook, HandleDeliverWebhookTask)
+	mux.HandleFunc(NotifyEmail, HandleNotifyEmailTask)
+	mux.HandleFunc(ExpiryReminder, HandleExpiryReminderTask)
+	mux.HandleFunc(AuditRetention, HandleAuditRetentionTask)
+	mux.Use(traceTasks, logTasks, countTasks)
 	// run server
 	if err := srv.Start(mux); err != nil {
-		log.Fatal(err)
+		return err
 	}
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt, os.Kill)
-	<-signals
-	StopBackgroundWorkers()
-	fmt.Println("stopped background workers ...")
-	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
-		log.Fatal(err)
+	// setup periodic tasks
+	scheduler = asynq.NewScheduler(*redis, &asynq.SchedulerOpts{Logger: asynqLogger{}})
+	if _, err := scheduler.Register(conf.Jobs.CleanupSchedule, NewContinuousDeleteTask()); err != nil {
+		return err
 	}
+	if _, err := scheduler.Register(conf.Jobs.ReminderSchedule, NewExpiryReminderTask()); err != nil {
+		return err
+	}
+	if _, err := scheduler.Register(conf.Jobs.CleanupSchedule, NewAuditRetentionTask()); err != nil {
+		return err
+	}
+	return scheduler.Start()
 }
 
-func StopBackgroundWorkers() {
-	srv.Stop()
+// logTasks gives each task a logger with its type, its id and the id of the request which enqueued it. Failed tasks
+// are logged.
+func logTasks(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		id, _ := asynq.GetTaskID(ctx)
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("task", t.Type, "task_id", id))
+		if reqID, err := t.Payload.GetString(requestIDKey); err == nil {
+			ctx = logging.WithRequestID(ctx, reqID)
+		}
+		log := logging.FromContext(ctx)
+		start := time.Now()
+		err := next.ProcessTask(ctx, t)
+		if err != nil {
+			retried, _ := asynq.GetRetryCount(ctx)
+			log.Error("task failed", "error", err, "retried", retried, "duration", time.Since(start))
+		} else {
+			log.Debug("task done", "duration", time.Since(start))
+		}
+		return err
+	})
 }
 
-func EnqueueJob(task *asynq.Task, at *time.Time) error {
-	// workers need to be running
-	if redis == nil {
+// traceTasks records a span of each task, as child of the span which enqueued it
+func traceTasks(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if carrier, err := t.Payload.GetStringMapString(traceKey); err == nil {
+			ctx = tracing.Extract(ctx, carrier)
+		}
+		ctx, span := tracing.StartKind(ctx, t.Type, trace.SpanKindConsumer, taskAttributes(t, "process")...)
+		if id, ok := asynq.GetTaskID(ctx); ok {
+			span.SetAttributes(semconv.MessagingMessageID(id))
+		}
+		if retried, ok := asynq.GetRetryCount(ctx); ok && retried > 0 {
+			span.SetAttributes(attribute.Int("asynq.retry_count", retried))
+		}
+		err := next.ProcessTask(ctx, t)
+		tracing.End(span, err)
+		return err
+	})
+}
+
+// taskAttributes returns the attributes of the spans of the task
+func taskAttributes(t *asynq.Task, operation string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingSystemKey.String("asynq"),
+		semconv.MessagingOperationName(operation),
+		attribute.String("asynq.task.type", t.Type),
+	}
+}
+
+// asynqLogger writes the logs of the workers and the scheduler through logging
+type asynqLogger struct{}
+
+func (asynqLogger) Debug(args ...interface{}) {
+	logging.Debug(fmt.Sprint(args...), "component", "asynq")
+}
+func (asynqLogger) Info(args ...interface{}) { logging.Info(fmt.Sprint(args...), "component", "asynq") }
+func (asynqLogger) Warn(args ...interface{}) { logging.Warn(fmt.Sprint(args...), "component", "asynq") }
+func (asynqLogger) Error(args ...interface{}) {
+	logging.Error(fmt.Sprint(args...), "component", "asynq")
+}
+func (asynqLogger) Fatal(args ...interface{}) {
+	logging.Fatal(fmt.Sprint(args...), "component", "asynq")
+}
+
+// countTasks counts the processed tasks by type and outcome
+func countTasks(next asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		err := next.ProcessTask(ctx, t)
+		outcome := "success"
+		if err != nil {
+			outcome = "failure"
+		}
+		metrics.Tasks.WithLabelValues(t.Type, outcome).Inc()
+		return err
+	})
+}
+
+// StopBackgroundWorkers stops the scheduler and waits for the running tasks until ctx is done
+func StopBackgroundWorkers(ctx context.Context) error {
+	if scheduler != nil {
+		scheduler.Stop()
+	}
+	if srv == nil {
+		return nil
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		srv, scheduler = nil, nil
 		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	client := asynq.NewClient(*redis)
-	if at != nil {
-		if _, err := client.Enqueue(task, asynq.ProcessAt(*at)); err != nil {
-			return err
+// EnqueueJob hands the task to the workers, at the given time or right away. Fails if redis can't be reached.
+func EnqueueJob(ctx context.Context, task *asynq.Task, at *time.Time) error {
+	_, err := enqueue(ctx, task, at)
+	return err
+}
+
+// keys added to the payload of tasks enqueued while handling a request
+const (
+	requestIDKey = "request_id"
+	traceKey     = "trace" // trace context of the enqueue span, the span of the handler is its child
+)
+
+// enqueue returns the key the inspector knows the task by
+func enqueue(ctx context.Context, task *asynq.Task, at *time.Time, opts ...asynq.Option) (key string, err error) {
+	if client == nil {
+		return "", ErrNotConfigured
+	}
+	ctx, span := tracing.StartKind(ctx, "enqueue "+task.Type, trace.SpanKindProducer, taskAttributes(task, "enqueue")...)
+	defer func() { tracing.End(span, err) }()
+	extra := map[string]interface{}{}
+	if id := logging.RequestID(ctx); id != "" {
+		extra[requestIDKey] = id
+	}
+	if carrier := tracing.Inject(ctx); len(carrier) > 0 {
+		extra[traceKey] = carrier
+	}
+	if len(extra) > 0 {
+		// the payload can only be set when creating the task
+		var payload map[string]interface{}
+		b, err := json.Marshal(task.Payload)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal(b, &payload); err != nil {
+			return "", err
 		}
-	} else {
-		if _, err := client.Enqueue(task); err != nil {
-			return err
+		for k, v := range extra {
+			payload[k] = v
 		}
+		task = asynq.NewTask(task.Type, payload)
+	}
+	if at != nil {
+		opts = append(opts, asynq.ProcessAt(*at))
+	}
+	res, err := client.Enqueue(task, opts...)
+	if err != nil {
+		return "", err
+	}
+	span.SetAttributes(semconv.MessagingMessageID(res.ID))
+	// tasks due already are pending right away
+	if res.ProcessAt.After(res.EnqueuedAt) {
+		return fmt.Sprintf("s:%s:%d", res.ID, res.ProcessAt.Unix()), nil
+	}
+	return fmt.Sprintf("p:%s:0", res.ID), nil
+}
+
+// Running tells if this process runs background workers
+func Running() bool {
+	return srv != nil
+}
+
+// Workers returns the background workers of all processes
+func Workers() ([]*inspeq.ServerInfo, error) {
+	i, err := inspector()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer i.Close()
+	return i.Servers()
 }
 
+// GetJobs returns the periodic tasks registered by the scheduler
 func GetJobs() ([]*inspeq.SchedulerEntry, error) {
 	// get inspector
-	i := inspeq.New(redis)
+	i, err := inspector()
+	if err != nil {
+		return nil, err
+	}
 	defer i.Close()
 	// get jobs
 	jobs, err := i.SchedulerEntries()
@@ -0,0 +1,394 @@
+// Package config holds the settings of the server. Later sources override earlier ones: the defaults,
+// the YAML file (-config or CONFIG_FILE), the environment and the command line flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/chiefsend/api/logging"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config of the api server and the background workers
+type Config struct {
+	Port          int           `yaml:"port"  env:"PORT"  flag:"port"  usage:"port the api listens to"`
+	MediaDir      string        `yaml:"media_dir"  env:"MEDIA_DIR"  flag:"media-dir"  usage:"absolute path where the files are saved"`
+	AdminKey      string        `yaml:"admin_key"  env:"ADMIN_KEY"`
+	PublicURL     string        `yaml:"public_url"  env:"PUBLIC_URL"  flag:"public-url"  usage:"base URL of the frontend, used in links"`
+	StatsCacheTTL time.Duration `yaml:"stats_cache_ttl"  env:"STATS_CACHE_TTL"`
+	// transfers and tasks in flight get this long to finish on SIGINT/SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"  env:"SHUTDOWN_TIMEOUT"  flag:"shutdown-timeout"  usage:"how long to wait for transfers and tasks in flight on shutdown"`
+
+	Database Database `yaml:"database"`
+	Redis    Redis    `yaml:"redis"`
+	Jobs     Jobs     `yaml:"jobs"`
+	Policy   Policy   `yaml:"policy"`
+	SMTP     SMTP     `yaml:"smtp"`
+	Health   Health   `yaml:"health"`
+	Metrics  Metrics  `yaml:"metrics"`
+	Log      Log      `yaml:"log"`
+	Tracing  Tracing  `yaml:"tracing"`
+}
+
+type Database struct {
+	Dialect         string        `yaml:"dialect"  env:"DATABASE_DIALECT"  flag:"database-dialect"  usage:"mysql | postgres | sqlite | mssql"`
+	URI             string        `yaml:"uri"  env:"DATABASE_URI"  flag:"database-uri"  usage:"dsn of the database connection"`
+	MaxOpenConns    int           `yaml:"max_open_conns"  env:"DATABASE_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"  env:"DATABASE_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"  env:"DATABASE_CONN_MAX_LIFETIME"`
+	ConnectTimeout  time.Duration `yaml:"connect_timeout"  env:"DATABASE_CONNECT_TIMEOUT"` // retry the startup ping this long
+}
+
+type Redis struct {
+	URI      string `yaml:"uri"  env:"REDIS_URI"  flag:"redis-uri"  usage:"address of redis, e.g. localhost:6379"`
+	DB       int    `yaml:"db"  env:"REDIS_DB"  flag:"redis-db"  usage:"number of the redis db (0..15)"`
+	Password string `yaml:"password"  env:"REDIS_PASSWORD"`
+}
+
+// Jobs configures the background workers
+type Jobs struct {
+	Workers           int           `yaml:"workers"  env:"BACKGROUND_WORKERS"  flag:"workers"  usage:"number of background workers"`
+	CleanupSchedule   string        `yaml:"cleanup_schedule"  env:"CLEANUP_SCHEDULE"`
+	ReminderSchedule  string        `yaml:"reminder_schedule"  env:"REMINDER_SCHEDULE"`
+	TemporaryShareTTL time.Duration `yaml:"temporary_share_ttl"  env:"TEMPORARY_SHARE_TTL"`
+	ExpiryReminder    time.Duration `yaml:"expiry_reminder"  env:"EXPIRY_REMINDER"`
+	AuditRetention    time.Duration `yaml:"audit_retention"  env:"AUDIT_RETENTION"` // 0 keeps the audit log forever
+}
+
+// Policy holds the limits every share has to obey. Zero values mean "no limit".
+type Policy struct {
+	DefaultExpiry        time.Duration `yaml:"default_expiry"  env:"DEFAULT_EXPIRY"`
+	MaxExpiry            time.Duration `yaml:"max_expiry"  env:"MAX_EXPIRY"`
+	DefaultDownloadLimit int64         `yaml:"default_download_limit"  env:"DEFAULT_DOWNLOAD_LIMIT"`
+	MaxDownloadLimit     int64         `yaml:"max_download_limit"  env:"MAX_DOWNLOAD_LIMIT"`
+	RequirePassword      bool          `yaml:"require_password"  env:"REQUIRE_PASSWORD"`
+}
+
+// SMTP is optional, emails are only sent if the Host is set
+type SMTP struct {
+	Host     string `yaml:"host"  env:"SMTP_HOST"`
+	Port     int    `yaml:"port"  env:"SMTP_PORT"`
+	Username string `yaml:"username"  env:"SMTP_USERNAME"`
+	Password string `yaml:"password"  env:"SMTP_PASSWORD"`
+	From     string `yaml:"from"  env:"SMTP_FROM"`
+}
+
+// Health configures /healthz and /readyz
+type Health struct {
+	Port         int   `yaml:"port"  env:"HEALTH_PORT"  flag:"health-port"  usage:"port of /healthz and /readyz for the worker command"`
+	MinFreeSpace int64 `yaml:"min_free_space"  env:"MIN_FREE_SPACE"` // bytes left in media_dir
+}
+
+// Log configures the log lines of the process
+type Log struct {
+	Format string `yaml:"format"  env:"LOG_FORMAT"  flag:"log-format"  usage:"json or logfmt"`
+	Level  string `yaml:"level"  env:"LOG_LEVEL"  flag:"log-level"  usage:"debug, info, warn or error"`
+}
+
+// Metrics configures /metrics. It's served on its own address if there is one, on the api with the token otherwise,
+// and not at all without both.
+type Metrics struct {
+	Token   string `yaml:"token"  env:"METRICS_TOKEN"`
+	Address string `yaml:"address"  env:"METRICS_ADDRESS"  flag:"metrics-address"  usage:"host:port of a separate /metrics listener, e.g. 127.0.0.1:9100"`
+}
+
+// Tracing configures the export of OpenTelemetry traces, nothing is recorded without an endpoint
+type Tracing struct {
+	Endpoint    string  `yaml:"endpoint"  env:"TRACING_ENDPOINT"  flag:"tracing-endpoint"  usage:"URL of an OTLP/HTTP trace collector, e.g. http://localhost:4318/v1/traces"`
+	ServiceName string  `yaml:"service_name"  env:"TRACING_SERVICE_NAME"`
+	SampleRatio float64 `yaml:"sample_ratio"  env:"TRACING_SAMPLE_RATIO"` // of the traces started here, 0..1
+}
+
+// Errors are all the problems found in a configuration
+type Errors []error
+
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  " + err.Error()
+	}
+	return "invalid configuration:\n" + strings.Join(lines, "\n")
+}
+
+func (e Errors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+var dialects = []string{"mysql", "postgres", "sqlite", "mssql"}
+
+// removedDialects were supported by earlier versions, with the reason why they aren't anymore
+var removedDialects = map[string]string{
+	"clickhouse": "there are no migrations for it and it lacks the transactions they need",
+}
+
+// Defaults returns the configuration without any source applied
+func Defaults() Config {
+	return Config{
+		StatsCacheTTL:   30 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		Database: Database{
+			MaxOpenConns:    20,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: time.Hour,
+			ConnectTimeout:  30 * time.Second,
+		},
+		Jobs: Jobs{
+			Workers:           5,
+			CleanupSchedule:   "@every 1h",
+			ReminderSchedule:  "@every 1h",
+			TemporaryShareTTL: 24 * time.Hour,
+			ExpiryReminder:    24 * time.Hour,
+			AuditRetention:    365 * 24 * time.Hour,
+		},
+		SMTP:    SMTP{Port: 25},
+		Health:  Health{MinFreeSpace: 100 << 20},
+		Log:     Log{Format: logging.FormatJSON, Level: "info"},
+		Tracing: Tracing{ServiceName: "chiefsend-api", SampleRatio: 1},
+	}
+}
+
+// Load registers the flags on fs, parses args and returns the validated configuration. The worker command (first
+// argument after the flags) doesn't need the settings of the api server.
+func Load(fs *flag.FlagSet, args []string) (Config, error) {
+	c := Defaults()
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "path of the YAML config file")
+	for _, f := range c.fields() {
+		if f.flag != "" {
+			def := ""
+			if !f.value.IsZero() {
+				def = fmt.Sprint(f.value.Interface())
+			}
+			fs.String(f.flag, def, f.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	// the flag package stops at the command, whatever follows would be ignored
+	switch fs.Arg(0) {
+	case "", "all", "serve", "worker":
+		if fs.NArg() > 1 {
+			return c, fmt.Errorf("unexpected arguments after %q: %s (flags go before the command)", fs.Arg(0),
+				strings.Join(fs.Args()[1:], " "))
+		}
+	}
+	if *file != "" {
+		if err := c.readFile(*file); err != nil {
+			return c, err
+		}
+	}
+	errs := c.readEnv()
+	fs.Visit(func(fl *flag.Flag) {
+		for _, f := range c.fields() {
+			if f.flag == fl.Name {
+				if err := f.set(fl.Value.String()); err != nil {
+					errs = append(errs, fmt.Errorf("-%s: %w", f.flag, err))
+				}
+			}
+		}
+	})
+	errs = append(errs, c.validate(fs.Arg(0))...)
+	return c, errs.orNil()
+}
+
+// FromEnv returns the defaults overridden by the environment, without validating them
+func FromEnv() (Config, error) {
+	c := Defaults()
+	return c, c.readEnv().orNil()
+}
+
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) readEnv() Errors {
+	var errs Errors
+	for _, f := range c.fields() {
+		if s, ok := os.LookupEnv(f.env); ok && s != "" {
+			if err := f.set(s); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.env, err))
+			}
+		}
+	}
+	return errs
+}
+
+// Validate returns all problems of the configuration at once
+func (c Config) Validate() error {
+	return c.validate("all").orNil()
+}
+
+// ValidateCommand is Validate for a subcommand, without the settings it doesn't need: the api server (all, serve)
+// needs everything, worker no port and admin_key, migrate and fsck neither redis.
+func (c Config) ValidateCommand(command string) error {
+	return c.validate(command).orNil()
+}
+
+func (c Config) validate(command string) Errors {
+	var errs Errors
+	check := func(ok bool, name, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+		}
+	}
+	server := command == "" || command == "all" || command == "serve"
+	if server {
+		check(c.Port > 0 && c.Port <= 65535, "port", "has to be between 1 and 65535")
+		check(c.AdminKey != "", "admin_key", "is required")
+	}
+	check(c.MediaDir != "" && filepath.IsAbs(c.MediaDir), "media_dir", "has to be an absolute path")
+	check(c.StatsCacheTTL >= 0, "stats_cache_ttl", "must not be negative")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout", "has to be positive")
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "public_url", "has to be an absolute http(s) URL")
+	}
+	// database
+	if why, ok := removedDialects[c.Database.Dialect]; ok {
+		check(false, "database.dialect", "%s isn't supported anymore, %s (use one of %s)", c.Database.Dialect, why, strings.Join(dialects, ", "))
+	} else {
+		check(contains(dialects, c.Database.Dialect), "database.dialect", "has to be one of %s", strings.Join(dialects, ", "))
+	}
+	check(c.Database.URI != "", "database.uri", "is required")
+	check(c.Database.MaxOpenConns >= 0, "database.max_open_conns", "must not be negative (0 is unlimited)")
+	check(c.Database.MaxIdleConns >= 0, "database.max_idle_conns", "must not be negative")
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns, "database.max_idle_conns", "exceeds max_open_conns")
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime", "must not be negative (0 is unlimited)")
+	check(c.Database.ConnectTimeout > 0, "database.connect_timeout", "has to be positive")
+	// redis
+	if server || command == "worker" {
+		check(c.Redis.URI != "", "redis.uri", "is required")
+	}
+	check(c.Redis.DB >= 0 && c.Redis.DB <= 15, "redis.db", "has to be between 0 and 15")
+	// jobs
+	check(c.Jobs.Workers > 0, "jobs.workers", "has to be positive")
+	check(c.Jobs.CleanupSchedule != "", "jobs.cleanup_schedule", "is required")
+	check(c.Jobs.ReminderSchedule != "", "jobs.reminder_schedule", "is required")
+	check(c.Jobs.TemporaryShareTTL > 0, "jobs.temporary_share_ttl", "has to be positive")
+	check(c.Jobs.ExpiryReminder > 0, "jobs.expiry_reminder", "has to be positive")
+	check(c.Jobs.AuditRetention >= 0, "jobs.audit_retention", "must not be negative")
+	// policy
+	p := c.Policy
+	check(p.DefaultExpiry >= 0, "policy.default_expiry", "must not be negative")
+	check(p.MaxExpiry >= 0, "policy.max_expiry", "must not be negative")
+	check(p.DefaultDownloadLimit >= 0, "policy.default_download_limit", "must not be negative")
+	check(p.MaxDownloadLimit >= 0, "policy.max_download_limit", "must not be negative")
+	check(p.MaxExpiry == 0 || p.DefaultExpiry <= p.MaxExpiry, "policy.default_expiry", "exceeds max_expiry")
+	check(p.MaxDownloadLimit == 0 || p.DefaultDownloadLimit <= p.MaxDownloadLimit, "policy.default_download_limit", "exceeds max_download_limit")
+	// health
+	check(c.Health.Port >= 0 && c.Health.Port <= 65535, "health.port", "has to be between 0 and 65535")
+	check(c.Health.MinFreeSpace >= 0, "health.min_free_space", "must not be negative")
+	// metrics
+	if c.Metrics.Address != "" {
+		_, port, err := net.SplitHostPort(c.Metrics.Address)
+		check(err == nil && port != "", "metrics.address", "has to be host:port")
+	}
+	// smtp
+	if c.SMTP.Host != "" {
+		check(c.SMTP.Port > 0 && c.SMTP.Port <= 65535, "smtp.port", "has to be between 1 and 65535")
+		addr, err := mail.ParseAddress(c.SMTP.From)
+		check(err == nil && addr.Address == c.SMTP.From, "smtp.from", "has to be an email address")
+	}
+	// log
+	check(c.Log.Format == logging.FormatJSON || c.Log.Format == logging.FormatLogfmt, "log.format", "has to be json or logfmt")
+	_, err := logging.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level", "has to be debug, info, warn or error")
+	// tracing
+	if c.Tracing.Endpoint != "" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "tracing.endpoint", "has to be an http(s) URL")
+		check(c.Tracing.ServiceName != "", "tracing.service_name", "is required")
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio", "has to be between 0 and 1")
+	return errs
+}
+
+// field is a setting which can be set from a string
+type field struct {
+	value            reflect.Value
+	env, flag, usage string
+}
+
+// fields returns the settings of c, nested structs included
+func (c *Config) fields() []field {
+	var fields []field
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		for i := 0; i < v.NumField(); i++ {
+			sf := v.Type().Field(i)
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i))
+				continue
+			}
+			fields = append(fields, field{v.Field(i), sf.Tag.Get("env"), sf.Tag.Get("flag"), sf.Tag.Get("usage")})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem())
+	return fields
+}
+
+func (f field) set(s string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+	case int, int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("has to be an integer")
+		}
+		f.value.SetInt(i)
+	case float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New("has to be a number")
+		}
+		f.value.SetFloat(x)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("has to be true or false")
+		}
+		f.value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", f.value.Type())
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
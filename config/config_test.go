@@ -0,0 +1,194 @@
+package config
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setenv sets the variables until the test is done, unsets all others the config reads
+func setenv(t *testing.T, vars map[string]string) {
+	var c Config
+	for _, f := range c.fields() {
+		if old, ok := os.LookupEnv(f.env); ok {
+			t.Cleanup(func() { _ = os.Setenv(f.env, old) })
+		} else {
+			t.Cleanup(func() { _ = os.Unsetenv(f.env) })
+		}
+		_ = os.Unsetenv(f.env)
+	}
+	for k, v := range vars {
+		_ = os.Setenv(k, v)
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "chiefsend.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const valid = `
+port: 6969
+media_dir: /srv/chiefsend
+admin_key: from-file
+database:
+  dialect: sqlite
+  uri: file.db
+redis:
+  uri: localhost:6379
+policy:
+  max_expiry: 720h
+`
+
+func TestLoad(t *testing.T) {
+	t.Run("precedence", func(t *testing.T) {
+		setenv(t, map[string]string{"PORT": "7000", "ADMIN_KEY": "from-env", "BACKGROUND_WORKERS": "2"})
+		c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", writeFile(t, valid), "-port", "8000"})
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, 8000, c.Port)                      // flag over env and file
+		assert.Equal(t, "from-env", c.AdminKey)            // env over file
+		assert.Equal(t, 2, c.Jobs.Workers)                 // env over default
+		assert.Equal(t, "/srv/chiefsend", c.MediaDir)      // file
+		assert.Equal(t, 720*time.Hour, c.Policy.MaxExpiry) // file
+		assert.Equal(t, "@every 1h", c.Jobs.CleanupSchedule)
+		assert.Equal(t, 25, c.SMTP.Port)
+	})
+
+	t.Run("file from environment", func(t *testing.T) {
+		setenv(t, map[string]string{"CONFIG_FILE": writeFile(t, valid)})
+		defer os.Unsetenv("CONFIG_FILE")
+		c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+		assert.Nil(t, err)
+		assert.Equal(t, "from-file", c.AdminKey)
+	})
+
+	t.Run("without file", func(t *testing.T) {
+		setenv(t, map[string]string{"PORT": "6969", "MEDIA_DIR": "/srv/chiefsend", "ADMIN_KEY": "key",
+			"DATABASE_DIALECT": "postgres", "DATABASE_URI": "host=db", "REDIS_URI": "redis:6379", "REQUIRE_PASSWORD": "true",
+			"TRACING_SAMPLE_RATIO": "0.25"})
+		c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+		assert.Nil(t, err)
+		assert.True(t, c.Policy.RequirePassword)
+		assert.Equal(t, 0.25, c.Tracing.SampleRatio)
+	})
+
+	t.Run("example file", func(t *testing.T) {
+		setenv(t, nil)
+		c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", "../config.example.yaml"})
+		assert.Nil(t, err)
+		assert.Equal(t, 168*time.Hour, c.Policy.DefaultExpiry)
+	})
+
+	t.Run("worker", func(t *testing.T) {
+		setenv(t, map[string]string{"MEDIA_DIR": "/srv/chiefsend", "DATABASE_DIALECT": "sqlite", "DATABASE_URI": "file.db",
+			"REDIS_URI": "redis:6379"})
+		_, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"worker"})
+		assert.Nil(t, err) // no port and admin key
+		_, err = Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"serve"})
+		assert.Contains(t, err.Error(), "admin_key")
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		setenv(t, nil)
+		_, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", writeFile(t, valid+"prot: 1\n")})
+		assert.Contains(t, err.Error(), "prot")
+	})
+
+	t.Run("all problems at once", func(t *testing.T) {
+		setenv(t, map[string]string{"MAX_EXPIRY": "forever", "REDIS_DB": "16", "MEDIA_DIR": "relative"})
+		_, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-workers", "none"})
+		// assertions
+		errs, ok := err.(Errors)
+		assert.True(t, ok)
+		for _, problem := range []string{"MAX_EXPIRY", "-workers", "port", "media_dir", "admin_key", "database.dialect", "database.uri", "redis.uri", "redis.db"} {
+			assert.Contains(t, err.Error(), problem)
+		}
+		assert.Len(t, errs, 9)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		setenv(t, map[string]string{"DATABASE_DIALECT": "sqlite", "DATABASE_URI": "file.db", "MEDIA_DIR": "/srv/chiefsend"})
+		_, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"migrate", "up"})
+		assert.Nil(t, err)
+	})
+
+	t.Run("flags after the command", func(t *testing.T) {
+		setenv(t, map[string]string{"DATABASE_DIALECT": "sqlite", "DATABASE_URI": "file.db", "MEDIA_DIR": "/srv/chiefsend",
+			"ADMIN_KEY": "key", "REDIS_URI": "localhost:6379"})
+		_, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"serve", "-config", "x.yml"})
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "-config x.yml")
+		}
+		_, err = Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-port", "8080", "worker"})
+		assert.Nil(t, err)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	base := Defaults()
+	base.Port, base.MediaDir, base.AdminKey = 6969, "/srv/chiefsend", "key"
+	base.Database.Dialect, base.Database.URI = "sqlite", "file.db"
+	base.Redis.URI = "localhost:6379"
+	assert.Nil(t, base.Validate())
+
+	t.Run("removed dialect", func(t *testing.T) {
+		c := base
+		c.Database.Dialect = "clickhouse"
+		err := c.Validate()
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "clickhouse isn't supported anymore")
+		}
+	})
+
+	t.Run("by command", func(t *testing.T) {
+		c := Defaults()
+		c.MediaDir, c.Database.Dialect, c.Database.URI = "/srv/chiefsend", "sqlite", "file.db"
+		assert.Nil(t, c.ValidateCommand("migrate"))
+		assert.Nil(t, c.ValidateCommand("fsck"))
+		for command, missing := range map[string][]string{
+			"worker": {"redis.uri"},
+			"serve":  {"port", "admin_key", "redis.uri"},
+			"":       {"port", "admin_key", "redis.uri"},
+		} {
+			err := c.ValidateCommand(command)
+			if assert.NotNil(t, err, command) {
+				assert.Len(t, err.(Errors), len(missing), command)
+				for _, name := range missing {
+					assert.Contains(t, err.Error(), name, command)
+				}
+			}
+		}
+	})
+
+	for name, change := range map[string]func(c *Config){
+		"policy.default_expiry":         func(c *Config) { c.Policy.DefaultExpiry, c.Policy.MaxExpiry = 2*time.Hour, time.Hour },
+		"policy.default_download_limit": func(c *Config) { c.Policy.DefaultDownloadLimit, c.Policy.MaxDownloadLimit = 5, 1 },
+		"policy.max_download_limit":     func(c *Config) { c.Policy.MaxDownloadLimit = -1 },
+		"smtp.from":                     func(c *Config) { c.SMTP.Host = "mail" },
+		"public_url":                    func(c *Config) { c.PublicURL = "send.example.com" },
+		"metrics.address":               func(c *Config) { c.Metrics.Address = "9100" },
+		"jobs.workers":                  func(c *Config) { c.Jobs.Workers = 0 },
+		"jobs.audit_retention":          func(c *Config) { c.Jobs.AuditRetention = -time.Hour },
+		"log.format":                    func(c *Config) { c.Log.Format = "text" },
+		"log.level":                     func(c *Config) { c.Log.Level = "verbose" },
+		"tracing.endpoint":              func(c *Config) { c.Tracing.Endpoint = "localhost:4318" },
+		"tracing.sample_ratio":          func(c *Config) { c.Tracing.SampleRatio = 1.5 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := base
+			change(&c)
+			err := c.Validate()
+			if assert.NotNil(t, err) {
+				assert.Contains(t, err.Error(), name)
+			}
+		})
+	}
+}
@@ -2,23 +2,35 @@ package controllers
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/chiefsend/api/background"
+	"github.com/chiefsend/api/logging"
+	"github.com/chiefsend/api/metrics"
 	m "github.com/chiefsend/api/models"
+	"github.com/chiefsend/api/tracing"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/guregu/null.v4"
 	"gorm.io/gorm"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// maxRecipients is the number of email addresses a share can be sent to at once
+const maxRecipients = 50
+
 type HTTPError struct {
 	Error   error
 	Message string
@@ -28,13 +40,90 @@ type HTTPError struct {
 type EndpointREST func(http.ResponseWriter, *http.Request) *HTTPError
 
 func (fn EndpointREST) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if e := fn(w, r); e != nil { // e is *HTTPError, not os.Error.
-		if e.Error != nil {
-			http.Error(w, fmt.Sprintf("%s - %s", e.Message, e.Error.Error()), e.Code)
-		} else {
-			http.Error(w, e.Message, e.Code)
+	r, span := startSpan(r)
+	e := fn(w, r)
+	if e != nil { // e is *HTTPError, not os.Error.
+		logError(r, e)
+		writeProblem(w, r, e)
+	}
+	endSpan(span, e)
+}
+
+// countDownload increments the download counter, takes one download off the limit (if there is one) and emits the
+// events. The limit is checked again in the update, of concurrent downloads only as many as the limit allows succeed.
+// Admins may download a share without downloads left, without changing the limit.
+func countDownload(ctx context.Context, db *gorm.DB, share *m.Share, admin bool) *HTTPError {
+	updates := map[string]interface{}{"downloads": gorm.Expr("downloads + ?", 1)}
+	query := db.Model(share)
+	limited := share.DownloadLimit.Valid && !(admin && share.DownloadLimit.Int64 <= 0)
+	if limited {
+		updates["download_limit"] = gorm.Expr("download_limit - ?", 1)
+		query = query.Where("download_limit > ?", 0)
+	}
+	res := query.UpdateColumns(updates)
+	if res.Error != nil {
+		return &HTTPError{res.Error, "Error editing share object", 500}
+	}
+	if res.RowsAffected == 0 && limited {
+		return &HTTPError{ErrDownloadLimitReached, "Download limit is reached", 410}
+	}
+	if res.RowsAffected == 0 {
+		return &HTTPError{gorm.ErrRecordNotFound, "Record not found", 404}
+	}
+	share.Downloads++
+	if limited {
+		share.DownloadLimit.Int64--
+	}
+	background.EmitEvent(ctx, m.EventShareDownloaded, *share)
+	if share.Downloads == 1 && share.OwnerEmail.Valid {
+		if err := background.SendEmail(ctx, background.EmailDownloaded, []string{share.OwnerEmail.String}, *share, false); err != nil {
+			logging.FromContext(ctx).Error("can't notify the owner", "share", share.ID, "error", err)
 		}
 	}
+	if limited && share.DownloadLimit.Int64 == 0 {
+		background.EmitEvent(ctx, m.EventDownloadLimitReached, *share)
+	}
+	return nil
+}
+
+// checkUploadLimits returns an error if another file of the given size exceeds the limits of the share's upload request
+func checkUploadLimits(db *gorm.DB, share m.Share, size int64) *HTTPError {
+	var ur m.UploadRequest
+	if err := db.Where("id = ?", share.UploadRequestID.String).First(&ur).Error; err != nil {
+		return &HTTPError{err, "Can't fetch upload request", 500}
+	}
+	var files struct {
+		Count int64
+		Size  int64
+	}
+	err := db.Model(&m.Attachment{}).Select("COUNT(*) AS count, COALESCE(SUM(filesize), 0) AS size").
+		Where("share_id = ?", share.ID.String()).Scan(&files).Error
+	if err != nil {
+		return &HTTPError{err, "Can't fetch data", 500}
+	}
+	if ur.MaxFiles.Valid && files.Count+1 > ur.MaxFiles.Int64 {
+		return &HTTPError{ErrQuotaExceeded, fmt.Sprintf("At most %d files can be uploaded", ur.MaxFiles.Int64), 413}
+	}
+	if ur.MaxSize.Valid && files.Size+size > ur.MaxSize.Int64 {
+		return &HTTPError{ErrQuotaExceeded, fmt.Sprintf("At most %d bytes can be uploaded", ur.MaxSize.Int64), 413}
+	}
+	return nil
+}
+
+// checkExpiry returns an error if the share has expired, but isn't deleted yet
+func checkExpiry(share m.Share) *HTTPError {
+	if share.IsExpired(time.Now()) {
+		return &HTTPError{ErrShareExpired, "Share is expired", 410}
+	}
+	return nil
+}
+
+// checkDownloadLimit returns an error if the share can't be downloaded anymore
+func checkDownloadLimit(share m.Share) *HTTPError {
+	if share.DownloadLimit.Valid && share.DownloadLimit.Int64 <= 0 {
+		return &HTTPError{ErrDownloadLimitReached, "Download limit is reached", 410}
+	}
+	return nil
 }
 
 /////////////////////////////////
@@ -43,7 +132,7 @@ func (fn EndpointREST) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func AllShares(w http.ResponseWriter, r *http.Request) *HTTPError {
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
@@ -52,20 +141,88 @@ func AllShares(w http.ResponseWriter, r *http.Request) *HTTPError {
 	if err != nil {
 		return &HTTPError{err, "can't check authorization header", 500}
 	}
+	// parse query
+	filter, err := parseShareFilter(r)
+	if err != nil {
+		return &HTTPError{err, "invalid query param", 400}
+	}
+	if !admin {
+		filter.Public = null.BoolFrom(true)
+		filter.Temporary = null.BoolFrom(false)
+	}
 	// get shares
-	var shares []m.Share
-	if admin {
-		err = db.Preload("Attachments").Find(&shares).Error
-	} else {
-		err = db.Preload("Attachments").Where("is_public = 1 AND is_temporary = 0").Find(&shares).Error
+	shares, next, err := m.FindShares(db, filter)
+	if errors.Is(err, m.ErrInvalidQuery) {
+		return &HTTPError{err, "invalid query param", 400}
 	}
 	if err != nil {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
+	if shares == nil {
+		shares = []m.Share{}
+	}
 	// return shares
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
 	return sendJSON(w, shares)
 }
 
+// parseShareFilter reads the filter, sort and pagination params of the share listing
+func parseShareFilter(r *http.Request) (m.ShareFilter, error) {
+	q := r.URL.Query()
+	f := m.ShareFilter{
+		Search:          q.Get("q"),
+		Sort:            q.Get("sort"),
+		Cursor:          q.Get("cursor"),
+		WithAttachments: true,
+	}
+	var err error
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil {
+			return f, fmt.Errorf("limit: %w", err)
+		}
+	}
+	if s := q.Get("attachments"); s != "" {
+		if f.WithAttachments, err = strconv.ParseBool(s); err != nil {
+			return f, fmt.Errorf("attachments: %w", err)
+		}
+	}
+	if s := q.Get("owner"); s != "" {
+		f.Owner = null.StringFrom(s)
+	}
+	times := map[string]*null.Time{
+		"created_after":  &f.CreatedAfter,
+		"created_before": &f.CreatedBefore,
+		"expires_after":  &f.ExpiresAfter,
+		"expires_before": &f.ExpiresBefore,
+	}
+	for key, t := range times {
+		if s := q.Get(key); s != "" {
+			v, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return f, fmt.Errorf("%s: %w", key, err)
+			}
+			t.SetValid(v)
+		}
+	}
+	bools := map[string]*null.Bool{
+		"public":       &f.Public,
+		"temporary":    &f.Temporary,
+		"has_password": &f.HasPassword,
+	}
+	for key, b := range bools {
+		if s := q.Get(key); s != "" {
+			v, err := strconv.ParseBool(s)
+			if err != nil {
+				return f, fmt.Errorf("%s: %w", key, err)
+			}
+			b.SetValid(v)
+		}
+	}
+	return f, nil
+}
+
 func GetShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 	// parse url
 	vars := mux.Vars(r)
@@ -74,7 +231,7 @@ func GetShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
@@ -93,7 +250,15 @@ func GetShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
 	if !admin && share.IsTemporary == true {
-		return &HTTPError{errors.New("share is not finalized"), "Share is not finalized", 403}
+		return &HTTPError{ErrShareNotFinalized, "Share is not finalized", 403}
+	}
+	if !admin && share.UploadRequestID.Valid {
+		return &HTTPError{ErrOwnerOnly, "Only the owner can access this share", 403}
+	}
+	if !admin {
+		if e := checkExpiry(share); e != nil {
+			return e
+		}
 	}
 	// auth
 	if !admin {
@@ -117,7 +282,7 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
@@ -132,7 +297,7 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) *HTTPError {
 	}
 	// check if attachments belongs to share
 	if att.ShareID != shareID {
-		return &HTTPError{errors.New("share doesn't match attachment"), "share doesn't match attachment", 404}
+		return &HTTPError{ErrAttachmentMismatch, "share doesn't match attachment", 404}
 	}
 	// see if (optional) admin key is provided to allow getting temporary shares
 	admin, err := CheckBearerAuth(r)
@@ -149,29 +314,39 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
 	if !admin && share.IsTemporary == true {
-		return &HTTPError{errors.New("share is not finalized"), "Share is not finalized", 403}
+		return &HTTPError{ErrShareNotFinalized, "Share is not finalized", 403}
+	}
+	if !admin && share.UploadRequestID.Valid {
+		return &HTTPError{ErrOwnerOnly, "Only the owner can access this share", 403}
 	}
 	// auth
 	if !admin {
 		if ok, err := CheckBasicAuth(r, share); err != nil || ok == false {
 			return &HTTPError{err, "Unauthorized", 401}
 		}
-	}
-	// reduce download limit
-	if share.DownloadLimit.Valid {
-		if err := db.Model(&share).Update("download_limit", share.DownloadLimit.Int64-1).Error; err != nil {
-			return &HTTPError{err, "Error editing share object", 500}
+		if e := checkExpiry(share); e != nil {
+			return e
+		}
+		if e := checkDownloadLimit(share); e != nil {
+			return e
 		}
 	}
+	// count download and reduce download limit
+	if e := countDownload(r.Context(), db, &share, admin); e != nil {
+		return e
+	}
 	// send file
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", att.Filename))
-	http.ServeFile(w, r, filepath.Join(os.Getenv("MEDIA_DIR"), "data", shareID.String(), attID.String()))
+	cw := &countingWriter{ResponseWriter: w}
+	done := metrics.Transfer("download")
+	http.ServeFile(cw, r, filepath.Join(share.Dir(), attID.String())) // admins get temporary shares too
+	done(cw.n)
 	return nil
 }
 
 func OpenShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
@@ -186,15 +361,77 @@ func OpenShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 	if err != nil {
 		return &HTTPError{err, "Can't parse body", 400}
 	}
+	// managed by the server, never by the client
+	newShare.CreatedAt, newShare.UpdatedAt = time.Time{}, time.Time{}
+	newShare.Downloads, newShare.ReminderSent, newShare.DeletionTask = 0, false, null.String{}
+	if newShare.OwnerEmail.Valid {
+		if err := m.ValidateEmail(newShare.OwnerEmail.String); err != nil {
+			return &HTTPError{err, "Invalid owner email", 400}
+		}
+	}
+	// (optional) upload request, the share goes to its owner
+	ur, err := CheckUploadToken(r, db)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &HTTPError{ErrUploadTokenInvalid, "Invalid upload token", 401}
+	}
+	if err != nil {
+		return &HTTPError{err, "Can't check upload token", 500}
+	}
+	newShare.UploadRequestID = null.String{}
+	// enforce server policy
+	policy := m.GetPolicy()
+	if ur != nil {
+		if err := ur.Open(time.Now()); err != nil {
+			return &HTTPError{err, "Upload request is closed", 410}
+		}
+		newShare.UploadRequestID = null.StringFrom(ur.ID.String())
+		newShare.Owner, newShare.OwnerEmail = ur.Owner, ur.OwnerEmail
+		newShare.IsPublic, newShare.Password = false, null.String{}
+		policy.RequirePassword = false // only the owner can access it
+	}
+	if err := policy.Apply(&newShare, time.Now()); err != nil {
+		return &HTTPError{err, "Share violates server policy", 400}
+	}
 	// setup and store it
 	newShare.Attachments = nil // dont want attachments yet
 	newShare.IsTemporary = true
-	err = db.Create(&newShare).Error
+	// the uploader of an upload request gets no management token, the share belongs to the owner of the request
+	var token string
+	if ur == nil {
+		var hash string
+		token, hash, err = m.NewToken()
+		if err != nil {
+			return &HTTPError{err, "Can't generate management token", 500}
+		}
+		newShare.ManagementHash = hash
+	}
+	err = m.Transaction(db, func(uow *m.UnitOfWork) error {
+		if ur != nil {
+			// count the use, unless someone else was faster
+			res := uow.DB().Model(ur).
+				Where("max_shares IS NULL OR shares < max_shares").
+				UpdateColumn("shares", gorm.Expr("shares + ?", 1))
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return m.ErrUploadRequestClosed
+			}
+		}
+		return uow.DB().Create(&newShare).Error
+	})
+	if errors.Is(err, m.ErrUploadRequestClosed) {
+		return &HTTPError{err, "Upload request is closed", 410}
+	}
 	if err != nil {
 		return &HTTPError{err, "Can't create data", 500}
 	}
-	// return share
-	return sendJSON(w, newShare)
+	// return share, the management token is only shown once
+	newShare.Secure()
+	return sendJSON(w, struct {
+		m.Share
+		ManagementToken string `json:"management_token,omitempty"`
+	}{newShare, token})
 }
 
 func CloseShare(w http.ResponseWriter, r *http.Request) *HTTPError {
@@ -205,7 +442,7 @@ func CloseShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
@@ -221,25 +458,65 @@ func CloseShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 	if share.IsTemporary == false { // already closed
 		return nil
 	}
-	// move files to permanent location
-	oldPath := filepath.Join(os.Getenv("MEDIA_DIR"), "temp", shareID.String())
-	newPath := filepath.Join(os.Getenv("MEDIA_DIR"), "data", shareID.String())
-	err = os.Rename(oldPath, newPath)
+	// uploader, owner or admin
+	role, e := authorize(r, db, share, ActionFinalize)
+	if e != nil {
+		return e
+	}
+	// parse (optional) body
+	var body struct {
+		Recipients     []string `json:"recipients"`
+		IncludeDetails bool     `json:"include_details"`
+	}
+	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return &HTTPError{err, "Can't move directory", 500}
+		return &HTTPError{err, "Request does not contain a valid body", 400}
 	}
-	// set stuff permanent
-	if err := db.Model(&share).Update("is_temporary", false).Error; err != nil {
-		return &HTTPError{err, "Can't edit data", 500}
+	if len(bytes.TrimSpace(reqBody)) > 0 {
+		if err := json.Unmarshal(reqBody, &body); err != nil {
+			return &HTTPError{err, "Can't parse body", 400}
+		}
+	}
+	if len(body.Recipients) > maxRecipients {
+		return &HTTPError{nil, fmt.Sprintf("At most %d recipients are allowed", maxRecipients), 400}
 	}
-	// put share in deletion queue
-	if share.Expires.Valid {
-		deleteTask := background.NewDeleteShareTask(share)
-		at := share.Expires.ValueOrZero()
-		if err := background.EnqueueJob(deleteTask, &at); err != nil {
-			return &HTTPError{err, "Can't start deleteShare task", 500}
+	for _, addr := range body.Recipients {
+		if err := m.ValidateEmail(addr); err != nil {
+			return &HTTPError{err, "Invalid recipient", 400}
 		}
 	}
+	if len(body.Recipients) > 0 && !background.MailConfigured() {
+		return &HTTPError{background.ErrMailNotConfigured, "Email is not configured", 503}
+	}
+	// set stuff permanent and move files to permanent location
+	oldPath := share.Dir()
+	before := share
+	err = m.Transaction(db, func(uow *m.UnitOfWork) error {
+		if err := uow.DB().Model(&share).Update("is_temporary", false).Error; err != nil {
+			return err
+		}
+		uow.Rename(oldPath, share.Dir())
+		// audit
+		entry := auditEntry(r, role, m.AuditShareFinalize, share)
+		changes, err := m.ShareDiff(&before, &share)
+		if err != nil {
+			return err
+		}
+		entry.Changes = changes
+		return m.Audit(uow.DB(), entry)
+	})
+	if err != nil {
+		return &HTTPError{err, "Can't finalize share", 500}
+	}
+	// put share in deletion queue, the cleanup job retries if that fails
+	if err := background.ScheduleShareDeletion(r.Context(), &share); err != nil {
+		logging.FromContext(r.Context()).Error("can't schedule the deletion of the share", "share", share.ID, "error", err)
+	}
+	background.EmitEvent(r.Context(), m.EventShareFinalized, share)
+	// send the link, the share is final anyway
+	if err := background.SendEmail(r.Context(), background.EmailShared, body.Recipients, share, body.IncludeDetails); err != nil {
+		logging.FromContext(r.Context()).Error("can't send the share to the recipients", "share", share.ID, "error", err)
+	}
 	// return share
 	return sendJSON(w, share)
 }
@@ -252,15 +529,10 @@ func UploadAttachment(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
-	// see if (optional) admin key is provided to allow adding files anyway
-	admin, err := CheckBearerAuth(r)
-	if err != nil {
-		return &HTTPError{err, "can't check authorization header", 500}
-	}
 	// get share
 	var share m.Share
 	err = db.Where("id = ?", shareID.String()).First(&share).Error
@@ -270,11 +542,18 @@ func UploadAttachment(w http.ResponseWriter, r *http.Request) *HTTPError {
 	if err != nil {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
-	if !admin && share.IsTemporary == false {
-		return &HTTPError{errors.New("share is not finalized"), "Can't upload to finalized Shares.", 403}
+	// uploader, owner or admin (finalized shares: owner or admin)
+	role, e := authorize(r, db, share, ActionUpload)
+	if e != nil {
+		return e
 	}
 	// Parse file from body
+	var written int64
+	done := metrics.Transfer("upload")
+	defer func() { done(written) }()
+	_, span := tracing.Start(r.Context(), "read upload")
 	err = r.ParseMultipartForm(10 << 20) // 10 MB
+	tracing.End(span, err)
 	if err != nil {
 		return &HTTPError{err, "Request does not contain a valid body (parsing form)", 400}
 	}
@@ -283,27 +562,33 @@ func UploadAttachment(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "Request does not contain a valid body (parsing file)", 400}
 	}
 	defer file.Close()
-	// add file to db and file system
-	var att m.Attachment
-	{
-		// add database entry // TODO error handling for whole transaction
-		db.Begin()
-		att.ShareID = shareID
-		att.Filename = handler.Filename
-		att.Filesize = handler.Size
-		db.Create(&att)
-
-		// save file
-		fileBytes, err := ioutil.ReadAll(file)
-		if err != nil {
-			return &HTTPError{err, "cant read file", 500}
+	// limits of the upload request
+	if role != RoleAdmin && share.UploadRequestID.Valid {
+		if e := checkUploadLimits(db, share, handler.Size); e != nil {
+			return e
 		}
-		err = ioutil.WriteFile(filepath.Join(os.Getenv("MEDIA_DIR"), "temp", shareID.String(), att.ID.String()), fileBytes, os.ModePerm)
-		if err != nil {
-			db.Rollback()
-			return &HTTPError{err, "cant save file", 500}
+	}
+	// add file to db and file system
+	att := m.Attachment{
+		ShareID:  shareID,
+		Filename: handler.Filename,
+		Filesize: handler.Size,
+	}
+	err = m.Transaction(db, func(uow *m.UnitOfWork) error {
+		if err := uow.DB().Create(&att).Error; err != nil {
+			return err
 		}
-		db.Commit()
+		_, span := tracing.Start(r.Context(), "write file", attribute.Int64("file.size", handler.Size))
+		n, err := uow.WriteFile(filepath.Join(share.Dir(), att.ID.String()), file)
+		tracing.End(span, err)
+		written = n
+		return err
+	})
+	if errors.Is(err, m.ErrMissingDirectory) {
+		return &HTTPError{err, "Share was finalized or deleted meanwhile", 409}
+	}
+	if err != nil {
+		return &HTTPError{err, "cant save file", 500}
 	}
 	// return new attachment
 	return sendJSON(w, att)
@@ -317,7 +602,7 @@ func DownloadZip(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
@@ -336,20 +621,27 @@ func DownloadZip(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
 	if !admin && share.IsTemporary == true {
-		return &HTTPError{errors.New("share is not finalized"), "Share is not finalized", 403}
+		return &HTTPError{ErrShareNotFinalized, "Share is not finalized", 403}
+	}
+	if !admin && share.UploadRequestID.Valid {
+		return &HTTPError{ErrOwnerOnly, "Only the owner can access this share", 403}
 	}
 	// auth
 	if !admin {
 		if basic, err := CheckBasicAuth(r, share); err != nil || basic == false {
 			return &HTTPError{err, "Unauthorized", 401}
 		}
-	}
-	// reduce download limit
-	if share.DownloadLimit.Valid {
-		if err := db.Model(&share).Update("download_limit", share.DownloadLimit.Int64-1).Error; err != nil {
-			return &HTTPError{err, "Error editing share object", 500}
+		if e := checkExpiry(share); e != nil {
+			return e
+		}
+		if e := checkDownloadLimit(share); e != nil {
+			return e
 		}
 	}
+	// count download and reduce download limit
+	if e := countDownload(r.Context(), db, &share, admin); e != nil {
+		return e
+	}
 	// set filename
 	if share.Name.Valid {
 		filename := strings.ReplaceAll(share.Name.String, " ", "_")
@@ -358,43 +650,68 @@ func DownloadZip(w http.ResponseWriter, r *http.Request) *HTTPError {
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.zip", share.ID.String()))
 	}
 	// create and send zip
-	zipWriter := zip.NewWriter(w)
+	cw := &countingWriter{ResponseWriter: w}
+	done := metrics.Transfer("download")
+	defer func() { done(cw.n) }()
+	out := &timedWriter{Writer: cw}
+	zipWriter := zip.NewWriter(out)
 	for _, file := range share.Attachments {
-		filePath := filepath.Join(os.Getenv("MEDIA_DIR"), "data", file.ShareID.String(), file.ID.String())
-
-		fileToZip, err := os.Open(filePath)
-		if err != nil {
-			return &HTTPError{err, "error opening file", 500}
-		}
-
-		info, err := fileToZip.Stat()
-		if err != nil {
-			return &HTTPError{err, "error getting file info", 500}
+		if e := addToZip(r.Context(), zipWriter, out, share.Dir(), file); e != nil {
+			return e
 		}
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		return &HTTPError{err, "error when closing zip", 500}
+	}
+	return nil
+}
 
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return &HTTPError{err, "error creating file header", 500}
+// addToZip compresses the file of the attachment in dir into the zip. Its span tells the time spent reading the disk from
+// the time spent writing to the client.
+func addToZip(ctx context.Context, zipWriter *zip.Writer, out *timedWriter, dir string, file m.Attachment) (e *HTTPError) {
+	_, span := tracing.Start(ctx, "zip file", attribute.String("attachment.id", file.ID.String()),
+		attribute.Int64("file.size", file.Filesize))
+	in := &timedReader{}
+	sent := out.d
+	defer func() {
+		span.SetAttributes(attribute.Float64("disk.read.seconds", in.d.Seconds()),
+			attribute.Float64("network.write.seconds", (out.d-sent).Seconds()))
+		if e != nil {
+			tracing.Fail(span, e.Error)
 		}
+		span.End()
+	}()
+	filePath := filepath.Join(dir, file.ID.String())
 
-		header.Name = file.Filename
-		header.Method = zip.Deflate
+	fileToZip, err := os.Open(filePath)
+	if err != nil {
+		return &HTTPError{err, "error opening file", 500}
+	}
+	in.Reader = fileToZip
 
-		writer, err := zipWriter.CreateHeader(header)
-		if err != nil {
-			return &HTTPError{err, "error creating header", 500}
-		}
-		if _, err := io.Copy(writer, fileToZip); err != nil {
-			return &HTTPError{err, "error copying file into zip archive", 500}
-		}
-		if err := fileToZip.Close(); err != nil {
-			return &HTTPError{err, "error closing zip archive", 500}
-		}
+	info, err := fileToZip.Stat()
+	if err != nil {
+		return &HTTPError{err, "error getting file info", 500}
+	}
 
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return &HTTPError{err, "error creating file header", 500}
 	}
-	err = zipWriter.Close()
+
+	header.Name = file.Filename
+	header.Method = zip.Deflate
+
+	writer, err := zipWriter.CreateHeader(header)
 	if err != nil {
-		return &HTTPError{err, "error when closing zip", 500}
+		return &HTTPError{err, "error creating header", 500}
+	}
+	if _, err := io.Copy(writer, in); err != nil {
+		return &HTTPError{err, "error copying file into zip archive", 500}
+	}
+	if err := fileToZip.Close(); err != nil {
+		return &HTTPError{err, "error closing zip archive", 500}
 	}
 	return nil
 }
@@ -404,18 +721,18 @@ func DownloadZip(w http.ResponseWriter, r *http.Request) *HTTPError {
 //////////////////////////////////////////
 
 func DeleteShare(w http.ResponseWriter, r *http.Request) *HTTPError {
-	// admin auth
-	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
-		return &HTTPError{err, "Authentication Failed", 401}
-	}
 	// parse url
 	vars := mux.Vars(r)
 	shareID, err := uuid.Parse(vars["id"])
 	if err != nil {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
+	// nobody deletes shares anonymously, no need to look it up
+	if anonymous(r) {
+		return &HTTPError{nil, "Authentication Failed", 401}
+	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
@@ -428,9 +745,25 @@ func DeleteShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 	if err != nil {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
-	// delete
-	deleteTask := background.NewDeleteShareTask(share)
-	if err := background.EnqueueJob(deleteTask, nil); err != nil {
+	// owner or admin
+	role, e := authorize(r, db, share, ActionDelete)
+	if e != nil {
+		return e
+	}
+	// delete now instead of at expiry
+	if err := background.CancelShareDeletion(&share); err != nil &&
+		!errors.Is(err, background.ErrNoDeletion) && !errors.Is(err, background.ErrNotConfigured) {
+		return &HTTPError{err, "Can't cancel deleteShare task", 500}
+	}
+	// audit the request and start the deletion, the task audits the deletion. The task is enqueued last, the entry
+	// isn't committed if that fails.
+	err = m.Transaction(db, func(uow *m.UnitOfWork) error {
+		if err := m.Audit(uow.DB(), auditEntry(r, role, m.AuditShareDelete, share)); err != nil {
+			return err
+		}
+		return background.EnqueueJob(r.Context(), background.NewDeleteShareTask(share), nil)
+	})
+	if err != nil {
 		return &HTTPError{err, "Can't start deleteShare task", 500}
 	}
 	// return
@@ -444,12 +777,8 @@ func UpdateShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 	if err != nil {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
-	// auth
-	if ok, err := CheckBearerAuth(r); err != nil || ok == false {
-		return &HTTPError{err, "Unauthorized", 401}
-	}
 	//  get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
@@ -462,21 +791,61 @@ func UpdateShare(w http.ResponseWriter, r *http.Request) *HTTPError {
 	if err != nil {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
-	// update share
+	// owner or admin
+	role, e := authorize(r, db, share, ActionUpdate)
+	if e != nil {
+		return e
+	}
+	// parse body
+	switch ct := strings.Split(r.Header.Get("Content-Type"), ";")[0]; ct {
+	case "", "application/json", "application/merge-patch+json":
+	default:
+		return &HTTPError{nil, "Body has to be application/merge-patch+json", 415}
+	}
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return &HTTPError{err, "Request does not contain a valid body", 400}
 	}
-	err = json.Unmarshal(reqBody, &share)
-	if err != nil {
-		return &HTTPError{err, "Can't parse body", 400}
-	}
-	err = db.Save(&share).Error
+	// update share
+	before := share
+	expires := share.Expires
+	if err := share.ApplyPatch(reqBody, time.Now()); err != nil {
+		return &HTTPError{err, "Can't apply patch", 400}
+	}
+	// enforce server policy, on what the patch changed
+	if err := m.GetPolicy().Check(before, share, time.Now()); err != nil {
+		return &HTTPError{err, "Share violates server policy", 400}
+	}
+	columns := append([]string{"updated_at", "reminder_sent"}, m.PatchableFields...)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&share).Select(columns).Updates(&share).Error; err != nil {
+			return err
+		}
+		// audit
+		entry := auditEntry(r, role, m.AuditShareUpdate, share)
+		changes, err := m.ShareDiff(&before, &share)
+		if err != nil {
+			return err
+		}
+		entry.Changes = changes
+		return m.Audit(tx, entry)
+	})
 	if err != nil {
 		return &HTTPError{err, "Can't edit data", 500}
 	}
-	// finish
-	return nil
+	// move the deletion to the new expiry, the update is saved already. Without a key the cleanup job retries, an old
+	// task left behind checks the expiry when it runs.
+	if !share.Expires.Equal(expires) {
+		if err := background.ScheduleShareDeletion(r.Context(), &share); err != nil {
+			logging.FromContext(r.Context()).Error("can't reschedule the deletion of the share", "share", share.ID, "error", err)
+			if err := db.Model(&share).UpdateColumn("deletion_task", nil).Error; err != nil {
+				logging.FromContext(r.Context()).Error("can't reset the deletion of the share", "share", share.ID, "error", err)
+			}
+			share.DeletionTask = null.String{}
+		}
+	}
+	// return share
+	return sendJSON(w, share)
 }
 
 func DeleteAttachment(w http.ResponseWriter, r *http.Request) *HTTPError {
@@ -491,10 +860,24 @@ func DeleteAttachment(w http.ResponseWriter, r *http.Request) *HTTPError {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
+	// get share
+	var share m.Share
+	err = db.Where("id = ?", shareID.String()).First(&share).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &HTTPError{err, "Record not found", 404}
+	}
+	if err != nil {
+		return &HTTPError{err, "Can't fetch data", 500}
+	}
+	// owner or admin (temporary shares: uploader too)
+	role, e := authorize(r, db, share, ActionRemoveAttachment)
+	if e != nil {
+		return e
+	}
 	// get attachment
 	var att m.Attachment
 	err = db.Where("id = ?", attID.String()).First(&att).Error
@@ -506,10 +889,21 @@ func DeleteAttachment(w http.ResponseWriter, r *http.Request) *HTTPError {
 	}
 	// check if attachment belongs to share
 	if att.ShareID != shareID {
-		return &HTTPError{errors.New("share doesn't match attachment"), "share doesn't match attachment", 404}
+		return &HTTPError{ErrAttachmentMismatch, "share doesn't match attachment", 404}
 	}
 	// delete attachment
-	err = db.Delete(&att).Error
+	err = m.Transaction(db, func(uow *m.UnitOfWork) error {
+		if err := uow.DB().Delete(&att).Error; err != nil {
+			return err
+		}
+		entry := auditEntry(r, role, m.AuditAttachmentDelete, share)
+		entry.AttachmentID = null.StringFrom(att.ID.String())
+		entry.Changes = m.Changes{
+			"filename": {Before: att.Filename},
+			"filesize": {Before: att.Filesize},
+		}
+		return m.Audit(uow.DB(), entry)
+	})
 	if err != nil {
 		return &HTTPError{err, "can't delete attachment", 500}
 	}
@@ -517,6 +911,24 @@ func DeleteAttachment(w http.ResponseWriter, r *http.Request) *HTTPError {
 	return nil
 }
 
+func Fsck(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// check (and repair on POST)
+	report, err := m.Fsck(db, r.Method == "POST")
+	if err != nil {
+		return &HTTPError{err, "Can't check storage", 500}
+	}
+	return sendJSON(w, report)
+}
+
 /////////////////////////////////////////////////////
 //////////////////// Misc. Routes ///////////////////
 /////////////////////////////////////////////////////
@@ -526,90 +938,538 @@ func Stats(w http.ResponseWriter, r *http.Request) *HTTPError {
 	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
 		return &HTTPError{err, "Authentication Failed", 401}
 	}
+	// cached?
+	statsCache.Lock()
+	defer statsCache.Unlock()
+	if time.Since(statsCache.stats.GeneratedAt) < conf.StatsCacheTTL {
+		return sendJSON(w, statsCache.stats)
+	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// collect data
+	stats, err := m.GetStats(db)
+	if err != nil {
+		return &HTTPError{err, "Can't fetch data", 500}
+	}
+	statsCache.stats = stats
+	// return data
+	return sendJSON(w, stats)
+}
+
+var statsCache struct {
+	sync.Mutex
+	stats m.Stats
+}
+
+func ShareStats(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// parse url
+	vars := mux.Vars(r)
+	shareID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		return &HTTPError{err, "invalid URL param", 400}
+	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
 	// get share
-	var shares []m.Share
-	err = db.Preload("Attachments").Find(&shares).Error
+	var share m.Share
+	err = db.Preload("Attachments").Where("ID = ?", shareID).First(&share).Error
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return &HTTPError{err, "record not found", 404}
 	}
 	if err != nil {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
-	// collect data
-	var ts int64
-	for _, sh := range shares {
-		for _, att := range sh.Attachments {
-			ts += att.Filesize
-		}
+	// owner or admin
+	if _, e := authorize(r, db, share, ActionStats); e != nil {
+		return e
 	}
 	// return data
+	return sendJSON(w, m.GetShareStats(share, time.Now()))
+}
+
+func GetConfig(w http.ResponseWriter, r *http.Request) *HTTPError {
+	policy := m.GetPolicy()
 	var res = struct {
-		NumberOfShares int   `json:"number_of_shares"`
-		TotalSize      int64 `json:"total_size"`
+		DefaultExpiry        int64 `json:"default_expiry"` // seconds, 0 = none
+		MaxExpiry            int64 `json:"max_expiry"`     // seconds, 0 = unlimited
+		DefaultDownloadLimit int64 `json:"default_download_limit"`
+		MaxDownloadLimit     int64 `json:"max_download_limit"`
+		RequirePassword      bool  `json:"require_password"`
 	}{
-		NumberOfShares: len(shares),
-		TotalSize:      ts,
+		DefaultExpiry:        int64(policy.DefaultExpiry.Seconds()),
+		MaxExpiry:            int64(policy.MaxExpiry.Seconds()),
+		DefaultDownloadLimit: policy.DefaultDownloadLimit,
+		MaxDownloadLimit:     policy.MaxDownloadLimit,
+		RequirePassword:      policy.RequirePassword,
 	}
 	return sendJSON(w, res)
 }
 
-func ShareStats(w http.ResponseWriter, r *http.Request) *HTTPError {
+/////////////////////////////////////////////////////
+/////////////// Upload Request Routes ///////////////
+/////////////////////////////////////////////////////
+
+func AllUploadRequests(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// get upload requests
+	requests := []m.UploadRequest{}
+	if err := db.Order("created_at").Find(&requests).Error; err != nil {
+		return &HTTPError{err, "Can't fetch data", 500}
+	}
+	return sendJSON(w, requests)
+}
+
+func CreateUploadRequest(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// parse body
+	var body struct {
+		Name       null.String `json:"name"`
+		Owner      null.String `json:"owner"`
+		OwnerEmail null.String `json:"owner_email"`
+		Expires    null.Time   `json:"expires"`
+		MaxShares  null.Int    `json:"max_shares"`
+		MaxFiles   null.Int    `json:"max_files"`
+		MaxSize    null.Int    `json:"max_size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return &HTTPError{err, "Can't parse body", 400}
+	}
+	ur := m.UploadRequest{
+		Name:       body.Name,
+		Owner:      body.Owner,
+		OwnerEmail: body.OwnerEmail,
+		Expires:    body.Expires,
+		MaxShares:  body.MaxShares,
+		MaxFiles:   body.MaxFiles,
+		MaxSize:    body.MaxSize,
+	}
+	if err := ur.Validate(time.Now()); err != nil {
+		return &HTTPError{err, "Invalid upload request", 400}
+	}
+	// store it
+	if err := db.Create(&ur).Error; err != nil {
+		return &HTTPError{err, "Can't create data", 500}
+	}
+	// return it, the only time the token is shown
+	return sendJSON(w, ur)
+}
+
+func DeleteUploadRequest(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
 	// parse url
 	vars := mux.Vars(r)
-	shareID, err := uuid.Parse(vars["id"])
+	id, err := uuid.Parse(vars["id"])
 	if err != nil {
 		return &HTTPError{err, "invalid URL param", 400}
 	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// delete, shares opened with it stay with the owner
+	res := db.Where("id = ?", id).Delete(&m.UploadRequest{})
+	if res.Error != nil {
+		return &HTTPError{res.Error, "Can't delete data", 500}
+	}
+	if res.RowsAffected == 0 {
+		return &HTTPError{gorm.ErrRecordNotFound, "Record not found", 404}
+	}
+	w.WriteHeader(204)
+	return nil
+}
+
+// CurrentUploadRequest shows the uploader the limits of the request of their X-Upload-Token
+func CurrentUploadRequest(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// get upload request
+	ur, err := CheckUploadToken(r, db)
+	if ur == nil || errors.Is(err, gorm.ErrRecordNotFound) {
+		return &HTTPError{ErrUploadTokenInvalid, "Invalid upload token", 401}
+	}
+	if err != nil {
+		return &HTTPError{err, "Can't check upload token", 500}
+	}
+	if err := ur.Open(time.Now()); err != nil {
+		return &HTTPError{err, "Upload request is closed", 410}
+	}
+	// the uploader doesn't need to know who the owner is
+	ur.Owner, ur.OwnerEmail = null.String{}, null.String{}
+	return sendJSON(w, ur)
+}
+
+/////////////////////////////////////////////////////
+////////////////// Webhook Routes ///////////////////
+/////////////////////////////////////////////////////
+
+func AllWebhooks(w http.ResponseWriter, r *http.Request) *HTTPError {
 	// admin auth
 	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
 		return &HTTPError{err, "Authentication Failed", 401}
 	}
 	// get database
-	db, err := m.GetDatabase()
+	db, err := m.GetDatabaseContext(r.Context())
 	if err != nil {
 		return &HTTPError{err, "Can't connect to database", 500}
 	}
-	// get share
-	var share m.Share
-	err = db.Preload("Attachments").Where("ID = ?", shareID).First(&share).Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return &HTTPError{err, "record not found", 404}
+	// get webhooks
+	webhooks := []m.Webhook{}
+	if err := db.Order("created_at").Find(&webhooks).Error; err != nil {
+		return &HTTPError{err, "Can't fetch data", 500}
+	}
+	return sendJSON(w, webhooks)
+}
+
+func CreateWebhook(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// parse body
+	var body struct {
+		URL    string      `json:"url"`
+		Events m.EventList `json:"events"`
+		Active *bool       `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return &HTTPError{err, "Can't parse body", 400}
+	}
+	webhook := m.Webhook{URL: body.URL, Events: body.Events, Active: body.Active == nil || *body.Active}
+	if err := webhook.Validate(); err != nil {
+		return &HTTPError{err, "Invalid webhook", 400}
+	}
+	// store it (gorm skips false because of the default)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&webhook).Error; err != nil {
+			return err
+		}
+		return tx.Model(&webhook).Update("active", webhook.Active).Error
+	})
+	if err != nil {
+		return &HTTPError{err, "Can't create data", 500}
+	}
+	// return webhook, the only time the secret is shown
+	return sendJSON(w, webhook)
+}
+
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	webhook, e := webhookFromRequest(r)
+	if e != nil {
+		return e
+	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// delete it with its log
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", webhook.ID).Delete(&m.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(webhook).Error
+	})
+	if err != nil {
+		return &HTTPError{err, "Can't delete data", 500}
+	}
+	w.WriteHeader(204)
+	return nil
+}
+
+func WebhookDeliveries(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	webhook, e := webhookFromRequest(r)
+	if e != nil {
+		return e
 	}
+	// parse query
+	limit := m.DefaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > m.MaxPageSize {
+			return &HTTPError{err, "Invalid limit", 400}
+		}
+		limit = l
+	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// newest first
+	deliveries := []m.WebhookDelivery{}
+	err = db.Where("webhook_id = ?", webhook.ID).Order("created_at DESC").Limit(limit).Find(&deliveries).Error
 	if err != nil {
 		return &HTTPError{err, "Can't fetch data", 500}
 	}
-	// get data
-	// TODO
-	// return
-	var res = struct {
-		Heat []int `json:"heat"`
-	}{
-		Heat: []int{1, 2, 3, 4},
+	return sendJSON(w, deliveries)
+}
+
+// webhookFromRequest loads the webhook of the {id} in the url
+func webhookFromRequest(r *http.Request) (*m.Webhook, *HTTPError) {
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return nil, &HTTPError{err, "Can't connect to database", 500}
+	}
+	// parse url
+	vars := mux.Vars(r)
+	id, err := uuid.Parse(vars["id"])
+	if err != nil {
+		return nil, &HTTPError{err, "Can't parse WebhookID", 400}
+	}
+	// get webhook
+	var webhook m.Webhook
+	if err := db.Where("id = ?", id).First(&webhook).Error; err != nil {
+		return nil, &HTTPError{err, "Webhook not found", 404}
+	}
+	return &webhook, nil
+}
+
+/////////////////////////////////////////////////////
+//////////////////// Job Routes /////////////////////
+/////////////////////////////////////////////////////
+
+// jobError maps the errors of the background package to HTTP errors
+func jobError(err error, msg string) *HTTPError {
+	switch {
+	case errors.Is(err, background.ErrNotConfigured):
+		return &HTTPError{err, "Background workers are not running", 503}
+	case errors.Is(err, background.ErrInvalidState):
+		return &HTTPError{err, "Invalid task state", 400}
+	case errors.Is(err, background.ErrTaskNotFound), errors.Is(err, background.ErrNoDeletion):
+		return &HTTPError{err, "Task not found", 404}
+	default:
+		return &HTTPError{err, msg, 500}
 	}
-	return sendJSON(w, res)
 }
 
 func Jobs(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
 	type job struct {
-		ID        string    `json:"string"`
-		Name      string    `json:"name"`
-		Execution time.Time `json:"execution"`
+		ID            string    `json:"id"`
+		Name          string    `json:"name"`
+		Spec          string    `json:"spec"`
+		Execution     time.Time `json:"execution"`
+		LastExecution time.Time `json:"last_execution"`
 	}
-	var res []job
+	res := []job{}
 	jobs, err := background.GetJobs()
 	if err != nil {
-		return &HTTPError{err, "can't get background jobs", 500}
+		return jobError(err, "can't get background jobs")
 	}
 	for _, j := range jobs {
 		res = append(res, job{
-			ID: j.ID,
-			//Name: j.Task.
+			ID:            j.ID,
+			Name:          j.Task.Type,
+			Spec:          j.Spec,
+			Execution:     j.Next,
+			LastExecution: j.Prev,
 		})
 	}
 	return sendJSON(w, res)
 }
+
+func QueueStats(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// get stats
+	stats, err := background.GetQueueStats()
+	if err != nil {
+		return jobError(err, "Can't get queue statistics")
+	}
+	return sendJSON(w, stats)
+}
+
+func Tasks(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// parse query
+	q := r.URL.Query()
+	state := q.Get("state")
+	if state == "" {
+		state = background.StateScheduled
+	}
+	page, size := 1, 50
+	if v := q.Get("page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 {
+			return &HTTPError{err, "Invalid page", 400}
+		}
+		page = p
+	}
+	if v := q.Get("size"); v != "" {
+		s, err := strconv.Atoi(v)
+		if err != nil || s < 1 || s > m.MaxPageSize {
+			return &HTTPError{err, "Invalid page size", 400}
+		}
+		size = s
+	}
+	// list tasks
+	tasks, err := background.ListTasks(q.Get("queue"), state, page, size)
+	if err != nil {
+		return jobError(err, "Can't list tasks")
+	}
+	return sendJSON(w, tasks)
+}
+
+func CancelTask(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// cancel
+	vars := mux.Vars(r)
+	if err := background.CancelTask(r.URL.Query().Get("queue"), vars["key"]); err != nil {
+		return jobError(err, "Can't cancel task")
+	}
+	w.WriteHeader(204)
+	return nil
+}
+
+func RunTask(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// run now
+	vars := mux.Vars(r)
+	if err := background.RunTask(r.URL.Query().Get("queue"), vars["key"]); err != nil {
+		return jobError(err, "Can't run task")
+	}
+	w.WriteHeader(204)
+	return nil
+}
+
+func GetShareDeletion(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	share, e := shareFromRequest(r)
+	if e != nil {
+		return e
+	}
+	// find task
+	task, err := background.FindShareDeletion(*share)
+	if err != nil {
+		return jobError(err, "Can't find deletion")
+	}
+	return sendJSON(w, task)
+}
+
+func CancelShareDeletion(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	share, e := shareFromRequest(r)
+	if e != nil {
+		return e
+	}
+	// cancel, also the deletions of shares finalized before their key was stored
+	if err := background.AdoptShareDeletion(share); err != nil {
+		return jobError(err, "Can't find deletion")
+	}
+	if err := background.CancelShareDeletion(share); err != nil {
+		return jobError(err, "Can't cancel deletion")
+	}
+	w.WriteHeader(204)
+	return nil
+}
+
+func RescheduleShareDeletion(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	share, e := shareFromRequest(r)
+	if e != nil {
+		return e
+	}
+	// parse body
+	var body struct {
+		At time.Time `json:"at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.At.IsZero() {
+		return &HTTPError{err, "Request format invalid", 400}
+	}
+	// reschedule
+	if err := background.RescheduleShareDeletion(r.Context(), share, body.At); err != nil {
+		return jobError(err, "Can't reschedule deletion")
+	}
+	task, err := background.FindShareDeletion(*share)
+	if err != nil {
+		return jobError(err, "Can't find deletion")
+	}
+	return sendJSON(w, task)
+}
+
+// shareFromRequest loads the share of the {id} in the url
+func shareFromRequest(r *http.Request) (*m.Share, *HTTPError) {
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return nil, &HTTPError{err, "Can't connect to database", 500}
+	}
+	// parse url
+	vars := mux.Vars(r)
+	shareID, err := uuid.Parse(vars["id"])
+	if err != nil {
+		return nil, &HTTPError{err, "Can't parse ShareID", 400}
+	}
+	// get share
+	var share m.Share
+	if err := db.Where("id = ?", shareID).First(&share).Error; err != nil {
+		return nil, &HTTPError{err, "Share not found", 404}
+	}
+	return &share, nil
+}
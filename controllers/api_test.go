@@ -2,10 +2,12 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/chiefsend/api/background"
+	"github.com/chiefsend/api/config"
 	m "github.com/chiefsend/api/models"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -43,16 +45,37 @@ func parseShare(sh m.Share) m.Share {
 var url string
 var db *gorm.DB
 
+// withConfig changes the configuration until the test is done
+func withConfig(t *testing.T, change func(c *config.Config)) {
+	old := conf
+	c := conf
+	change(&c)
+	m.Configure(c)
+	Configure(c)
+	t.Cleanup(func() {
+		m.Configure(old)
+		Configure(old)
+	})
+}
+
 func TestMain(mt *testing.M) {
 	_ = os.Setenv("ADMIN_KEY", "testkey123")
+	c, err := config.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	m.Configure(c)
+	background.Configure(c)
+	Configure(c)
 
 	dab, err := m.GetDatabase()
 	if err != nil {
 		log.Fatal("database brok")
 	}
 	db = dab
-	_ = db.AutoMigrate(&m.Share{})
-	_ = db.AutoMigrate(&m.Attachment{})
+	if _, err := m.MigrateUp(db); err != nil {
+		log.Fatal(err)
+	}
 
 	router := mux.NewRouter()
 	ts := httptest.NewServer(router)
@@ -111,6 +134,45 @@ func TestAllShares(t *testing.T) {
 		assert.Len(t, actual, len(expected))
 		assert.Equal(t, expected, actual)
 	})
+
+	t.Run("paginated", func(t *testing.T) {
+		// first page
+		req, _ := http.NewRequest("GET", fmt.Sprint(url, "/shares?limit=1&attachments=false"), nil)
+		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+		res, _ := http.DefaultClient.Do(req)
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual []m.Share
+		_ = json.Unmarshal(body, &actual)
+		next := res.Header.Get("X-Next-Cursor")
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, []m.Share{parseShare(shares[0])}, actual)
+		assert.NotEmpty(t, next)
+		// second page
+		req, _ = http.NewRequest("GET", fmt.Sprint(url, "/shares?limit=1&cursor=", next), nil)
+		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+		res, _ = http.DefaultClient.Do(req)
+		body, _ = ioutil.ReadAll(res.Body)
+		_ = json.Unmarshal(body, &actual)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, []m.Share{parseShare(shares[1])}, actual)
+		assert.Empty(t, res.Header.Get("X-Next-Cursor"))
+	})
+
+	t.Run("filters can't reveal private shares", func(t *testing.T) {
+		res, _ := http.Get(url + "/shares?public=false")
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual []m.Share
+		_ = json.Unmarshal(body, &actual)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, []m.Share{parseShare(shares[0])}, actual)
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		res, _ := http.Get(url + "/shares?sort=password")
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		res, _ = http.Get(url + "/shares?public=maybe")
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
 }
 
 func TestGetShare(t *testing.T) {
@@ -243,6 +305,47 @@ func TestDownloadFile(t *testing.T) {
 	})
 }
 
+func TestCountDownload(t *testing.T) {
+	sh := m.Share{
+		ID:            uuid.MustParse("6e2f4a1b-9c3d-4e5f-8a7b-0c1d2e3f4a51"),
+		IsPublic:      true,
+		DownloadLimit: null.IntFrom(1),
+	}
+	db.Create(&sh)
+	defer db.Delete(&sh)
+
+	t.Run("last download", func(t *testing.T) {
+		// two requests which both saw one download left
+		first, second := sh, sh
+		assert.Nil(t, countDownload(context.Background(), db, &first, false))
+		e := countDownload(context.Background(), db, &second, false)
+		if assert.NotNil(t, e) {
+			assert.Equal(t, http.StatusGone, e.Code)
+		}
+		var stored m.Share
+		db.Where("id = ?", sh.ID).First(&stored)
+		assert.Equal(t, null.IntFrom(0), stored.DownloadLimit)
+		assert.Equal(t, int64(1), stored.Downloads)
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		exhausted := sh
+		exhausted.DownloadLimit = null.IntFrom(0)
+		assert.Nil(t, countDownload(context.Background(), db, &exhausted, true))
+		var stored m.Share
+		db.Where("id = ?", sh.ID).First(&stored)
+		assert.Equal(t, null.IntFrom(0), stored.DownloadLimit)
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		gone := m.Share{ID: uuid.New()}
+		e := countDownload(context.Background(), db, &gone, false)
+		if assert.NotNil(t, e) {
+			assert.Equal(t, http.StatusNotFound, e.Code)
+		}
+	})
+}
+
 func TestOpenShare(t *testing.T) {
 	t.Run("happy path", func(t *testing.T) {
 		// request
@@ -272,6 +375,50 @@ func TestOpenShare(t *testing.T) {
 		assert.Equal(t, newShare.ID, actual.ID)
 	})
 
+	t.Run("policy violation", func(t *testing.T) {
+		withConfig(t, func(c *config.Config) { c.Policy.MaxDownloadLimit = 10 })
+		b, _ := json.Marshal(m.Share{IsPublic: true, DownloadLimit: null.IntFrom(11)})
+		req, _ := http.NewRequest("POST", url+"/shares", bytes.NewReader(b))
+		res, _ := http.DefaultClient.Do(req)
+		// assert
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("past expiry or negative limit", func(t *testing.T) {
+		for _, sh := range []m.Share{
+			{IsPublic: true, Expires: null.TimeFrom(time.Now().Add(-time.Hour))},
+			{IsPublic: true, DownloadLimit: null.IntFrom(-1)},
+		} {
+			b, _ := json.Marshal(sh)
+			req, _ := http.NewRequest("POST", url+"/shares", bytes.NewReader(b))
+			res, _ := http.DefaultClient.Do(req)
+			body, _ := ioutil.ReadAll(res.Body)
+			// assert
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+			assert.Contains(t, string(body), "policy_violation")
+		}
+	})
+
+	t.Run("server managed fields", func(t *testing.T) {
+		withConfig(t, func(c *config.Config) { c.Policy.MaxExpiry = 7 * 24 * time.Hour })
+		// a forged creation date can't stretch the expiry
+		req, _ := http.NewRequest("POST", url+"/shares", strings.NewReader(`{"is_public": true, "created_at": "2099-01-01T00:00:00Z", "expires": "2099-01-05T00:00:00Z"}`))
+		res, _ := http.DefaultClient.Do(req)
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+		assert.Contains(t, string(body), "policy_violation")
+		// nor preset the downloads
+		id := uuid.MustParse("b7e2c4d1-5a3f-4e68-9c0b-1d2e3f4a5b6c")
+		req, _ = http.NewRequest("POST", url+"/shares", strings.NewReader(fmt.Sprintf(`{"id": "%s", "is_public": true, "created_at": "2099-01-01T00:00:00Z", "downloads": 42}`, id)))
+		res, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		var stored m.Share
+		db.First(&stored, "id = ?", id.String())
+		defer db.Delete(&stored)
+		assert.Zero(t, stored.Downloads)
+		assert.WithinDuration(t, time.Now(), stored.CreatedAt, time.Minute)
+	})
+
 	t.Run("bad request", func(t *testing.T) {
 		req, _ := http.NewRequest("POST", url+"/shares", nil)
 		res, _ := http.DefaultClient.Do(req)
@@ -282,15 +429,33 @@ func TestOpenShare(t *testing.T) {
 
 func TestCloseShare(t *testing.T) {
 	sh := m.Share{
-		ID:          uuid.MustParse("a558aca3-fb40-400b-8dc6-ae49c705c791"),
-		IsTemporary: true,
+		ID:             uuid.MustParse("a558aca3-fb40-400b-8dc6-ae49c705c791"),
+		IsTemporary:    true,
+		ManagementHash: m.HashToken("s3cr3t"),
 	}
 	db.Create(&sh)
 	defer db.Delete(&sh)
 
+	t.Run("invalid recipients", func(t *testing.T) {
+		for _, body := range []string{`{"recipients": ["not an address"]}`, `{"recipients": ["Bob <bob@example.com>"]}`, `{"recipients": "bob@example.com"}`} {
+			req, _ := http.NewRequest("POST", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(body))
+			req.Header.Set("X-Management-Token", "s3cr3t")
+			res, _ := http.DefaultClient.Do(req)
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode, body)
+		}
+	})
+
+	t.Run("email not configured", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(`{"recipients": ["bob@example.com"]}`))
+		req.Header.Set("X-Management-Token", "s3cr3t")
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	})
+
 	t.Run("happy path", func(t *testing.T) {
 		// request
 		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), nil)
+		req.Header.Set("X-Management-Token", "s3cr3t")
 		res, _ := http.DefaultClient.Do(req)
 		// parse
 		body, _ := ioutil.ReadAll(res.Body)
@@ -313,8 +478,9 @@ func TestCloseShare(t *testing.T) {
 
 func TestUploadAttachment(t *testing.T) {
 	sh := m.Share{
-		ID:          uuid.MustParse("a558aca3-fb40-400b-8dc6-ae49c705c791"),
-		IsTemporary: true,
+		ID:             uuid.MustParse("a558aca3-fb40-400b-8dc6-ae49c705c791"),
+		IsTemporary:    true,
+		ManagementHash: m.HashToken("s3cr3t"),
 	}
 	db.Create(&sh)
 	defer db.Delete(&sh)
@@ -328,6 +494,7 @@ func TestUploadAttachment(t *testing.T) {
 		writer.Close()
 		// request
 		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/share/%s/attachments", url, sh.ID.String()), bytes.NewReader(b.Bytes()))
+		req.Header.Set("X-Management-Token", "s3cr3t")
 		req.Header.Set("Content-Type", writer.FormDataContentType())
 		res, _ := http.DefaultClient.Do(req)
 		// parse
@@ -341,6 +508,7 @@ func TestUploadAttachment(t *testing.T) {
 
 	t.Run("bad request", func(t *testing.T) {
 		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/share/%s/attachments", url, sh.ID.String()), nil)
+		req.Header.Set("X-Management-Token", "s3cr3t")
 		res, _ := http.DefaultClient.Do(req)
 		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
 	})
@@ -352,8 +520,10 @@ func TestDeleteShare(t *testing.T) {
 	}
 	db.Create(&sh)
 	defer db.Delete(&sh)
-	go background.StartBackgroundWorkers()
-	defer background.StopBackgroundWorkers()
+	if err := background.StartBackgroundWorkers(); err != nil {
+		t.Fatal(err)
+	}
+	defer background.StopBackgroundWorkers(context.Background())
 
 	t.Run("happy path", func(t *testing.T) {
 		// request
@@ -382,21 +552,120 @@ func TestUpdateShare(t *testing.T) {
 	}
 	db.Create(&sh)
 	defer db.Delete(&sh)
+	auth := "Bearer " + base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY")))
 
 	t.Run("happy path", func(t *testing.T) {
 		// request
-		sh.Name.SetValid("UpdatedName")
-		b, _ := json.Marshal(sh)
-		req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), bytes.NewReader(b))
-		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(`{"name": "UpdatedName"}`))
+		req.Header.Set("Authorization", auth)
+		req.Header.Set("Content-Type", "application/merge-patch+json")
 		res, _ := http.DefaultClient.Do(req)
 		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var returned m.Share
+		err := json.Unmarshal(body, &returned)
 		var actual m.Share
 		db.Where("ID = ?", sh.ID.String()).First(&actual)
 		actual.UpdatedAt = uhr
 		// assertions
+		sh.Name.SetValid("UpdatedName")
+		assert.Nil(t, err)
 		assert.Equal(t, http.StatusOK, res.StatusCode)
 		assert.Equal(t, sh, actual)
+		assert.Equal(t, sh.Name, returned.Name)
+	})
+
+	t.Run("password", func(t *testing.T) {
+		// set
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(`{"password": "test123"}`))
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual m.Share
+		db.Where("ID = ?", sh.ID.String()).First(&actual)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotContains(t, string(body), "$2a$") // no hash
+		check, _ := http.NewRequest("GET", url, nil)
+		check.SetBasicAuth(sh.ID.String(), "test123")
+		ok, err := CheckBasicAuth(check, actual)
+		assert.True(t, ok)
+		assert.Nil(t, err)
+		// remove
+		req, _ = http.NewRequest("PATCH", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(`{"password": null}`))
+		req.Header.Set("Authorization", auth)
+		res, _ = http.DefaultClient.Do(req)
+		actual = m.Share{}
+		db.Where("ID = ?", sh.ID.String()).First(&actual)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.False(t, actual.Password.Valid)
+	})
+
+	t.Run("read only fields", func(t *testing.T) {
+		for _, patch := range []string{`{"id": "5713d228-a042-446d-a5e4-183b19fa832a"}`, `{"is_temporary": true}`, `{"files": []}`} {
+			req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(patch))
+			req.Header.Set("Authorization", auth)
+			res, _ := http.DefaultClient.Do(req)
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode, patch)
+		}
+		var actual m.Share
+		err := db.Where("ID = ?", sh.ID.String()).First(&actual).Error
+		assert.Nil(t, err)
+		assert.False(t, actual.IsTemporary)
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		withConfig(t, func(c *config.Config) {
+			c.Policy.DefaultExpiry = 24 * time.Hour
+			c.Policy.MaxExpiry = 7 * 24 * time.Hour
+			c.Policy.DefaultDownloadLimit = 10
+			c.Policy.MaxDownloadLimit = 100
+			c.Policy.RequirePassword = true
+		})
+		patch := func(patch string) int {
+			req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(patch))
+			req.Header.Set("Authorization", auth)
+			res, _ := http.DefaultClient.Do(req)
+			return res.StatusCode
+		}
+		// renaming a share from before the policy, older than the max expiry, gets it no defaults
+		assert.Equal(t, http.StatusOK, patch(`{"name": "Legacy"}`))
+		var actual m.Share
+		db.Where("ID = ?", sh.ID.String()).First(&actual)
+		assert.Equal(t, "Legacy", actual.Name.String)
+		assert.False(t, actual.Expires.Valid)
+		assert.False(t, actual.DownloadLimit.Valid)
+		assert.False(t, actual.Password.Valid)
+		// the fields it changes are checked
+		assert.Equal(t, http.StatusBadRequest, patch(`{"expires": "`+time.Now().Add(time.Hour).Format(time.RFC3339)+`"}`))
+		assert.Equal(t, http.StatusBadRequest, patch(`{"download_limit": 101}`))
+		assert.Equal(t, http.StatusOK, patch(`{"is_public": true}`))
+		assert.Equal(t, http.StatusBadRequest, patch(`{"is_public": false}`))
+		assert.Equal(t, http.StatusOK, patch(`{"download_limit": 5}`))
+	})
+
+	t.Run("can't reschedule", func(t *testing.T) {
+		db.Model(&sh).UpdateColumn("deletion_task", "s:"+uuid.NewString()+":1")
+		c := conf
+		c.Redis.URI = "localhost:1" // nothing listens there
+		background.Configure(c)
+		t.Cleanup(func() { background.Configure(conf) })
+		expires := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+		// request
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(`{"expires": "`+expires.Format(time.RFC3339)+`"}`))
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		var actual m.Share
+		db.Where("ID = ?", sh.ID.String()).First(&actual)
+		// saved anyway, the cleanup job schedules the deletion
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.True(t, expires.Equal(actual.Expires.Time))
+		assert.False(t, actual.DeletionTask.Valid)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/share/%s", url, sh.ID.String()), strings.NewReader(`{"name": "x"}`))
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
 	})
 }
 
@@ -433,3 +702,469 @@ func TestDeleteAttachment(t *testing.T) {
 		assert.NoFileExists(t, path)
 	})
 }
+
+func TestGetConfig(t *testing.T) {
+	withConfig(t, func(c *config.Config) {
+		c.Policy.DefaultExpiry = 24 * time.Hour
+		c.Policy.MaxDownloadLimit = 50
+	})
+
+	t.Run("happy path", func(t *testing.T) {
+		// request
+		res, _ := http.Get(url + "/config")
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual map[string]interface{}
+		_ = json.Unmarshal(body, &actual)
+		// assertions
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.EqualValues(t, 86400, actual["default_expiry"])
+		assert.EqualValues(t, 0, actual["max_expiry"])
+		assert.EqualValues(t, 50, actual["max_download_limit"])
+		assert.Equal(t, false, actual["require_password"])
+	})
+}
+
+func TestFsck(t *testing.T) {
+	t.Run("happy path", func(t *testing.T) {
+		// request
+		req, _ := http.NewRequest("GET", url+"/fsck", nil)
+		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual m.FsckReport
+		err := json.Unmarshal(body, &actual)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", url+"/fsck", nil)
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+}
+
+func TestStats(t *testing.T) {
+	withConfig(t, func(c *config.Config) { c.StatsCacheTTL = 0 })
+
+	t.Run("happy path", func(t *testing.T) {
+		// request
+		req, _ := http.NewRequest("GET", url+"/shares/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual m.Stats
+		err := json.Unmarshal(body, &actual)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotNil(t, actual.SharesPerDay)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		res, _ := http.Get(url + "/shares/stats")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+}
+
+func TestShareStats(t *testing.T) {
+	sh := m.Share{
+		ID:            uuid.MustParse("5c2e8a41-7b3d-4f96-a0e1-2d4b6c8e0f17"),
+		Downloads:     4,
+		DownloadLimit: null.IntFrom(6),
+		Attachments: []m.Attachment{
+			{ID: uuid.MustParse("5c2e8a41-7b3d-4f96-a0e1-2d4b6c8e0f18"), Filename: "a", Filesize: 100},
+			{ID: uuid.MustParse("5c2e8a41-7b3d-4f96-a0e1-2d4b6c8e0f19"), Filename: "b", Filesize: 300},
+		},
+	}
+	db.Create(&sh)
+	defer db.Delete(&sh)
+
+	t.Run("happy path", func(t *testing.T) {
+		// request
+		req, _ := http.NewRequest("GET", url+"/share/"+sh.ID.String()+"/stats", nil)
+		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual m.ShareStats
+		err := json.Unmarshal(body, &actual)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.EqualValues(t, 4, actual.Downloads)
+		assert.Equal(t, null.IntFrom(6), actual.RemainingDownloads)
+		assert.Equal(t, 2, actual.NumberOfAttachments)
+		assert.EqualValues(t, 400, actual.TotalSize)
+		assert.Equal(t, null.IntFrom(300), actual.LargestFile)
+		assert.False(t, actual.ExpiresIn.Valid)
+	})
+}
+
+func TestJobs(t *testing.T) {
+	sh := m.Share{
+		ID: uuid.MustParse("e1d5a8c2-3b47-4f90-8c6e-5a2b7d9f0e13"),
+	}
+	db.Create(&sh)
+	defer db.Delete(&sh)
+	if err := background.StartBackgroundWorkers(); err != nil {
+		t.Fatal(err)
+	}
+	defer background.StopBackgroundWorkers(context.Background())
+	time.Sleep(500 * time.Millisecond)
+	auth := "Bearer " + base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY")))
+
+	t.Run("happy path", func(t *testing.T) {
+		// request
+		req, _ := http.NewRequest("GET", url+"/jobs/tasks?state=scheduled", nil)
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual []background.TaskInfo
+		err := json.Unmarshal(body, &actual)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("reschedule deletion", func(t *testing.T) {
+		at := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		// request
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("%s/share/%s/deletion", url, sh.ID), strings.NewReader(fmt.Sprintf(`{"at": %q}`, at.Format(time.RFC3339))))
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual background.TaskInfo
+		err := json.Unmarshal(body, &actual)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, background.DeleteShare, actual.Type)
+		assert.WithinDuration(t, at, *actual.NextProcessAt, time.Second)
+
+		// cancel it again
+		req, _ = http.NewRequest("DELETE", fmt.Sprintf("%s/share/%s/deletion", url, sh.ID), nil)
+		req.Header.Set("Authorization", auth)
+		res, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		res, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	})
+
+	t.Run("bad request", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", url+"/jobs/tasks?state=sleeping", nil)
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		for _, path := range []string{"/jobs", "/jobs/queues", "/jobs/tasks"} {
+			res, _ := http.Get(url + path)
+			assert.Equal(t, http.StatusUnauthorized, res.StatusCode, path)
+		}
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	auth := "Bearer " + base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY")))
+	var created m.Webhook
+
+	t.Run("create", func(t *testing.T) {
+		// request
+		req, _ := http.NewRequest("POST", url+"/webhooks", strings.NewReader(`{"url": "https://example.com/hook", "events": ["share.finalized", "share.deleted"]}`))
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		err := json.Unmarshal(body, &created)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotEmpty(t, created.Secret)
+		assert.True(t, created.Active)
+		assert.Equal(t, m.EventList{m.EventShareFinalized, m.EventShareDeleted}, created.Events)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		// request
+		req, _ := http.NewRequest("GET", url+"/webhooks", nil)
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual []m.Webhook
+		err := json.Unmarshal(body, &actual)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Len(t, actual, 1)
+		assert.Empty(t, actual[0].Secret)
+	})
+
+	t.Run("deliveries", func(t *testing.T) {
+		db.Create(&m.WebhookDelivery{WebhookID: created.ID, EventID: uuid.New(), Event: m.EventShareDeleted, Attempt: 1, StatusCode: 200})
+		// request
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/webhook/%s/deliveries", url, created.ID), nil)
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		var actual []m.WebhookDelivery
+		err := json.Unmarshal(body, &actual)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Len(t, actual, 1)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, body := range []string{`{"url": "ftp://example.com", "events": ["share.deleted"]}`, `{"url": "https://example.com", "events": ["share.eaten"]}`, `{"url": "https://example.com"}`} {
+			req, _ := http.NewRequest("POST", url+"/webhooks", strings.NewReader(body))
+			req.Header.Set("Authorization", auth)
+			res, _ := http.DefaultClient.Do(req)
+			assert.Equal(t, http.StatusBadRequest, res.StatusCode, body)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/webhook/%s", url, created.ID), nil)
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		var count int64
+		db.Model(&m.WebhookDelivery{}).Where("webhook_id = ?", created.ID).Count(&count)
+		assert.Zero(t, count)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		res, _ := http.Get(url + "/webhooks")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+}
+
+func TestUploadRequests(t *testing.T) {
+	auth := "Bearer " + base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY")))
+	var ur m.UploadRequest
+	var share m.Share
+	upload := func(token, name, content string) *http.Response {
+		var b bytes.Buffer
+		writer := multipart.NewWriter(&b)
+		fw, _ := writer.CreateFormFile("file", name)
+		_, _ = io.Copy(fw, strings.NewReader(content))
+		writer.Close()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/share/%s/attachments", url, share.ID.String()), bytes.NewReader(b.Bytes()))
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("X-Upload-Token", token)
+		res, _ := http.DefaultClient.Do(req)
+		return res
+	}
+	defer func() {
+		db.Where("upload_request_id = ?", ur.ID.String()).Delete(&m.Share{})
+		db.Delete(&ur)
+	}()
+
+	t.Run("create", func(t *testing.T) {
+		// request
+		req, _ := http.NewRequest("POST", url+"/uploadrequests", strings.NewReader(`{"name": "Invoices", "owner": "accounting", "max_shares": 1, "max_files": 2, "max_size": 20}`))
+		req.Header.Set("Authorization", auth)
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		err := json.Unmarshal(body, &ur)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotEmpty(t, ur.Token)
+		var stored m.UploadRequest
+		db.Where("id = ?", ur.ID).First(&stored)
+		assert.Equal(t, m.HashToken(ur.Token), stored.TokenHash)
+	})
+
+	t.Run("current", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", url+"/uploadrequest", nil)
+		req.Header.Set("X-Upload-Token", ur.Token)
+		res, _ := http.DefaultClient.Do(req)
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Contains(t, string(body), "Invoices")
+		assert.NotContains(t, string(body), "accounting")
+	})
+
+	t.Run("open share", func(t *testing.T) {
+		// request
+		req, _ := http.NewRequest("POST", url+"/shares", strings.NewReader(`{"name": "March", "is_public": true, "upload_request_id": "f43b0e48-13cc-4c6c-8a23-3a18a670effd"}`))
+		req.Header.Set("X-Upload-Token", ur.Token)
+		res, _ := http.DefaultClient.Do(req)
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		err := json.Unmarshal(body, &share)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, null.StringFrom("accounting"), share.Owner)
+		assert.Equal(t, null.StringFrom(ur.ID.String()), share.UploadRequestID)
+		assert.False(t, share.IsPublic)
+		// no management token, the uploader isn't the owner
+		assert.NotContains(t, string(body), "management_token")
+		var stored m.Share
+		db.Where("id = ?", share.ID).First(&stored)
+		assert.Empty(t, stored.ManagementHash)
+	})
+
+	t.Run("used up", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", url+"/shares", strings.NewReader(`{"name": "April"}`))
+		req.Header.Set("X-Upload-Token", ur.Token)
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusGone, res.StatusCode)
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, upload(ur.Token, "a.txt", "0123456789").StatusCode)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, upload(ur.Token, "b.txt", "0123456789abc").StatusCode) // too big
+		assert.Equal(t, http.StatusOK, upload(ur.Token, "b.txt", "0123456789").StatusCode)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, upload(ur.Token, "c.txt", "0").StatusCode) // too many
+		assert.Equal(t, http.StatusUnauthorized, upload("", "c.txt", "0").StatusCode)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/share/%s", url, share.ID.String()), nil)
+		req.Header.Set("X-Upload-Token", "guessed")
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+		req.Header.Set("X-Upload-Token", ur.Token)
+		res, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("owner only", func(t *testing.T) {
+		// uploader
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/share/%s", url, share.ID.String()), nil)
+		req.Header.Set("X-Upload-Token", ur.Token)
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+		for _, r := range []struct{ method, path string }{
+			{"PATCH", "/share/" + share.ID.String()},
+			{"DELETE", "/share/" + share.ID.String()},
+			{"GET", "/share/" + share.ID.String() + "/stats"},
+		} {
+			req, _ := http.NewRequest(r.method, url+r.path, strings.NewReader(`{"name": "Mine"}`))
+			req.Header.Set("X-Upload-Token", ur.Token)
+			res, _ := http.DefaultClient.Do(req)
+			assert.Equal(t, http.StatusForbidden, res.StatusCode, r.method+" "+r.path)
+		}
+		// admin
+		req.Header.Set("Authorization", auth)
+		res, _ = http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", url+"/shares", strings.NewReader(`{}`))
+		req.Header.Set("X-Upload-Token", "guessed")
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		res, _ := http.Get(url + "/uploadrequests")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+}
+
+func TestManagementToken(t *testing.T) {
+	var created struct {
+		m.Share
+		ManagementToken string `json:"management_token"`
+	}
+	var other m.Share
+	db.Create(&other)
+	defer db.Delete(&other)
+	do := func(method, path, token string, body io.Reader) *http.Response {
+		req, _ := http.NewRequest(method, url+path, body)
+		req.Header.Set("X-Management-Token", token)
+		res, _ := http.DefaultClient.Do(req)
+		return res
+	}
+
+	t.Run("open share", func(t *testing.T) {
+		// request
+		res, _ := http.Post(url+"/shares", "application/json", strings.NewReader(`{"name": "Mine"}`))
+		// parse
+		body, _ := ioutil.ReadAll(res.Body)
+		err := json.Unmarshal(body, &created)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotEmpty(t, created.ManagementToken)
+		var stored m.Share
+		db.Where("id = ?", created.ID).First(&stored)
+		assert.Equal(t, m.HashToken(created.ManagementToken), stored.ManagementHash)
+	})
+
+	t.Run("not shown again", func(t *testing.T) {
+		res := do("POST", "/share/"+created.ID.String(), created.ManagementToken, nil)
+		body, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.NotContains(t, string(body), "management")
+	})
+
+	t.Run("update", func(t *testing.T) {
+		res := do("PATCH", "/share/"+created.ID.String(), created.ManagementToken, strings.NewReader(`{"name": "Renamed"}`))
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res = do("PATCH", "/share/"+created.ID.String(), "guessed", strings.NewReader(`{"name": "Hacked"}`))
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("other share", func(t *testing.T) {
+		res := do("PATCH", "/share/"+other.ID.String(), created.ManagementToken, strings.NewReader(`{"name": "Hacked"}`))
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		res = do("DELETE", "/share/"+other.ID.String(), created.ManagementToken, nil)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	t.Run("attachments", func(t *testing.T) {
+		// upload to the finalized share
+		var b bytes.Buffer
+		writer := multipart.NewWriter(&b)
+		fw, _ := writer.CreateFormFile("file", "late.txt")
+		_, _ = io.Copy(fw, strings.NewReader("forgot this one"))
+		writer.Close()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/share/%s/attachments", url, created.ID), &b)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		res, _ := http.DefaultClient.Do(req)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		b.Reset()
+		writer = multipart.NewWriter(&b)
+		fw, _ = writer.CreateFormFile("file", "late.txt")
+		_, _ = io.Copy(fw, strings.NewReader("forgot this one"))
+		writer.Close()
+		req, _ = http.NewRequest("POST", fmt.Sprintf("%s/share/%s/attachments", url, created.ID), &b)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("X-Management-Token", created.ManagementToken)
+		res, _ = http.DefaultClient.Do(req)
+		var att m.Attachment
+		body, _ := ioutil.ReadAll(res.Body)
+		_ = json.Unmarshal(body, &att)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		// remove it again
+		path := fmt.Sprintf("/share/%s/attachment/%s", created.ID, att.ID)
+		assert.Equal(t, http.StatusUnauthorized, do("DELETE", path, "", nil).StatusCode)
+		assert.Equal(t, http.StatusOK, do("DELETE", path, created.ManagementToken, nil).StatusCode)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("GET", "/share/"+created.ID.String()+"/stats", created.ManagementToken, nil).StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, do("GET", "/share/"+other.ID.String()+"/stats", created.ManagementToken, nil).StatusCode)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do("DELETE", "/share/"+created.ID.String(), created.ManagementToken, nil).StatusCode)
+	})
+}
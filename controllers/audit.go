@@ -0,0 +1,106 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/chiefsend/api/logging"
+	m "github.com/chiefsend/api/models"
+	"gopkg.in/guregu/null.v4"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// auditEntry returns the entry for an action of the request on the share, done with the credentials of role
+func auditEntry(r *http.Request, role Role, action string, share m.Share) m.AuditEntry {
+	entry := m.AuditEntry{Action: action, ShareID: share.ID}
+	switch role {
+	case RoleAdmin:
+		entry.Actor = m.ActorAdmin
+	case RoleOwner:
+		entry.Actor = m.ActorOwner
+	case RoleUploader:
+		entry.Actor = m.ActorUploader
+		entry.ActorID = share.UploadRequestID
+	default:
+		entry.Actor = role.String()
+	}
+	// the address of the peer, headers of proxies can be forged
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.IP = null.StringFrom(host)
+	}
+	if id := logging.RequestID(r.Context()); id != "" {
+		entry.RequestID = null.StringFrom(id)
+	}
+	return entry
+}
+
+// AuditLog returns the audit log, newest first. Admins only.
+func AuditLog(w http.ResponseWriter, r *http.Request) *HTTPError {
+	// admin auth
+	if auth, err := CheckBearerAuth(r); err != nil || auth == false {
+		return &HTTPError{err, "Authentication Failed", 401}
+	}
+	// parse query
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		return &HTTPError{err, "invalid query param", 400}
+	}
+	// get database
+	db, err := m.GetDatabaseContext(r.Context())
+	if err != nil {
+		return &HTTPError{err, "Can't connect to database", 500}
+	}
+	// get entries
+	entries, next, err := m.FindAuditEntries(db, filter)
+	if errors.Is(err, m.ErrInvalidQuery) {
+		return &HTTPError{err, "invalid query param", 400}
+	}
+	if err != nil {
+		return &HTTPError{err, "Can't fetch data", 500}
+	}
+	if entries == nil {
+		entries = []m.AuditEntry{}
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	return sendJSON(w, entries)
+}
+
+// parseAuditFilter reads the filter and pagination params of the audit log
+func parseAuditFilter(r *http.Request) (m.AuditFilter, error) {
+	q := r.URL.Query()
+	f := m.AuditFilter{Cursor: q.Get("cursor")}
+	var err error
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil {
+			return f, fmt.Errorf("limit: %w", err)
+		}
+	}
+	values := map[string]*null.String{
+		"share":  &f.ShareID,
+		"actor":  &f.Actor,
+		"action": &f.Action,
+	}
+	for key, v := range values {
+		if s := q.Get(key); s != "" {
+			v.SetValid(s)
+		}
+	}
+	times := map[string]*null.Time{
+		"since": &f.Since,
+		"until": &f.Until,
+	}
+	for key, t := range times {
+		if s := q.Get(key); s != "" {
+			v, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return f, fmt.Errorf("%s: %w", key, err)
+			}
+			t.SetValid(v)
+		}
+	}
+	return f, nil
+}
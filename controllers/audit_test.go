@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/chiefsend/api/logging"
+	m "github.com/chiefsend/api/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	sh := m.Share{ID: uuid.MustParse("0f1b5a47-1d8c-4c8e-9b0e-5a1f8f3c2d01")}
+	db.Create(&sh)
+	defer db.Delete(&sh)
+	defer db.Where("share_id = ?", sh.ID.String()).Delete(&m.AuditEntry{})
+	auth := "Bearer " + base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY")))
+
+	patch := func(t *testing.T, body string) {
+		req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/share/%s", url, sh.ID), strings.NewReader(body))
+		req.Header.Set("Authorization", auth)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+	audit := func(t *testing.T, query string, admin bool) (*http.Response, []m.AuditEntry, string) {
+		req, _ := http.NewRequest("GET", url+"/audit?"+query, nil)
+		if admin {
+			req.Header.Set("Authorization", auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		var entries []m.AuditEntry
+		_ = json.Unmarshal(body, &entries)
+		return res, entries, string(body)
+	}
+
+	t.Run("update", func(t *testing.T) {
+		patch(t, `{"name": "Audited"}`)
+		res, entries, _ := audit(t, "share="+sh.ID.String(), true)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		if assert.Len(t, entries, 1) {
+			e := entries[0]
+			assert.Equal(t, m.ActorAdmin, e.Actor)
+			assert.Equal(t, m.AuditShareUpdate, e.Action)
+			assert.Equal(t, sh.ID, e.ShareID)
+			assert.Equal(t, m.Changes{"name": {After: "Audited"}}, e.Changes)
+			assert.Equal(t, "127.0.0.1", e.IP.String)
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		patch(t, `{"password": "hunter2"}`)
+		_, entries, body := audit(t, "share="+sh.ID.String()+"&limit=1", true)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, m.Change{After: "[REDACTED]"}, entries[0].Changes["password"])
+		}
+		assert.NotContains(t, body, "$2a$")
+		assert.NotContains(t, body, "hunter2")
+	})
+
+	t.Run("password changed", func(t *testing.T) {
+		patch(t, `{"password": "hunter3"}`)
+		_, entries, body := audit(t, "share="+sh.ID.String()+"&limit=1", true)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, m.Change{Before: "[REDACTED]", After: "[REDACTED]"}, entries[0].Changes["password"])
+		}
+		assert.NotContains(t, body, "$2a$")
+		assert.NotContains(t, body, "hunter3")
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		_, entries, _ := audit(t, "share="+sh.ID.String()+"&action="+m.AuditShareFinalize, true)
+		assert.Empty(t, entries)
+		res, entries, _ := audit(t, "share="+sh.ID.String()+"&limit=1", true)
+		assert.Len(t, entries, 1)
+		assert.NotEmpty(t, res.Header.Get("X-Next-Cursor"))
+		res, _, _ = audit(t, "since=yesterday", true)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+
+	t.Run("entry", func(t *testing.T) {
+		ur := null.StringFrom("7d1c1b0e-3f2a-4d5b-8c6e-9a0b1c2d3e4f")
+		req := httptest.NewRequest("POST", "/share/123", nil)
+		req.RemoteAddr = "192.0.2.1:4242"
+		req = req.WithContext(logging.WithRequestID(req.Context(), "audit-1"))
+		e := auditEntry(req, RoleUploader, m.AuditShareFinalize, m.Share{ID: sh.ID, UploadRequestID: ur})
+		assert.Equal(t, m.ActorUploader, e.Actor)
+		assert.Equal(t, ur, e.ActorID)
+		assert.Equal(t, "192.0.2.1", e.IP.String)
+		assert.Equal(t, "audit-1", e.RequestID.String)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		del := m.Share{ID: uuid.MustParse("0f1b5a47-1d8c-4c8e-9b0e-5a1f8f3c2d02")}
+		db.Create(&del)
+		defer db.Delete(&del)
+		defer db.Where("share_id = ?", del.ID.String()).Delete(&m.AuditEntry{})
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/share/%s", url, del.ID), nil)
+		req.Header.Set("Authorization", auth)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		_, entries, _ := audit(t, "share="+del.ID.String()+"&action="+m.AuditShareDelete, true)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, m.ActorAdmin, entries[0].Actor)
+		}
+	})
+
+	t.Run("admins only", func(t *testing.T) {
+		res, _, _ := audit(t, "", false)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+}
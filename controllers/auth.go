@@ -1,13 +1,16 @@
 package controllers
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
+	"github.com/chiefsend/api/metrics"
 	"github.com/chiefsend/api/models"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 	"net/http"
-	"os"
 	"strings"
+	"time"
 )
 
 // CheckBearerAuth returns true if the ADMIN_KEY is provided as Bearer token, false otherwise (or no token is included)
@@ -27,7 +30,7 @@ func CheckBearerAuth(r *http.Request) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return string(token) == os.Getenv("ADMIN_KEY"), nil
+	return conf.AdminKey != "" && subtle.ConstantTimeCompare(token, []byte(conf.AdminKey)) == 1, nil
 }
 
 // CheckBasicAuth returns true if data in basic auth header can unlock the share. Returns error if no Auth header is provided
@@ -35,13 +38,16 @@ func CheckBasicAuth(r *http.Request, share models.Share) (bool, error) {
 	if share.Password.Valid {
 		sid, pass, ok := r.BasicAuth()
 		if !ok {
-			return false, errors.New("invalid auth header")
+			return false, ErrPasswordRequired
 		}
 		if sid != share.ID.String() {
 			return false, nil
 		}
 
-		if err := bcrypt.CompareHashAndPassword([]byte(share.Password.ValueOrZero()), []byte(pass)); err != nil {
+		start := time.Now()
+		err := bcrypt.CompareHashAndPassword([]byte(share.Password.ValueOrZero()), []byte(pass))
+		metrics.BcryptDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
 			return false, err
 		} else {
 			return true, nil
@@ -49,3 +55,25 @@ func CheckBasicAuth(r *http.Request, share models.Share) (bool, error) {
 	}
 	return true, nil // no password
 }
+
+// CheckUploadToken returns the upload request of the X-Upload-Token header, nil if there is no token
+func CheckUploadToken(r *http.Request, db *gorm.DB) (*models.UploadRequest, error) {
+	token := r.Header.Get("X-Upload-Token")
+	if token == "" {
+		return nil, nil
+	}
+	ur, err := models.FindUploadRequest(db, token)
+	if err != nil {
+		return nil, err
+	}
+	return &ur, nil
+}
+
+// CheckManagementToken returns true if the X-Management-Token header holds the management token of the share
+func CheckManagementToken(r *http.Request, share models.Share) bool {
+	token := r.Header.Get("X-Management-Token")
+	if token == "" || share.ManagementHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(models.HashToken(token)), []byte(share.ManagementHash)) == 1
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"errors"
+	m "github.com/chiefsend/api/models"
+	"gorm.io/gorm"
+	"net/http"
+)
+
+// Role of a request in relation to a share, a higher role may do everything a lower one may
+type Role int
+
+const (
+	RoleAnonymous Role = iota
+	RoleUploader       // X-Upload-Token of the upload request the share was opened with
+	RoleOwner          // X-Management-Token of the share
+	RoleAdmin          // ADMIN_KEY
+	roleNobody         // not even the admin
+)
+
+func (r Role) String() string {
+	return [...]string{"anonymous", "uploader", "owner", "admin", "nobody"}[r]
+}
+
+// Action changes a share
+type Action string
+
+const (
+	ActionUpload           Action = "upload"
+	ActionRemoveAttachment Action = "remove_attachment"
+	ActionFinalize         Action = "finalize"
+	ActionUpdate           Action = "update"
+	ActionDelete           Action = "delete"
+	ActionStats            Action = "stats"
+)
+
+// permissions holds the lowest role allowed to do an action, by the state of the share
+var permissions = map[Action]struct{ Temporary, Finalized Role }{
+	ActionUpload:           {RoleUploader, RoleOwner},
+	ActionRemoveAttachment: {RoleUploader, RoleOwner},
+	ActionFinalize:         {RoleUploader, roleNobody}, // closing twice is a no-op
+	ActionUpdate:           {RoleOwner, RoleOwner},
+	ActionDelete:           {RoleOwner, RoleOwner},
+	ActionStats:            {RoleOwner, RoleOwner},
+}
+
+// required returns the lowest role allowed to do the action on the share
+func required(action Action, share m.Share) Role {
+	p, ok := permissions[action]
+	switch {
+	case !ok:
+		return roleNobody
+	case legacy(share) && (action == ActionUpload || action == ActionFinalize):
+		return RoleAnonymous // as before there were management tokens
+	case share.IsTemporary:
+		return p.Temporary
+	default:
+		return p.Finalized
+	}
+}
+
+// legacy reports whether the share is a temporary one opened before there were management tokens. Whoever knows its id
+// may still upload to and finalize it.
+func legacy(share m.Share) bool {
+	return share.IsTemporary && share.ManagementHash == "" && !share.UploadRequestID.Valid
+}
+
+// anonymous reports whether the request comes without any credentials
+func anonymous(r *http.Request) bool {
+	return r.Header.Get("Authorization") == "" && r.Header.Get("X-Management-Token") == "" &&
+		r.Header.Get("X-Upload-Token") == ""
+}
+
+// roleOf returns the highest role the credentials of the request grant on the share
+func roleOf(r *http.Request, db *gorm.DB, share m.Share) (Role, error) {
+	admin, err := CheckBearerAuth(r)
+	if err != nil {
+		return RoleAnonymous, err
+	}
+	if admin {
+		return RoleAdmin, nil
+	}
+	if CheckManagementToken(r, share) {
+		return RoleOwner, nil
+	}
+	if share.UploadRequestID.Valid {
+		ur, err := CheckUploadToken(r, db)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return RoleAnonymous, ErrUploadTokenInvalid
+		}
+		if err != nil {
+			return RoleAnonymous, err
+		}
+		if ur != nil {
+			if ur.ID.String() != share.UploadRequestID.String {
+				return RoleAnonymous, ErrUploadTokenInvalid // token of another upload request
+			}
+			return RoleUploader, nil
+		}
+	}
+	return RoleAnonymous, nil
+}
+
+// authorize returns the role of the request, or an error if it may not do the action on the share
+func authorize(r *http.Request, db *gorm.DB, share m.Share, action Action) (Role, *HTTPError) {
+	role, err := roleOf(r, db, share)
+	if errors.Is(err, ErrUploadTokenInvalid) {
+		return role, &HTTPError{err, "Invalid upload token", 403}
+	}
+	if err != nil {
+		return role, &HTTPError{err, "Can't check authorization", 500}
+	}
+	if role >= required(action, share) {
+		return role, nil
+	}
+	temporary := share
+	temporary.IsTemporary = true
+	switch {
+	case !share.IsTemporary && role >= required(action, temporary):
+		return role, &HTTPError{ErrShareFinalized, "Share is already finalized", 403}
+	case role == RoleAnonymous:
+		return role, &HTTPError{nil, "Authentication Failed", 401}
+	default:
+		return role, &HTTPError{nil, "Not allowed to " + string(action) + " as " + role.String(), 403}
+	}
+}
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	m "github.com/chiefsend/api/models"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	var other m.UploadRequest
+	db.Create(&other)
+	defer db.Delete(&other)
+
+	// expected status by role, for temporary and finalized shares
+	roles := []string{"anonymous", "other uploader", "uploader", "owner", "admin"}
+	cases := []struct {
+		action               Action
+		method, path         string // %[1]s: share, %[2]s: attachment
+		temporary, finalized [5]int
+	}{
+		{ActionUpload, "POST", "/share/%[1]s/attachments", [5]int{401, 403, 200, 200, 200}, [5]int{401, 403, 403, 200, 200}},
+		{ActionRemoveAttachment, "DELETE", "/share/%[1]s/attachment/%[2]s", [5]int{401, 403, 200, 200, 200}, [5]int{401, 403, 403, 200, 200}},
+		{ActionFinalize, "POST", "/share/%[1]s", [5]int{401, 403, 200, 200, 200}, [5]int{200, 200, 200, 200, 200}}, // no-op
+		{ActionUpdate, "PATCH", "/share/%[1]s", [5]int{401, 403, 403, 200, 200}, [5]int{401, 403, 403, 200, 200}},
+		{ActionDelete, "DELETE", "/share/%[1]s", [5]int{401, 403, 403, 200, 200}, [5]int{401, 403, 403, 200, 200}},
+		{ActionStats, "GET", "/share/%[1]s/stats", [5]int{401, 403, 403, 200, 200}, [5]int{401, 403, 403, 200, 200}},
+	}
+
+	for _, c := range cases {
+		for _, temporary := range []bool{true, false} {
+			expected := c.finalized
+			state := "finalized"
+			if temporary {
+				expected, state = c.temporary, "temporary"
+			}
+			for i, role := range roles {
+				t.Run(fmt.Sprintf("%s %s share as %s", c.action, state, role), func(t *testing.T) {
+					// fresh share from an upload request, with one file
+					var ur m.UploadRequest
+					db.Create(&ur)
+					defer db.Delete(&ur)
+					sh := m.Share{
+						IsTemporary:     temporary,
+						UploadRequestID: null.StringFrom(ur.ID.String()),
+						ManagementHash:  m.HashToken("s3cr3t"),
+						Attachments:     []m.Attachment{{Filename: "a.txt", Filesize: 3}},
+					}
+					db.Create(&sh)
+					defer db.Delete(&sh)
+					_ = os.WriteFile(filepath.Join(sh.Dir(), sh.Attachments[0].ID.String()), []byte("abc"), 0600)
+					// request
+					var body io.Reader
+					contentType := "application/merge-patch+json"
+					switch c.action {
+					case ActionUpload:
+						var b bytes.Buffer
+						writer := multipart.NewWriter(&b)
+						fw, _ := writer.CreateFormFile("file", "b.txt")
+						_, _ = io.Copy(fw, strings.NewReader("def"))
+						writer.Close()
+						body, contentType = &b, writer.FormDataContentType()
+					case ActionUpdate:
+						body = strings.NewReader(`{"name": "Renamed"}`)
+					}
+					req, _ := http.NewRequest(c.method, url+fmt.Sprintf(c.path, sh.ID, sh.Attachments[0].ID), body)
+					req.Header.Set("Content-Type", contentType)
+					switch role {
+					case "other uploader":
+						req.Header.Set("X-Upload-Token", other.Token)
+					case "uploader":
+						req.Header.Set("X-Upload-Token", ur.Token)
+					case "owner":
+						req.Header.Set("X-Management-Token", "s3cr3t")
+					case "admin":
+						req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+					}
+					res, _ := http.DefaultClient.Do(req)
+					// assertions
+					assert.Equal(t, expected[i], res.StatusCode)
+				})
+			}
+		}
+	}
+}
+
+func TestAuthorizeReads(t *testing.T) {
+	var ur, other m.UploadRequest
+	db.Create(&ur)
+	defer db.Delete(&ur)
+	db.Create(&other)
+	defer db.Delete(&other)
+
+	// expected status by role, for temporary and finalized shares. Shares of upload requests have no management
+	// token, only admins can read them.
+	roles := []string{"anonymous", "other uploader", "uploader", "owner", "admin"}
+	cases := []struct {
+		route                string
+		method, path         string // %[1]s: share, %[2]s: attachment
+		request              bool   // share of an upload request
+		temporary, finalized [5]int
+	}{
+		{"GetShare", "GET", "/share/%[1]s", false, [5]int{403, 403, 403, 403, 200}, [5]int{200, 200, 200, 200, 200}},
+		{"GetShare", "GET", "/share/%[1]s", true, [5]int{403, 403, 403, 403, 200}, [5]int{403, 403, 403, 403, 200}},
+		{"DownloadFile", "GET", "/share/%[1]s/attachment/%[2]s", false, [5]int{403, 403, 403, 403, 200}, [5]int{200, 200, 200, 200, 200}},
+		{"DownloadFile", "GET", "/share/%[1]s/attachment/%[2]s", true, [5]int{403, 403, 403, 403, 200}, [5]int{403, 403, 403, 403, 200}},
+		{"DownloadZip", "GET", "/share/%[1]s/zip", false, [5]int{403, 403, 403, 403, 200}, [5]int{200, 200, 200, 200, 200}},
+		{"DownloadZip", "GET", "/share/%[1]s/zip", true, [5]int{403, 403, 403, 403, 200}, [5]int{403, 403, 403, 403, 200}},
+		{"ShareStats", "GET", "/share/%[1]s/stats", false, [5]int{401, 401, 401, 200, 200}, [5]int{401, 401, 401, 200, 200}},
+		{"ShareStats", "GET", "/share/%[1]s/stats", true, [5]int{401, 403, 403, 401, 200}, [5]int{401, 403, 403, 401, 200}},
+	}
+
+	for _, c := range cases {
+		for _, temporary := range []bool{true, false} {
+			expected := c.finalized
+			state := "finalized"
+			if temporary {
+				expected, state = c.temporary, "temporary"
+			}
+			kind := "own"
+			if c.request {
+				kind = "upload request"
+			}
+			for i, role := range roles {
+				t.Run(fmt.Sprintf("%s %s %s share as %s", c.route, state, kind, role), func(t *testing.T) {
+					// fresh share with one file
+					sh := m.Share{
+						IsPublic:       true,
+						IsTemporary:    temporary,
+						ManagementHash: m.HashToken("s3cr3t"),
+						Attachments:    []m.Attachment{{Filename: "a.txt", Filesize: 3}},
+					}
+					if c.request {
+						sh.UploadRequestID, sh.ManagementHash = null.StringFrom(ur.ID.String()), ""
+					}
+					db.Create(&sh)
+					defer db.Delete(&sh)
+					_ = os.WriteFile(filepath.Join(sh.Dir(), sh.Attachments[0].ID.String()), []byte("abc"), 0600)
+					// request
+					req, _ := http.NewRequest(c.method, url+fmt.Sprintf(c.path, sh.ID, sh.Attachments[0].ID), nil)
+					switch role {
+					case "other uploader":
+						req.Header.Set("X-Upload-Token", other.Token)
+					case "uploader":
+						req.Header.Set("X-Upload-Token", ur.Token)
+					case "owner":
+						req.Header.Set("X-Management-Token", "s3cr3t")
+					case "admin":
+						req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+					}
+					res, _ := http.DefaultClient.Do(req)
+					// assertions
+					assert.Equal(t, expected[i], res.StatusCode)
+				})
+			}
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	t.Run("every action", func(t *testing.T) {
+		for action, p := range permissions {
+			assert.LessOrEqual(t, int(p.Temporary), int(p.Finalized), action) // finalizing never opens up a share
+			assert.Greater(t, int(p.Temporary), int(RoleAnonymous), action)
+		}
+	})
+
+	t.Run("unknown action", func(t *testing.T) {
+		assert.Equal(t, roleNobody, required("rename", m.Share{}))
+	})
+
+	t.Run("legacy share", func(t *testing.T) {
+		// temporary, opened before there were management tokens
+		sh := m.Share{IsTemporary: true}
+		assert.Equal(t, RoleAnonymous, required(ActionUpload, sh))
+		assert.Equal(t, RoleAnonymous, required(ActionFinalize, sh))
+		assert.Equal(t, RoleOwner, required(ActionUpdate, sh))
+		assert.Equal(t, RoleUploader, required(ActionFinalize, m.Share{IsTemporary: true, ManagementHash: m.HashToken("s3cr3t")}))
+		assert.Equal(t, RoleUploader, required(ActionFinalize, m.Share{IsTemporary: true, UploadRequestID: null.StringFrom("x")}))
+		assert.Equal(t, RoleOwner, required(ActionUpload, m.Share{}))
+	})
+}
+
+func TestLegacyFinalize(t *testing.T) {
+	sh := m.Share{IsTemporary: true}
+	db.Create(&sh)
+	defer db.Delete(&sh)
+
+	req, _ := http.NewRequest("PATCH", fmt.Sprintf("%s/share/%s", url, sh.ID), strings.NewReader(`{"name": "Mine"}`))
+	res, _ := http.DefaultClient.Do(req)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res, _ = http.Post(fmt.Sprintf("%s/share/%s", url, sh.ID), "application/json", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var stored m.Share
+	db.Where("id = ?", sh.ID).First(&stored)
+	assert.False(t, stored.IsTemporary)
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/chiefsend/api/background"
+	"github.com/chiefsend/api/logging"
+	m "github.com/chiefsend/api/models"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"net/http"
+	"regexp"
+)
+
+// errors with a stable code, handlers wrap or return them so clients can react on the code
+var (
+	ErrShareNotFinalized    = errors.New("share is not finalized")
+	ErrShareFinalized       = errors.New("share is already finalized")
+	ErrShareExpired         = errors.New("share is expired")
+	ErrDownloadLimitReached = errors.New("download limit of share is reached")
+	ErrPasswordRequired     = errors.New("share is protected by a password")
+	ErrQuotaExceeded        = errors.New("quota exceeded")
+	ErrAttachmentMismatch   = errors.New("share doesn't match attachment")
+	ErrUploadTokenInvalid   = errors.New("upload token is invalid")
+	ErrOwnerOnly            = errors.New("share can only be accessed by its owner")
+)
+
+// error codes, never change the existing ones
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrShareNotFinalized, "share_not_finalized"},
+	{ErrShareFinalized, "share_finalized"},
+	{ErrShareExpired, "share_expired"},
+	{ErrDownloadLimitReached, "download_limit_reached"},
+	{ErrPasswordRequired, "password_required"},
+	{ErrQuotaExceeded, "quota_exceeded"},
+	{ErrAttachmentMismatch, "not_found"},
+	{ErrUploadTokenInvalid, "invalid_upload_token"},
+	{ErrOwnerOnly, "forbidden"},
+	{m.ErrUploadRequestClosed, "upload_request_closed"},
+	{m.ErrInvalidUploadRequest, "invalid_upload_request"},
+	{m.ErrPolicyViolation, "policy_violation"},
+	{m.ErrInvalidPatch, "invalid_patch"},
+	{m.ErrInvalidWebhook, "invalid_webhook"},
+	{m.ErrInvalidEmail, "invalid_email"},
+	{background.ErrMailNotConfigured, "unavailable"},
+	{background.ErrNotConfigured, "unavailable"},
+	{background.ErrInvalidState, "bad_request"},
+	{background.ErrNoDeletion, "not_found"},
+	{background.ErrTaskNotFound, "not_found"},
+	{bcrypt.ErrMismatchedHashAndPassword, "invalid_password"},
+	{gorm.ErrRecordNotFound, "not_found"},
+}
+
+// fallback codes by HTTP status
+var statusCodes = map[int]string{
+	400: "bad_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	409: "conflict",
+	410: "gone",
+	413: "quota_exceeded",
+	415: "unsupported_media_type",
+	500: "internal_error",
+	503: "unavailable",
+}
+
+// Problem is an RFC 7807 problem details object
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
+}
+
+// code returns the stable error code of the HTTPError
+func (e *HTTPError) code() string {
+	if e.Error != nil {
+		for _, c := range errorCodes {
+			if errors.Is(e.Error, c.err) {
+				return c.code
+			}
+		}
+	}
+	if c, ok := statusCodes[e.Code]; ok {
+		return c
+	}
+	if e.Code >= 500 {
+		return "internal_error"
+	}
+	return "error"
+}
+
+// writeProblem sends e as application/problem+json. The internal error only goes to the log.
+func writeProblem(w http.ResponseWriter, r *http.Request, e *HTTPError) {
+	id := requestID(w, r)
+	p := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(e.Code),
+		Status:    e.Code,
+		Detail:    e.Message,
+		Code:      e.code(),
+		RequestID: id,
+	}
+	// validation errors explain themselves and don't leak anything
+	if errors.Is(e.Error, m.ErrPolicyViolation) || errors.Is(e.Error, m.ErrInvalidPatch) || errors.Is(e.Error, m.ErrInvalidWebhook) ||
+		errors.Is(e.Error, m.ErrInvalidEmail) || errors.Is(e.Error, m.ErrInvalidUploadRequest) {
+		p.Detail = e.Error.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Code)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// logError logs the error of a handler, server errors at LevelError and client errors at LevelInfo
+func logError(r *http.Request, e *HTTPError) {
+	log := logging.FromContext(r.Context())
+	kv := []interface{}{"method", r.Method, "path", r.URL.Path, "status", e.Code, "code", e.code(), "error", e.Error}
+	if e.Code >= 500 {
+		log.Error(e.Message, kv...)
+	} else {
+		log.Info(e.Message, kv...)
+	}
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID returns the id logRequests gave the request, or the X-Request-ID of the request (or generates one) and
+// sets it on the response
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	if id := logging.RequestID(r.Context()); id != "" {
+		return id
+	}
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID.MatchString(id) {
+		id = uuid.New().String()
+	}
+	w.Header().Set("X-Request-ID", id)
+	return id
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	m "github.com/chiefsend/api/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v4"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPErrorCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      *HTTPError
+		expected string
+	}{
+		{"sentinel", &HTTPError{ErrShareExpired, "Share is expired", 410}, "share_expired"},
+		{"wrapped sentinel", &HTTPError{fmt.Errorf("upload: %w", ErrQuotaExceeded), "Too big", 413}, "quota_exceeded"},
+		{"policy", &HTTPError{fmt.Errorf("%w: too long", m.ErrPolicyViolation), "Share violates server policy", 400}, "policy_violation"},
+		{"fallback to status", &HTTPError{errors.New("UNIQUE constraint failed"), "Can't create data", 500}, "internal_error"},
+		{"no error", &HTTPError{nil, "Authentication Failed", 401}, "unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.err.code())
+		})
+	}
+}
+
+func TestWriteProblem(t *testing.T) {
+	t.Run("hides internal error", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/share/123", nil)
+		req.Header.Set("X-Request-ID", "abc-123")
+		rec := httptest.NewRecorder()
+		writeProblem(rec, req, &HTTPError{errors.New("SQL logic error: no such table: shares"), "Can't fetch data", 500})
+		// parse
+		var actual Problem
+		err := json.Unmarshal(rec.Body.Bytes(), &actual)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "abc-123", rec.Header().Get("X-Request-ID"))
+		assert.Equal(t, Problem{
+			Type:      "about:blank",
+			Title:     "Internal Server Error",
+			Status:    500,
+			Detail:    "Can't fetch data",
+			Code:      "internal_error",
+			RequestID: "abc-123",
+		}, actual)
+		assert.NotContains(t, rec.Body.String(), "SQL")
+	})
+
+	t.Run("generates request id", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/share/123", nil)
+		req.Header.Set("X-Request-ID", "not valid\n")
+		rec := httptest.NewRecorder()
+		writeProblem(rec, req, &HTTPError{nil, "record not found", 404})
+		// assertions
+		_, err := uuid.Parse(rec.Header().Get("X-Request-ID"))
+		assert.Nil(t, err)
+	})
+}
+
+func TestProblemResponses(t *testing.T) {
+	shares := []m.Share{
+		{
+			ID:       uuid.MustParse("3c1a6e0b-7d7f-4f5e-9a55-0b2b5f1f6c01"),
+			IsPublic: true,
+			Expires:  null.TimeFrom(time.Now().Add(-time.Hour)),
+		},
+		{
+			ID:            uuid.MustParse("3c1a6e0b-7d7f-4f5e-9a55-0b2b5f1f6c02"),
+			IsPublic:      true,
+			DownloadLimit: null.IntFrom(0),
+		},
+		{
+			ID:       uuid.MustParse("3c1a6e0b-7d7f-4f5e-9a55-0b2b5f1f6c03"),
+			Password: null.StringFrom("test123"),
+		},
+		{
+			ID:          uuid.MustParse("3c1a6e0b-7d7f-4f5e-9a55-0b2b5f1f6c04"),
+			IsTemporary: true,
+		},
+	}
+	for i := range shares {
+		db.Create(&shares[i])
+		defer db.Delete(&shares[i])
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		code   string
+	}{
+		{"expired", fmt.Sprintf("/share/%s", shares[0].ID), 410, "share_expired"},
+		{"download limit", fmt.Sprintf("/share/%s/zip", shares[1].ID), 410, "download_limit_reached"},
+		{"password", fmt.Sprintf("/share/%s", shares[2].ID), 401, "password_required"},
+		{"not finalized", fmt.Sprintf("/share/%s", shares[3].ID), 403, "share_not_finalized"},
+		{"not found", fmt.Sprintf("/share/%s", uuid.New()), 404, "not_found"},
+		{"bad request", "/share/kekw", 400, "bad_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, _ := http.Get(url + tt.path)
+			// parse
+			body, _ := ioutil.ReadAll(res.Body)
+			var actual Problem
+			_ = json.Unmarshal(body, &actual)
+			// assertions
+			assert.Equal(t, tt.status, res.StatusCode)
+			assert.Equal(t, tt.status, actual.Status)
+			assert.Equal(t, tt.code, actual.Code)
+			assert.NotEmpty(t, actual.RequestID)
+		})
+	}
+}
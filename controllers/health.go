@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/chiefsend/api/background"
+	"github.com/chiefsend/api/logging"
+	m "github.com/chiefsend/api/models"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds each readiness check, a hanging dependency counts as down
+const checkTimeout = 3 * time.Second
+
+// readinessChecks return details for admins, or an error if the process isn't ready
+var readinessChecks = map[string]func(ctx context.Context) (interface{}, error){
+	"database":  checkDatabase,
+	"redis":     checkRedis,
+	"workers":   checkWorkers,
+	"media_dir": checkMediaDir,
+	"disk":      checkDisk,
+}
+
+// checkResult is the outcome of one readiness check
+type checkResult struct {
+	OK       bool        `json:"ok"`
+	Duration string      `json:"duration"`
+	Error    string      `json:"error,omitempty"`
+	Details  interface{} `json:"details,omitempty"`
+}
+
+// NewHealthServer returns a server with only /healthz and /readyz, for processes without the api
+func NewHealthServer() *http.Server {
+	router := mux.NewRouter()
+	configureHealthRoutes(router)
+	configureMetricsRoutes(router)
+	router.Use(instrument)
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", conf.Health.Port),
+		Handler: logRequests(router),
+	}
+}
+
+func configureHealthRoutes(router *mux.Router) {
+	router.Handle("/healthz", EndpointREST(Healthz)).Methods("GET", "HEAD")
+	router.Handle("/readyz", EndpointREST(Readyz)).Methods("GET", "HEAD")
+}
+
+// Healthz answers as long as the process serves requests (liveness)
+func Healthz(w http.ResponseWriter, r *http.Request) *HTTPError {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+	return nil
+}
+
+// Readyz answers 200 if the process can do its work and 503 if not. Admins get the results of the checks as JSON.
+func Readyz(w http.ResponseWriter, r *http.Request) *HTTPError {
+	results, ready := runChecks(r.Context())
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	// admins see the details
+	if admin, err := CheckBearerAuth(r); err == nil && admin {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(struct {
+			Ready  bool                   `json:"ready"`
+			Checks map[string]checkResult `json:"checks"`
+		}{ready, results})
+		return nil
+	}
+	// probes only need the status
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if ready {
+		_, _ = w.Write([]byte("ok\n"))
+	} else {
+		_, _ = w.Write([]byte("not ready\n"))
+	}
+	return nil
+}
+
+// runChecks runs all readiness checks at once
+func runChecks(ctx context.Context) (map[string]checkResult, bool) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]checkResult, len(readinessChecks))
+	ready := true
+	for name, check := range readinessChecks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) (interface{}, error)) {
+			defer wg.Done()
+			start := time.Now()
+			details, err := runCheck(ctx, check)
+			res := checkResult{OK: err == nil, Duration: time.Since(start).String(), Details: details}
+			if err != nil {
+				res.Error = err.Error()
+				logging.FromContext(ctx).Warn("not ready", "check", name, "error", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			results[name] = res
+			ready = ready && res.OK
+		}(name, check)
+	}
+	wg.Wait()
+	return results, ready
+}
+
+// runCheck gives up on checks which don't return when ctx is done
+func runCheck(ctx context.Context, check func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	type result struct {
+		details interface{}
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		details, err := check(ctx)
+		done <- result{details, err}
+	}()
+	select {
+	case res := <-done:
+		return res.details, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func checkDatabase(ctx context.Context) (interface{}, error) {
+	db, err := m.GetDatabaseContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return nil, err
+	}
+	return sqlDB.Stats(), nil
+}
+
+func checkRedis(ctx context.Context) (interface{}, error) {
+	return nil, background.Ping()
+}
+
+// checkWorkers needs the queue to be inspectable, and the workers of this process to be registered if it runs some
+func checkWorkers(ctx context.Context) (interface{}, error) {
+	servers, err := background.Workers()
+	if err != nil {
+		return nil, err
+	}
+	details := map[string]int{"processes": len(servers)}
+	if !background.Running() {
+		return details, nil
+	}
+	host, _ := os.Hostname()
+	for _, s := range servers {
+		if s.Host == host && s.PID == os.Getpid() {
+			return details, nil
+		}
+	}
+	return details, errors.New("background workers of this process aren't running")
+}
+
+// checkMediaDir writes a file to each directory the files are stored in
+func checkMediaDir(ctx context.Context) (interface{}, error) {
+	for _, dir := range []string{"data", "temp"} {
+		f, err := ioutil.TempFile(filepath.Join(m.MediaDir(), dir), ".readyz-")
+		if err != nil {
+			return nil, err
+		}
+		_ = f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func checkDisk(ctx context.Context) (interface{}, error) {
+	free, err := m.FreeSpace()
+	if errors.Is(err, m.ErrFreeSpaceUnsupported) {
+		return "unsupported", nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	details := map[string]uint64{"free": free, "min_free": uint64(conf.Health.MinFreeSpace)}
+	if free < uint64(conf.Health.MinFreeSpace) {
+		return details, fmt.Errorf("only %d bytes free in %s, %d required", free, m.MediaDir(), conf.Health.MinFreeSpace)
+	}
+	return details, nil
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/chiefsend/api/config"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	res, err := http.Get(url + "/healthz")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "ok\n", string(body))
+}
+
+func TestReadyz(t *testing.T) {
+	readyz := func(t *testing.T, admin bool) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", url+"/readyz", nil)
+		if admin {
+			req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(os.Getenv("ADMIN_KEY"))))
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, body
+	}
+	type report struct {
+		Ready  bool
+		Checks map[string]checkResult
+	}
+
+	t.Run("probe", func(t *testing.T) {
+		res, body := readyz(t, false)
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "ok\n", string(body))
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		res, body := readyz(t, true)
+		assert.Equal(t, 200, res.StatusCode)
+		var rep report
+		assert.Nil(t, json.Unmarshal(body, &rep))
+		assert.True(t, rep.Ready)
+		for name := range readinessChecks {
+			assert.True(t, rep.Checks[name].OK, name)
+		}
+	})
+
+	t.Run("disk full", func(t *testing.T) {
+		withConfig(t, func(c *config.Config) { c.Health.MinFreeSpace = 1 << 62 })
+		res, body := readyz(t, false)
+		assert.Equal(t, 503, res.StatusCode)
+		assert.Equal(t, "not ready\n", string(body)) // no details for probes
+		// details for admins
+		res, body = readyz(t, true)
+		assert.Equal(t, 503, res.StatusCode)
+		var rep report
+		assert.Nil(t, json.Unmarshal(body, &rep))
+		assert.False(t, rep.Ready)
+		assert.False(t, rep.Checks["disk"].OK)
+		assert.Contains(t, rep.Checks["disk"].Error, "bytes free")
+		assert.True(t, rep.Checks["database"].OK)
+	})
+
+	t.Run("media dir missing", func(t *testing.T) {
+		withConfig(t, func(c *config.Config) { c.MediaDir = t.TempDir() }) // without data and temp
+		res, body := readyz(t, true)
+		assert.Equal(t, 503, res.StatusCode)
+		var rep report
+		assert.Nil(t, json.Unmarshal(body, &rep))
+		assert.False(t, rep.Checks["media_dir"].OK)
+	})
+}
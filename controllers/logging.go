@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"github.com/chiefsend/api/logging"
+	"net/http"
+	"time"
+)
+
+// logRequests gives each request an id and a logger carrying it, and logs the request once it is answered
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(w, r)
+		r = r.WithContext(logging.WithRequestID(r.Context(), id))
+		log := logging.FromContext(r.Context())
+		if log.Enabled(logging.LevelDebug) {
+			log.Debug("request", "method", r.Method, "path", r.URL.Path, "query", r.URL.RawQuery, "header", r.Header)
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		log.Info("request done", "method", r.Method, "path", r.URL.Path, "status", rec.status, "bytes", rec.size,
+			"duration", time.Since(start), "remote", r.RemoteAddr, "user_agent", r.UserAgent())
+	})
+}
@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/chiefsend/api/logging"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogRequests(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := logging.New(&buf, logging.FormatJSON, logging.LevelDebug)
+	old := logging.Default()
+	logging.SetDefault(logger)
+	defer logging.SetDefault(old)
+
+	handler := logRequests(EndpointREST(func(w http.ResponseWriter, r *http.Request) *HTTPError {
+		return &HTTPError{errors.New("disk on fire"), "Can't save file", 500}
+	}))
+	req := httptest.NewRequest("POST", "/share/123/attachments", nil)
+	req.Header.Set("X-Request-ID", "req-42")
+	req.SetBasicAuth("user", "hunter2")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	// parse
+	lines := map[string]map[string]interface{}{}
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(l), &line))
+		lines[line["msg"].(string)] = line
+	}
+	// assertions
+	assert.Equal(t, "req-42", rec.Header().Get("X-Request-ID"))
+	if assert.Contains(t, lines, "Can't save file") {
+		assert.Equal(t, "error", lines["Can't save file"]["level"])
+		assert.Equal(t, "req-42", lines["Can't save file"]["request_id"])
+		assert.Equal(t, "disk on fire", lines["Can't save file"]["error"])
+	}
+	if assert.Contains(t, lines, "request done") {
+		assert.Equal(t, "req-42", lines["request done"]["request_id"])
+		assert.Equal(t, float64(500), lines["request done"]["status"])
+	}
+	assert.Contains(t, lines, "request") // headers at debug level
+	assert.NotContains(t, buf.String(), "dXNlcjpodW50ZXIy") // user:hunter2
+}
@@ -3,15 +3,20 @@ package controllers
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/chiefsend/api/config"
 	"github.com/chiefsend/api/models"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
-	"log"
 	"net/http"
-	"os"
 )
 
+var conf config.Config
+
+// Configure sets port, admin key and caching of the api
+func Configure(c config.Config) {
+	conf = c
+}
+
 // ConfigureRoutes sets up the mux router
 func configureRoutes(router *mux.Router) {
 	router.Handle("/shares", EndpointREST(AllShares)).Methods("GET")
@@ -20,7 +25,7 @@ func configureRoutes(router *mux.Router) {
 	router.Handle("/share/{id}", EndpointREST(GetShare)).Methods("GET")
 	router.Handle("/share/{id}", EndpointREST(CloseShare)).Methods("POST")
 	router.Handle("/share/{id}", EndpointREST(DeleteShare)).Methods("DELETE")
-	router.Handle("/share/{id}", EndpointREST(UpdateShare)).Methods("PUT")
+	router.Handle("/share/{id}", EndpointREST(UpdateShare)).Methods("PATCH", "PUT")
 
 	router.Handle("/share/{id}/attachments", EndpointREST(UploadAttachment)).Methods("POST")
 
@@ -32,22 +37,50 @@ func configureRoutes(router *mux.Router) {
 	router.Handle("/shares/stats", EndpointREST(Stats)).Methods("GET")
 	router.Handle("/share/{id}/stats", EndpointREST(ShareStats)).Methods("GET")
 	router.Handle("/jobs", EndpointREST(Jobs)).Methods("GET")
+	router.Handle("/jobs/queues", EndpointREST(QueueStats)).Methods("GET")
+	router.Handle("/jobs/tasks", EndpointREST(Tasks)).Methods("GET")
+	router.Handle("/jobs/tasks/{key}", EndpointREST(CancelTask)).Methods("DELETE")
+	router.Handle("/jobs/tasks/{key}/run", EndpointREST(RunTask)).Methods("POST")
+	router.Handle("/share/{id}/deletion", EndpointREST(GetShareDeletion)).Methods("GET")
+	router.Handle("/share/{id}/deletion", EndpointREST(CancelShareDeletion)).Methods("DELETE")
+	router.Handle("/share/{id}/deletion", EndpointREST(RescheduleShareDeletion)).Methods("PUT")
+	router.Handle("/config", EndpointREST(GetConfig)).Methods("GET")
+
+	router.Handle("/uploadrequests", EndpointREST(AllUploadRequests)).Methods("GET")
+	router.Handle("/uploadrequests", EndpointREST(CreateUploadRequest)).Methods("POST")
+	router.Handle("/uploadrequest", EndpointREST(CurrentUploadRequest)).Methods("GET")
+	router.Handle("/uploadrequest/{id}", EndpointREST(DeleteUploadRequest)).Methods("DELETE")
+
+	router.Handle("/webhooks", EndpointREST(AllWebhooks)).Methods("GET")
+	router.Handle("/webhooks", EndpointREST(CreateWebhook)).Methods("POST")
+	router.Handle("/webhook/{id}", EndpointREST(DeleteWebhook)).Methods("DELETE")
+	router.Handle("/webhook/{id}/deliveries", EndpointREST(WebhookDeliveries)).Methods("GET")
+	router.Handle("/fsck", EndpointREST(Fsck)).Methods("GET", "POST")
+	router.Handle("/audit", EndpointREST(AuditLog)).Methods("GET")
+
+	configureHealthRoutes(router)
+	configureMetricsRoutes(router)
+	router.Use(instrument)
 }
 
-func StartServer() {
+// NewServer returns the api server listening to the configured port, run it with ListenAndServe
+func NewServer() *http.Server {
 	router := mux.NewRouter()
 	handler := cors.New(cors.Options{
 		AllowedOrigins:     []string{"*"}, // FIXME
-		AllowedMethods:     []string{"GET", "POST", "DELETE", "PUT", "OPTIONS"},
-		AllowedHeaders:     []string{"Content-Disposition", "*"}, // FIXME
-		ExposedHeaders:     []string{"Content-Disposition", "*"}, // FIXME
-		MaxAge:             0,                                    // no max age
+		AllowedMethods:     []string{"GET", "POST", "DELETE", "PUT", "PATCH", "OPTIONS"},
+		AllowedHeaders:     []string{"Content-Disposition", "X-Upload-Token", "X-Management-Token", "*"}, // FIXME
+		ExposedHeaders:     []string{"Content-Disposition", "*"},                                         // FIXME
+		MaxAge:             0,                                                                            // no max age
 		AllowCredentials:   true,
 		OptionsPassthrough: false,
 	}).Handler(router)
 
 	configureRoutes(router)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), handlers.LoggingHandler(os.Stdout, handler)))
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", conf.Port),
+		Handler: logRequests(handler),
+	}
 }
 
 func sendJSON(w http.ResponseWriter, res interface{}) *HTTPError {
@@ -61,6 +94,11 @@ func sendJSON(w http.ResponseWriter, res interface{}) *HTTPError {
 			v[i].Secure()
 		}
 		res = v
+	case []models.Webhook:
+		for i := range v {
+			v[i].Secure()
+		}
+		res = v
 	}
 	// Send it
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"github.com/chiefsend/api/background"
+	"github.com/chiefsend/api/metrics"
+	m "github.com/chiefsend/api/models"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	metrics.Registry.MustRegister(stateCollector{})
+}
+
+// NewMetricsServer returns a server with only /metrics, listening to the metrics address
+func NewMetricsServer() *http.Server {
+	router := mux.NewRouter()
+	router.Handle("/metrics", metricsHandler(false)).Methods("GET")
+	return &http.Server{
+		Addr:    conf.Metrics.Address,
+		Handler: logRequests(router),
+	}
+}
+
+// configureMetricsRoutes serves /metrics next to other routes
+func configureMetricsRoutes(router *mux.Router) {
+	router.Handle("/metrics", metricsHandler(true)).Methods("GET")
+}
+
+// metricsHandler checks the token (if any) and serves the metrics. Next to other routes, it needs a token and the
+// metrics must not have an address of their own.
+func metricsHandler(shared bool) http.Handler {
+	next := metrics.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shared && (conf.Metrics.Token == "" || conf.Metrics.Address != "") {
+			writeProblem(w, r, &HTTPError{nil, "Not Found", 404})
+			return
+		}
+		if conf.Metrics.Token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(conf.Metrics.Token)) != 1 {
+				writeProblem(w, r, &HTTPError{nil, "Authentication Failed", 401})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// instrument counts the requests and their duration by the template of the route, so ids don't add labels
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeTemplate returns the path template of the route of the request, e.g. /share/{id}
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// statusRecorder remembers the status code and the size of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	size        int64
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = code, true
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps sendfile of the underlying writer for http.ServeFile
+func (rec *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	rec.wroteHeader = true
+	n, err := io.Copy(rec.ResponseWriter, r)
+	rec.size += n
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingWriter counts the bytes of the response body
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(cw.ResponseWriter, r)
+	cw.n += n
+	return n, err
+}
+
+var (
+	sharesDesc = prometheus.NewDesc("chiefsend_shares", "Shares by state (temporary or finalized).",
+		[]string{"state"}, nil)
+	storedBytesDesc = prometheus.NewDesc("chiefsend_stored_bytes", "Bytes of the attachments by state of their share.",
+		[]string{"state"}, nil)
+	queueDesc = prometheus.NewDesc("chiefsend_task_queue_tasks", "Background tasks by queue and state.",
+		[]string{"queue", "state"}, nil)
+)
+
+// stateCollector reads the shares, the storage and the task queues when the metrics are scraped
+type stateCollector struct{}
+
+func (stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sharesDesc
+	ch <- storedBytesDesc
+	ch <- queueDesc
+}
+
+func (stateCollector) Collect(ch chan<- prometheus.Metric) {
+	// shares and storage
+	rows, err := shareStates()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(sharesDesc, err)
+		ch <- prometheus.NewInvalidMetric(storedBytesDesc, err)
+	}
+	for _, row := range rows {
+		state := "finalized"
+		if row.IsTemporary {
+			state = "temporary"
+		}
+		ch <- prometheus.MustNewConstMetric(sharesDesc, prometheus.GaugeValue, float64(row.Shares), state)
+		ch <- prometheus.MustNewConstMetric(storedBytesDesc, prometheus.GaugeValue, float64(row.Bytes), state)
+	}
+	// queues
+	queues, err := background.GetQueueStats()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(queueDesc, err)
+		return
+	}
+	for _, q := range queues {
+		for state, n := range map[string]int{background.StatePending: q.Pending, background.StateActive: q.Active,
+			background.StateScheduled: q.Scheduled, background.StateRetry: q.Retry, background.StateDead: q.Archived} {
+			ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(n), q.Queue, state)
+		}
+	}
+}
+
+type shareState struct {
+	IsTemporary bool
+	Shares      int64
+	Bytes       int64
+}
+
+// shareStates returns the number of shares and the size of their attachments, temporary and finalized
+func shareStates() ([]shareState, error) {
+	db, err := m.GetDatabase()
+	if err != nil {
+		return nil, err
+	}
+	var shares []shareState
+	err = db.Model(&m.Share{}).Select("is_temporary, COUNT(*) AS shares").Group("is_temporary").Scan(&shares).Error
+	if err != nil {
+		return nil, err
+	}
+	var sizes []shareState
+	err = db.Model(&m.Attachment{}).Select("shares.is_temporary, SUM(attachments.filesize) AS bytes").
+		Joins("JOIN shares ON shares.id = attachments.share_id").Group("shares.is_temporary").Scan(&sizes).Error
+	if err != nil {
+		return nil, err
+	}
+	// both states, even without shares
+	res := []shareState{{IsTemporary: true}, {IsTemporary: false}}
+	for i := range res {
+		for _, s := range shares {
+			if s.IsTemporary == res[i].IsTemporary {
+				res[i].Shares = s.Shares
+			}
+		}
+		for _, s := range sizes {
+			if s.IsTemporary == res[i].IsTemporary {
+				res[i].Bytes = s.Bytes
+			}
+		}
+	}
+	return res, nil
+}
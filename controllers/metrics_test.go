@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"github.com/chiefsend/api/config"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	scrape := func(t *testing.T, token string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", url+"/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		res, _ := scrape(t, "")
+		assert.Equal(t, 404, res.StatusCode)
+	})
+
+	t.Run("own address", func(t *testing.T) {
+		withConfig(t, func(c *config.Config) { c.Metrics.Token, c.Metrics.Address = "secret", "localhost:9100" })
+		res, _ := scrape(t, "secret")
+		assert.Equal(t, 404, res.StatusCode)
+	})
+
+	t.Run("wrong token", func(t *testing.T) {
+		withConfig(t, func(c *config.Config) { c.Metrics.Token = "secret" })
+		res, _ := scrape(t, "guess")
+		assert.Equal(t, 401, res.StatusCode)
+	})
+
+	t.Run("scrape", func(t *testing.T) {
+		withConfig(t, func(c *config.Config) { c.Metrics.Token = "secret" })
+		_, err := http.Get(url + "/share/0e0e0e0e-0e0e-0e0e-0e0e-0e0e0e0e0e0e")
+		assert.Nil(t, err)
+		res, body := scrape(t, "secret")
+		assert.Equal(t, 200, res.StatusCode)
+		// the template, not the id
+		assert.Contains(t, body, `chiefsend_http_requests_total{code="404",method="GET",route="/share/{id}"}`)
+		assert.NotContains(t, body, "0e0e0e0e")
+		assert.Contains(t, body, `chiefsend_shares{state="finalized"}`)
+		assert.Contains(t, body, `chiefsend_stored_bytes{state="temporary"}`)
+		assert.Contains(t, body, "chiefsend_task_queue_tasks{")
+		assert.Contains(t, body, "go_goroutines")
+	})
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/chiefsend/api/logging"
+	"github.com/chiefsend/api/tracing"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"net/http"
+	"time"
+)
+
+// startSpan starts the server span of the request, as child of the span of the caller if it sent a traceparent
+func startSpan(r *http.Request) (*http.Request, trace.Span) {
+	route := routeTemplate(r)
+	ctx := tracing.ExtractHeader(r.Context(), r.Header)
+	ctx, span := tracing.StartKind(ctx, r.Method+" "+route, trace.SpanKindServer,
+		semconv.HTTPRequestMethodKey.String(r.Method), semconv.HTTPRoute(route))
+	if id := tracing.TraceID(ctx); id != "" {
+		ctx = logging.NewContext(ctx, logging.FromContext(ctx).With("trace_id", id))
+	}
+	return r.WithContext(ctx), span
+}
+
+// endSpan ends the server span, errors of the server mark it as failed (the ones of the client don't)
+func endSpan(span trace.Span, e *HTTPError) {
+	if e != nil {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(e.Code))
+		if e.Code >= 500 {
+			err := e.Error
+			if err == nil {
+				err = errors.New(e.Message)
+			}
+			tracing.Fail(span, err)
+		}
+	}
+	span.End()
+}
+
+// timedReader sums up the time spent reading, e.g. from the disk
+type timedReader struct {
+	io.Reader
+	d time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.Reader.Read(p)
+	t.d += time.Since(start)
+	return n, err
+}
+
+// timedWriter sums up the time spent writing, e.g. to the client
+type timedWriter struct {
+	io.Writer
+	d time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.Writer.Write(p)
+	t.d += time.Since(start)
+	return n, err
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"fmt"
+	m "github.com/chiefsend/api/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	sh := m.Share{ID: uuid.MustParse("6e2b9d4a-5c1f-4a7e-8b3d-0f9c2e4a6b01"), IsPublic: true}
+	att := m.Attachment{ID: uuid.MustParse("6e2b9d4a-5c1f-4a7e-8b3d-0f9c2e4a6b02"), ShareID: sh.ID, Filename: "notes.txt", Filesize: 5}
+	db.Create(&sh)
+	db.Create(&att)
+	defer db.Delete(&sh)
+	defer db.Delete(&att)
+	dir := filepath.Join(m.MediaDir(), "data", sh.ID.String())
+	_ = os.MkdirAll(dir, os.ModePerm)
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, att.ID.String()), []byte("hello"), 0600)
+	// spans by name, of the last request
+	get := func(t *testing.T, path string) map[string]sdktrace.ReadOnlySpan {
+		before := len(rec.Ended())
+		req, _ := http.NewRequest("GET", url+path, nil)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = ioutil.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range rec.Ended()[before:] {
+			spans[span.Name()] = span
+		}
+		return spans
+	}
+
+	t.Run("request and queries", func(t *testing.T) {
+		spans := get(t, "/share/"+sh.ID.String())
+		if assert.Contains(t, spans, "GET /share/{id}") && assert.Contains(t, spans, "select shares") {
+			server, query := spans["GET /share/{id}"], spans["select shares"]
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+			assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+			assert.Equal(t, server.SpanContext().SpanID(), query.Parent().SpanID())
+			assert.Contains(t, query.Attributes(), attribute.String("db.system.name", "sqlite"))
+		}
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		spans := get(t, fmt.Sprintf("/share/%s/zip", sh.ID))
+		if assert.Contains(t, spans, "GET /share/{id}/zip") && assert.Contains(t, spans, "zip file") {
+			server, file := spans["GET /share/{id}/zip"], spans["zip file"]
+			assert.Equal(t, server.SpanContext().SpanID(), file.Parent().SpanID())
+			keys := map[attribute.Key]bool{}
+			for _, kv := range file.Attributes() {
+				keys[kv.Key] = true
+			}
+			assert.True(t, keys["disk.read.seconds"])
+			assert.True(t, keys["network.write.seconds"])
+			assert.Contains(t, file.Attributes(), attribute.Int64("file.size", 5))
+		}
+	})
+}
@@ -0,0 +1,135 @@
+// Package lifecycle starts the services of the process and stops them in reverse order on SIGINT/SIGTERM, giving the
+// work in flight a deadline to finish.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/chiefsend/api/logging"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Service is a part of the process that has to be stopped cleanly, e.g. the api server or the background workers
+type Service struct {
+	Name  string
+	Start func() error                    // returns once the service runs (optional)
+	Stop  func(ctx context.Context) error // returns once the service stopped, gives up when ctx is done (optional)
+}
+
+// Manager runs the services of the process
+type Manager struct {
+	timeout  time.Duration
+	services []Service
+	failed   chan error
+}
+
+// New returns a manager giving the services timeout to stop
+func New(timeout time.Duration) *Manager {
+	return &Manager{timeout: timeout, failed: make(chan error, 1)}
+}
+
+// Add appends a service. The services start in the order they were added and stop in reverse.
+func (m *Manager) Add(s Service) {
+	m.services = append(m.services, s)
+}
+
+// AddServer adds an http server. It stops accepting connections first, then waits for the requests in flight.
+func (m *Manager) AddServer(name string, srv *http.Server) {
+	m.Add(Service{
+		Name: name,
+		Start: func() error {
+			// listen right away, so a port in use fails the start
+			l, err := net.Listen("tcp", srv.Addr)
+			if err != nil {
+				return err
+			}
+			go func() {
+				if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+					m.Fail(fmt.Errorf("%s: %w", name, err))
+				}
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			if err := srv.Shutdown(ctx); err != nil {
+				_ = srv.Close() // cut off the transfers that didn't make it
+				return err
+			}
+			return nil
+		},
+	})
+}
+
+// Fail shuts down the process with exit status 1, for services that fail after they started
+func (m *Manager) Fail(err error) {
+	select {
+	case m.failed <- err:
+	default: // shutting down already
+	}
+}
+
+// Run starts the services and blocks until SIGINT, SIGTERM or a failure, then stops them. A second signal stops
+// waiting for the work in flight. Returns the exit status of the process.
+func (m *Manager) Run() int {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	return m.run(signals)
+}
+
+func (m *Manager) run(signals <-chan os.Signal) int {
+	status := 0
+	// start
+	started := 0
+	for _, s := range m.services {
+		if s.Start != nil {
+			logging.Info("starting", "service", s.Name)
+			if err := s.Start(); err != nil {
+				logging.Error("cannot start", "service", s.Name, "error", err)
+				status = 1
+				break
+			}
+		}
+		started++
+	}
+	// wait
+	if status == 0 {
+		select {
+		case sig := <-signals:
+			logging.Info("shutting down", "signal", sig)
+		case err := <-m.failed:
+			logging.Error("shutting down", "error", err)
+			status = 1
+		}
+	}
+	// stop
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			logging.Warn("received second signal, not waiting any longer")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for i := started - 1; i >= 0; i-- {
+		s := m.services[i]
+		if s.Stop == nil {
+			continue
+		}
+		if err := s.Stop(ctx); err != nil {
+			logging.Error("cannot stop", "service", s.Name, "error", err)
+			status = 1
+			continue
+		}
+		logging.Info("stopped", "service", s.Name)
+	}
+	return status
+}
@@ -0,0 +1,157 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// record returns a service appending its start and stop to events
+func record(name string, events *[]string) Service {
+	return Service{
+		Name:  name,
+		Start: func() error { *events = append(*events, "start "+name); return nil },
+		Stop:  func(context.Context) error { *events = append(*events, "stop "+name); return nil },
+	}
+}
+
+// freeAddr returns a local address nothing listens to
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	t.Run("stops in reverse order", func(t *testing.T) {
+		var events []string
+		lc := New(time.Second)
+		lc.Add(record("database", &events))
+		lc.Add(record("workers", &events))
+		lc.Add(record("server", &events))
+		signals := make(chan os.Signal, 1)
+		signals <- syscall.SIGTERM
+		// assertions
+		assert.Equal(t, 0, lc.run(signals))
+		assert.Equal(t, []string{"start database", "start workers", "start server", "stop server", "stop workers", "stop database"}, events)
+	})
+
+	t.Run("start fails", func(t *testing.T) {
+		var events []string
+		lc := New(time.Second)
+		lc.Add(record("database", &events))
+		lc.Add(Service{Name: "workers", Start: func() error { return errors.New("no redis") }})
+		lc.Add(record("server", &events))
+		// assertions
+		assert.Equal(t, 1, lc.run(nil))
+		assert.Equal(t, []string{"start database", "stop database"}, events)
+	})
+
+	t.Run("fails after start", func(t *testing.T) {
+		var events []string
+		lc := New(time.Second)
+		lc.Add(record("server", &events))
+		lc.Fail(errors.New("broken"))
+		lc.Fail(errors.New("broken again")) // doesn't block
+		// assertions
+		assert.Equal(t, 1, lc.run(nil))
+		assert.Equal(t, []string{"start server", "stop server"}, events)
+	})
+
+	t.Run("second signal", func(t *testing.T) {
+		lc := New(time.Minute)
+		lc.Add(Service{Name: "stuck", Stop: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}})
+		signals := make(chan os.Signal, 2)
+		signals <- syscall.SIGINT
+		signals <- syscall.SIGINT
+		start := time.Now()
+		// assertions
+		assert.Equal(t, 1, lc.run(signals))
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	})
+}
+
+func TestAddServer(t *testing.T) {
+	// handler answers after the shutdown started
+	inFlight := make(chan struct{})
+	server := func(delay time.Duration) *http.Server {
+		return &http.Server{Addr: freeAddr(t), Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inFlight <- struct{}{}
+			time.Sleep(delay)
+			_, _ = w.Write([]byte("done"))
+		})}
+	}
+
+	t.Run("drains requests in flight", func(t *testing.T) {
+		srv := server(200 * time.Millisecond)
+		lc := New(time.Second)
+		lc.AddServer("server", srv)
+		signals := make(chan os.Signal, 1)
+		status := make(chan int)
+		go func() { status <- lc.run(signals) }()
+		time.Sleep(50 * time.Millisecond) // listening
+		body := make(chan string)
+		go func() {
+			res, err := http.Get("http://" + srv.Addr)
+			if err != nil {
+				body <- err.Error()
+				return
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			body <- string(b)
+		}()
+		<-inFlight
+		signals <- syscall.SIGTERM
+		// assertions
+		assert.Equal(t, "done", <-body)
+		assert.Equal(t, 0, <-status)
+		_, err := http.Get("http://" + srv.Addr)
+		assert.NotNil(t, err) // not accepting anymore
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		srv := server(2 * time.Second)
+		lc := New(100 * time.Millisecond)
+		lc.AddServer("server", srv)
+		signals := make(chan os.Signal, 1)
+		status := make(chan int)
+		go func() { status <- lc.run(signals) }()
+		time.Sleep(50 * time.Millisecond)
+		failed := make(chan error)
+		go func() {
+			_, err := http.Get("http://" + srv.Addr)
+			failed <- err
+		}()
+		<-inFlight
+		signals <- syscall.SIGTERM
+		// assertions
+		assert.Equal(t, 1, <-status)
+		assert.NotNil(t, <-failed) // cut off
+	})
+
+	t.Run("port in use", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		lc := New(time.Second)
+		lc.AddServer("server", &http.Server{Addr: l.Addr().String()})
+		// assertions
+		assert.Equal(t, 1, lc.run(nil))
+	})
+}
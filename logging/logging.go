@@ -0,0 +1,281 @@
+// Package logging writes leveled, structured log lines as JSON or logfmt. Loggers carry fields (e.g. the request id)
+// and travel in contexts, values of sensitive keys like passwords and tokens are never written.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Formats supported by New
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Redacted replaces the values of sensitive keys
+const Redacted = "[REDACTED]"
+
+// sink is shared by a logger and all loggers derived from it
+type sink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	level  Level
+}
+
+// Logger writes lines with its fields and the ones given to each call
+type Logger struct {
+	sink   *sink
+	fields []interface{} // key, value, key, value, ...
+}
+
+// New returns a logger writing lines of at least level to out, format is FormatJSON or FormatLogfmt
+func New(out io.Writer, format string, level Level) (*Logger, error) {
+	if format != FormatJSON && format != FormatLogfmt {
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return &Logger{sink: &sink{out: out, format: format, level: level}}, nil
+}
+
+var std = &Logger{sink: &sink{out: os.Stderr, format: FormatLogfmt, level: LevelInfo}}
+
+// SetDefault replaces the logger used without a context and by the package functions
+func SetDefault(l *Logger) {
+	std = l
+}
+
+// Default returns the logger used without a context
+func Default() *Logger {
+	return std
+}
+
+// With returns a logger which adds the key value pairs to each line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// Enabled tells if lines of level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.sink.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	pairs = append(pairs, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	pairs = append(append(pairs, l.fields...), kv...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	if l.sink.format == FormatJSON {
+		writeJSON(&buf, pairs)
+	} else {
+		writeLogfmt(&buf, pairs)
+	}
+	buf.WriteByte('\n')
+	l.sink.mu.Lock()
+	defer l.sink.mu.Unlock()
+	_, _ = l.sink.out.Write(buf.Bytes())
+}
+
+// value returns what is written for the value of key
+func value(key string, v interface{}) interface{} {
+	if Sensitive(key) {
+		return Redacted
+	}
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case http.Header:
+		return RedactHeader(v)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSON(buf *bytes.Buffer, pairs []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(value(key, pairs[i+1]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(pairs[i+1]))
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
+
+func writeLogfmt(buf *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(strings.Map(func(r rune) rune {
+			if r <= ' ' || r == '=' || r == '"' {
+				return '_'
+			}
+			return r
+		}, key))
+		buf.WriteByte('=')
+		var s string
+		switch v := value(key, pairs[i+1]).(type) {
+		case string:
+			s = v
+		case nil:
+			s = "null"
+		default:
+			if b, err := json.Marshal(v); err == nil && !bytes.HasPrefix(b, []byte(`"`)) {
+				s = string(b)
+			} else {
+				s = fmt.Sprint(v)
+			}
+		}
+		if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, func(r rune) bool { return r < ' ' }) >= 0 {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+// Sensitive tells if the values of key must not be logged, e.g. password, admin_key, upload_token or Authorization
+func Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"password", "secret", "token", "authorization", "cookie", "admin_key"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactHeader returns a copy of h with the values of sensitive headers replaced
+func RedactHeader(h http.Header) http.Header {
+	res := make(http.Header, len(h))
+	for k, v := range h {
+		if Sensitive(k) {
+			v = []string{Redacted}
+		}
+		res[k] = v
+	}
+	return res
+}
+
+func Debug(msg string, kv ...interface{}) { std.log(LevelDebug, msg, kv) }
+func Info(msg string, kv ...interface{})  { std.log(LevelInfo, msg, kv) }
+func Warn(msg string, kv ...interface{})  { std.log(LevelWarn, msg, kv) }
+func Error(msg string, kv ...interface{}) { std.log(LevelError, msg, kv) }
+
+// Fatal logs at LevelError and exits with 1
+func Fatal(msg string, kv ...interface{}) {
+	std.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// Writer returns a writer logging each line at level, to route the standard library's log through the logger
+func (l *Logger) Writer(level Level) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			l.log(level, line, nil)
+		}
+		return len(p), nil
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewContext returns a context carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// FromContext returns the logger of ctx, or the default one
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return l
+	}
+	return std
+}
+
+// WithRequestID returns a context carrying the request id and a logger adding it to each line
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, id)
+	return NewContext(ctx, FromContext(ctx).With("request_id", id))
+}
+
+// RequestID returns the request id of ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
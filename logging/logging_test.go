@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		l, err := New(&buf, FormatJSON, LevelInfo)
+		assert.Nil(t, err)
+		l.With("share", "abc").Error("can't send", "error", errors.New("refused"), "took", time.Second)
+		var line map[string]interface{}
+		assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+		assert.Equal(t, "error", line["level"])
+		assert.Equal(t, "can't send", line["msg"])
+		assert.Equal(t, "abc", line["share"])
+		assert.Equal(t, "refused", line["error"])
+		assert.Equal(t, "1s", line["took"])
+	})
+
+	t.Run("logfmt", func(t *testing.T) {
+		var buf bytes.Buffer
+		l, _ := New(&buf, FormatLogfmt, LevelInfo)
+		l.Info("request done", "path", "/share/1", "status", 200, "user_agent", `curl "7.0"`)
+		line := buf.String()
+		assert.Contains(t, line, ` level=info msg="request done" path=/share/1 status=200 user_agent="curl \"7.0\""`)
+		assert.True(t, strings.HasSuffix(line, "\n"))
+	})
+
+	t.Run("level", func(t *testing.T) {
+		var buf bytes.Buffer
+		l, _ := New(&buf, FormatLogfmt, LevelWarn)
+		l.Info("hidden")
+		assert.Empty(t, buf.String())
+		l.Warn("shown")
+		assert.Contains(t, buf.String(), "msg=shown")
+	})
+
+	t.Run("redaction", func(t *testing.T) {
+		var buf bytes.Buffer
+		l, _ := New(&buf, FormatJSON, LevelDebug)
+		header := http.Header{"Authorization": {"Bearer key"}, "X-Upload-Token": {"token"}, "Accept": {"*/*"}}
+		l.Debug("request", "password", "hunter2", "admin_key", "key", "header", header)
+		assert.NotContains(t, buf.String(), "hunter2")
+		assert.NotContains(t, buf.String(), "Bearer key")
+		assert.NotContains(t, buf.String(), `"token"`)
+		assert.Contains(t, buf.String(), `"Accept":["*/*"]`)
+		assert.Equal(t, "Bearer key", header.Get("Authorization")) // not changed
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		_, err := New(&bytes.Buffer{}, "text", LevelInfo)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := New(&buf, FormatLogfmt, LevelInfo)
+	ctx := WithRequestID(NewContext(context.Background(), l), "req-1")
+	assert.Equal(t, "req-1", RequestID(ctx))
+	FromContext(ctx).Info("hello")
+	assert.Contains(t, buf.String(), "request_id=req-1")
+	// without
+	assert.Equal(t, "", RequestID(context.Background()))
+	assert.Equal(t, Default(), FromContext(context.Background()))
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelWarn, level)
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
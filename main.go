@@ -1,51 +1,217 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/chiefsend/api/background"
+	"github.com/chiefsend/api/config"
 	"github.com/chiefsend/api/controllers"
+	"github.com/chiefsend/api/lifecycle"
+	"github.com/chiefsend/api/logging"
 	m "github.com/chiefsend/api/models"
+	"github.com/chiefsend/api/tracing"
 	"github.com/joho/godotenv"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	// .env is optional, the environment may have everything set already
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logging.Fatal("cannot load .env", "error", err)
 	}
 
+	conf, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logging.Fatal("invalid configuration", "error", err)
+	}
+	setupLogging(conf.Log)
+	stopTracing, err := tracing.Setup(conf.Tracing.Endpoint, conf.Tracing.ServiceName, conf.Tracing.SampleRatio)
+	if err != nil {
+		logging.Fatal("cannot set up tracing", "error", err)
+	}
+	m.Configure(conf)
+	background.Configure(conf)
+	controllers.Configure(conf)
+	// wait for the database
+	ctx, cancel := context.WithTimeout(context.Background(), conf.Database.ConnectTimeout)
+	err = m.Connect(ctx)
+	cancel()
+	if err != nil {
+		logging.Fatal("cannot connect database", "error", err)
+	}
+	// migrations run before the schema check, everything else needs the current schema
+	if flag.Arg(0) == "migrate" {
+		migrate(flag.Args()[1:])
+		return
+	}
 	{
-		autoMigrate := flag.Bool("auto-migrate", false, "pass -auto-migrate=true if you want gorm to auto migrate the database")
-		flag.Parse()
-		if *autoMigrate {
-			// set/test database connection
-			db, err := m.GetDatabase()
-			if err != nil || db == nil {
-				log.Fatal("Cannot connect database")
+		db, err := m.GetDatabase()
+		if err != nil {
+			logging.Fatal("cannot connect database")
+		}
+		if err := m.CheckSchema(db); err != nil {
+			logging.Fatal("schema check failed", "error", err)
+		}
+	}
+	// check if file structure is there
+	for _, dir := range []string{"temp", "data", "staging"} {
+		if err := os.MkdirAll(filepath.Join(m.MediaDir(), dir), os.ModePerm); err != nil {
+			logging.Fatal("cannot create media directory", "error", err)
+		}
+	}
+	// subcommands
+	command := flag.Arg(0)
+	switch command {
+	case "", "all", "serve", "worker":
+	case "fsck":
+		fsck(flag.Args()[1:])
+		return
+	default:
+		logging.Fatal("unknown command", "command", command)
+	}
+	// run until SIGINT/SIGTERM, then stop in reverse order: server, workers, task queue, database, tracing
+	lc := lifecycle.New(conf.ShutdownTimeout)
+	lc.Add(lifecycle.Service{
+		Name: "tracing",
+		Stop: stopTracing, // exports the spans left
+	})
+	lc.Add(lifecycle.Service{
+		Name: "database",
+		Stop: func(context.Context) error { return m.CloseDatabase() },
+	})
+	lc.Add(lifecycle.Service{
+		Name:  "task queue",
+		Start: background.Ping, // tasks can't be enqueued without redis
+		Stop:  func(context.Context) error { return background.Close() },
+	})
+	if command != "serve" {
+		lc.Add(lifecycle.Service{
+			Name:  "background workers",
+			Start: background.StartBackgroundWorkers,
+			Stop:  background.StopBackgroundWorkers,
+		})
+	}
+	if command != "worker" {
+		lc.AddServer("server", controllers.NewServer())
+	} else if conf.Health.Port > 0 {
+		lc.AddServer("health server", controllers.NewHealthServer())
+	}
+	if conf.Metrics.Address != "" {
+		lc.AddServer("metrics server", controllers.NewMetricsServer())
+	}
+	os.Exit(lc.Run())
+}
+
+// setupLogging writes the log lines as configured, the ones of the standard library's log too
+func setupLogging(c config.Log) {
+	level, _ := logging.ParseLevel(c.Level) // validated by config.Load
+	logger, err := logging.New(os.Stdout, c.Format, level)
+	if err != nil {
+		logging.Fatal("invalid configuration", "error", err)
+	}
+	logging.SetDefault(logger)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.LevelInfo))
+}
+
+// migrate changes the database schema: up applies all pending migrations, down reverts the last ones, status lists
+// them. Exits with 1 on failure.
+func migrate(args []string) {
+	const usage = "usage: chiefsend-api [flags] migrate up|down|status [-steps n] [-baseline n]"
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		logging.Fatal(usage)
+	}
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	steps := fs.Int("steps", 1, "number of migrations down reverts")
+	baseline := fs.Int("baseline", 0, "pass -baseline 1 to mark the migrations up to 1 as applied without running them "+
+		"(for databases created with -auto-migrate)")
+	_ = fs.Parse(args[1:])
+	if fs.NArg() > 0 {
+		logging.Fatal(usage, "unexpected", strings.Join(fs.Args(), " "))
+	}
+
+	db, err := m.GetDatabase()
+	if err != nil {
+		logging.Fatal("cannot connect database")
+	}
+	defer m.CloseDatabase()
+	switch args[0] {
+	case "up":
+		if *baseline > 0 {
+			marked, err := m.Baseline(db, *baseline)
+			for _, mig := range marked {
+				logging.Info("marked as applied", "migration", fmt.Sprintf("%04d_%s", mig.Version, mig.Name))
 			}
-			// Migrate the schema (temporary)
-			if err := db.AutoMigrate(&m.Share{}); err != nil {
-				log.Fatal("Cannot migrate database")
+			if err != nil {
+				logging.Fatal("baseline failed", "error", err)
 			}
-			if err := db.AutoMigrate(&m.Attachment{}); err != nil {
-				log.Fatal("Cannot migrate database")
+		}
+		ran, err := m.MigrateUp(db)
+		for _, mig := range ran {
+			logging.Info("applied", "migration", fmt.Sprintf("%04d_%s", mig.Version, mig.Name))
+		}
+		if err != nil {
+			logging.Fatal("migration failed", "error", err)
+		}
+		if len(ran) == 0 {
+			logging.Info("schema is up to date")
+		}
+	case "down":
+		reverted, err := m.MigrateDown(db, *steps)
+		for _, mig := range reverted {
+			logging.Info("reverted", "migration", fmt.Sprintf("%04d_%s", mig.Version, mig.Name))
+		}
+		if err != nil {
+			logging.Fatal("migration failed", "error", err)
+		}
+	case "status":
+		status, err := m.GetMigrationStatus(db)
+		if err != nil {
+			logging.Fatal("cannot read migrations", "error", err)
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
 			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
 		}
+	default:
+		logging.Fatal("unknown migrate command", "command", args[0])
 	}
-	// check if file structure is there
-	if err := os.MkdirAll(filepath.Join(os.Getenv("MEDIA_DIR"), "temp"), os.ModePerm); err != nil {
-		log.Fatal(err)
-	}
-	if err := os.MkdirAll(filepath.Join(os.Getenv("MEDIA_DIR"), "data"), os.ModePerm); err != nil {
-		log.Fatal(err)
+}
+
+// fsck checks (and repairs) the consistency of database and media storage. Exits with 1 if problems remain.
+func fsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "pass -repair to fix the problems found")
+	_ = fs.Parse(args)
+	if fs.NArg() > 0 {
+		logging.Fatal("usage: chiefsend-api [flags] fsck [-repair]", "unexpected", strings.Join(fs.Args(), " "))
 	}
-	// start the server(s)
-	log.Print("starting background workers ...")
-	go background.StartBackgroundWorkers()
 
-	log.Print("starting server ...")
-	controllers.StartServer()
+	db, err := m.GetDatabase()
+	if err != nil {
+		logging.Fatal("cannot connect database")
+	}
+	report, err := m.Fsck(db, *repair)
+	_ = m.CloseDatabase()
+	if err != nil {
+		logging.Fatal("fsck failed", "error", err)
+	}
+	out, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		logging.Fatal("cannot encode report", "error", err)
+	}
+	os.Stdout.Write(append(out, '\n'))
+	if report.Unrepaired() > 0 {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,73 @@
+// Package metrics holds the Prometheus metrics of the api server and the background workers. Metrics which are
+// read at scrape time (shares, storage, queues) are registered by the packages that know how to read them.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const namespace = "chiefsend"
+
+// Registry holds all metrics of the process
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "http", Name: "requests_total",
+		Help: "HTTP requests by route template, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "http", Name: "request_duration_seconds",
+		Help: "Duration of the HTTP requests by route template and method, transfers included.",
+		// up to long uploads and zip downloads
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900},
+	}, []string{"route", "method"})
+
+	TransferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Name: "transferred_bytes_total",
+		Help: "Bytes of uploaded and downloaded files.",
+	}, []string{"direction"})
+
+	ActiveTransfers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace, Name: "active_transfers",
+		Help: "Uploads and downloads in progress.",
+	}, []string{"direction"})
+
+	Tasks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "tasks", Name: "processed_total",
+		Help: "Background tasks processed by this process, by type and outcome (success or failure).",
+	}, []string{"type", "outcome"})
+
+	BcryptDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace, Name: "bcrypt_verify_duration_seconds",
+		Help:    "Duration of the share password verifications.",
+		Buckets: prometheus.ExponentialBuckets(.01, 2, 10),
+	})
+
+	DBErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "db", Name: "errors_total",
+		Help: "Failed database operations by kind (create, query, update, delete, row, raw), missing records excluded.",
+	}, []string{"operation"})
+)
+
+func init() {
+	Registry.MustRegister(HTTPRequests, HTTPDuration, TransferredBytes, ActiveTransfers, Tasks, BcryptDuration, DBErrors,
+		prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// Handler serves the metrics in the Prometheus exposition format. Metrics which can't be read are left out.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError})
+}
+
+// Transfer counts a transfer as active until done is called with the bytes it moved
+func Transfer(direction string) (done func(n int64)) {
+	ActiveTransfers.WithLabelValues(direction).Inc()
+	return func(n int64) {
+		ActiveTransfers.WithLabelValues(direction).Dec()
+		TransferredBytes.WithLabelValues(direction).Add(float64(n))
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
-	"os"
 	"path/filepath"
 )
 
@@ -29,7 +28,6 @@ func (att *Attachment) BeforeCreate(tx *gorm.DB) error {
 	if att.ID.String() == "00000000-0000-0000-0000-000000000000" {
 		uid, err := uuid.NewRandom()
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 		att.ID = uid
@@ -38,9 +36,11 @@ func (att *Attachment) BeforeCreate(tx *gorm.DB) error {
 }
 
 func (att *Attachment) BeforeDelete(tx *gorm.DB) error {
-	if err := os.Remove(filepath.Join(os.Getenv("MEDIA_DIR"), "data", att.ShareID.String(), att.ID.String())); err != nil {
-		tx.Rollback()
-		return err
+	// the file is in data or temp, depending on the state of the share
+	for _, state := range []string{"data", "temp"} {
+		if err := removeAll(tx, filepath.Join(MediaDir(), state, att.ShareID.String(), att.ID.String())); err != nil {
+			return err
+		}
 	}
 	return nil
 }
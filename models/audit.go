@@ -0,0 +1,228 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"gopkg.in/guregu/null.v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"time"
+)
+
+// actors of audit entries
+const (
+	ActorAdmin    = "admin"    // ADMIN_KEY
+	ActorOwner    = "owner"    // management token of the share
+	ActorUploader = "uploader" // upload token, ActorID is the id of the upload request
+	ActorSystem   = "system"   // background tasks
+)
+
+// actions of audit entries
+const (
+	AuditShareFinalize    = "share.finalize"
+	AuditShareUpdate      = "share.update"
+	AuditShareDelete      = "share.delete" // requested, a background task deletes the share
+	AuditAttachmentDelete = "attachment.delete"
+	AuditShareDeleted     = "share.deleted" // by a background task, as requested or rescheduled
+	AuditShareExpired     = "share.expired" // by a background task at its expiry
+	AuditShareCleanup     = "share.cleanup" // temporary share older than jobs.temporary_share_ttl
+)
+
+// AuditEntry records who changed or deleted a share, when and from where
+type AuditEntry struct {
+	ID        uuid.UUID `json:"id"  gorm:"primary_key"`
+	CreatedAt time.Time `json:"created_at"  gorm:"index"`
+
+	Actor        string      `json:"actor"  gorm:"size:32; index"`
+	ActorID      null.String `json:"actor_id,omitempty"`
+	Action       string      `json:"action"  gorm:"size:32; index"`
+	ShareID      uuid.UUID   `json:"share_id"  gorm:"index"`
+	AttachmentID null.String `json:"attachment_id,omitempty"`
+	Changes      Changes     `json:"changes,omitempty"`
+	IP           null.String `json:"ip,omitempty"`
+	RequestID    null.String `json:"request_id,omitempty"`
+}
+
+func (e *AuditEntry) BeforeCreate(tx *gorm.DB) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	return nil
+}
+
+// Change of a field, nil if the share didn't exist before or doesn't anymore
+type Change struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Changes by field, stored as JSON
+type Changes map[string]Change
+
+func (c Changes) Value() (driver.Value, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(c)
+	return string(b), err
+}
+
+func (Changes) GormDataType() string {
+	return "text"
+}
+
+// GormDBDataType stores the JSON in the large text type of the dialect
+func (Changes) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	switch db.Dialector.Name() {
+	case "mysql":
+		return "longtext"
+	case "sqlserver":
+		return "nvarchar(MAX)"
+	default:
+		return "text"
+	}
+}
+
+func (c *Changes) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	case nil:
+		*c = nil
+		return nil
+	default:
+		return fmt.Errorf("can't scan %T into Changes", value)
+	}
+	return json.Unmarshal(b, c)
+}
+
+// redacted are the fields whose values never get into the audit log, only that they changed
+var redacted = map[string]bool{"password": true}
+
+// auditFields returns the fields of the share as they are sent to clients, without its attachments
+func auditFields(sh *Share) (map[string]interface{}, error) {
+	if sh == nil {
+		return map[string]interface{}{}, nil
+	}
+	s := *sh
+	s.Attachments = nil
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	return fields, json.Unmarshal(b, &fields)
+}
+
+// ShareDiff returns the fields which differ between before and after. Either may be nil for shares which are created
+// or deleted, all fields of the other one are in the diff then.
+func ShareDiff(before, after *Share) (Changes, error) {
+	b, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := Changes{}
+	for k, v := range b {
+		if !reflect.DeepEqual(v, a[k]) {
+			changes[k] = Change{Before: v, After: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			changes[k] = Change{After: v}
+		}
+	}
+	// compared raw, so a new password is recorded even if there was one before
+	for k, c := range changes {
+		if redacted[k] {
+			changes[k] = Change{Before: redact(c.Before), After: redact(c.After)}
+		}
+	}
+	return changes, nil
+}
+
+func redact(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return "[REDACTED]"
+}
+
+// Audit records the entry, in the transaction of the change it is about
+func Audit(tx *gorm.DB, entry AuditEntry) error {
+	return tx.Create(&entry).Error
+}
+
+// AuditFilter describes which entries FindAuditEntries returns. Unset fields don't filter.
+type AuditFilter struct {
+	ShareID null.String
+	Actor   null.String
+	Action  null.String
+	Since   null.Time
+	Until   null.Time
+
+	Limit  int
+	Cursor string // returned by the previous FindAuditEntries call
+}
+
+// FindAuditEntries returns one page of entries matching the filter, newest first, and the cursor of the next page
+// ("" if it's the last one)
+func FindAuditEntries(db *gorm.DB, f AuditFilter) ([]AuditEntry, string, error) {
+	if f.Limit <= 0 {
+		f.Limit = DefaultPageSize
+	}
+	if f.Limit > MaxPageSize {
+		f.Limit = MaxPageSize
+	}
+	tx := db.Model(&AuditEntry{})
+	if f.ShareID.Valid {
+		tx = tx.Where("share_id = ?", f.ShareID.String)
+	}
+	if f.Actor.Valid {
+		tx = tx.Where("actor = ?", f.Actor.String)
+	}
+	if f.Action.Valid {
+		tx = tx.Where("action = ?", f.Action.String)
+	}
+	if f.Since.Valid {
+		tx = tx.Where("created_at >= ?", f.Since.Time)
+	}
+	if f.Until.Valid {
+		tx = tx.Where("created_at < ?", f.Until.Time)
+	}
+	// keyset pagination, like FindShares
+	if f.Cursor != "" {
+		value, id, err := decodeCursor(f.Cursor, "created_at")
+		if err != nil {
+			return nil, "", err
+		}
+		tx = tx.Where("((created_at < ?) OR (created_at = ? AND id < ?))", value, value, id.String())
+	}
+	var entries []AuditEntry
+	if err := tx.Order("created_at DESC, id DESC").Limit(f.Limit + 1).Find(&entries).Error; err != nil {
+		return nil, "", err
+	}
+	if len(entries) <= f.Limit {
+		return entries, "", nil
+	}
+	entries = entries[:f.Limit]
+	last := entries[len(entries)-1]
+	next, err := encodeCursor(Share{ID: last.ID, CreatedAt: last.CreatedAt}, "created_at")
+	return entries, next, err
+}
+
+// PruneAuditLog deletes the entries older than retention, returns how many
+func PruneAuditLog(db *gorm.DB, retention time.Duration) (int64, error) {
+	res := db.Where("created_at < ?", time.Now().Add(-retention)).Delete(&AuditEntry{})
+	return res.RowsAffected, res.Error
+}
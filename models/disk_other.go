@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package models
+
+// FreeSpace returns the bytes available to the api in the media directory
+func FreeSpace() (uint64, error) {
+	return 0, ErrFreeSpaceUnsupported
+}
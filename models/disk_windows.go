@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package models
+
+import "golang.org/x/sys/windows"
+
+// FreeSpace returns the bytes available to the api in the media directory
+func FreeSpace() (uint64, error) {
+	dir, err := windows.UTF16PtrFromString(conf.MediaDir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// kinds of problems Fsck can find
+const (
+	OrphanedFile      = "orphaned_file"      // file without attachment row
+	OrphanedDirectory = "orphaned_directory" // directory without share row
+	MissingDirectory  = "missing_directory"  // share row without directory
+	MissingBlob       = "missing_blob"       // attachment row without file
+	DanglingRow       = "dangling_row"       // attachment row without share row
+	SizeMismatch      = "size_mismatch"      // file size differs from the stored one
+	MisplacedShare    = "misplaced_share"    // share directory in data while temporary or vice versa
+)
+
+// repairGrace protects files and directories of uploads in progress, younger ones are never removed
+const repairGrace = time.Hour
+
+type FsckProblem struct {
+	Kind         string `json:"kind"`
+	Path         string `json:"path"`
+	ShareID      string `json:"share_id,omitempty"`
+	AttachmentID string `json:"attachment_id,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+	Repaired     bool   `json:"repaired"`
+}
+
+type FsckReport struct {
+	Shares      int           `json:"shares"`
+	Attachments int           `json:"attachments"`
+	Files       int           `json:"files"`
+	Problems    []FsckProblem `json:"problems"`
+}
+
+// Unrepaired returns the number of problems which are still there
+func (rep FsckReport) Unrepaired() int {
+	var n int
+	for _, p := range rep.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// Fsck compares MEDIA_DIR/data, MEDIA_DIR/temp and the database. With repair it tries to fix every problem it finds:
+// orphans get removed, dangling rows get deleted, sizes get taken from the file and misplaced directories get moved.
+// Orphans of temporary shares and orphans younger than an hour might belong to uploads in progress, they are left to
+// the cleanup job.
+func Fsck(db *gorm.DB, repair bool) (FsckReport, error) {
+	rep := FsckReport{Problems: []FsckProblem{}}
+	// removes an orphan unless it might still be in use
+	remove := func(p *FsckProblem, info os.FileInfo, temporary bool) {
+		switch {
+		case temporary:
+			p.Detail = "temporary, left to the cleanup job"
+		case time.Since(info.ModTime()) < repairGrace:
+			p.Detail = "too recent to remove"
+		default:
+			p.Repaired = os.RemoveAll(p.Path) == nil
+		}
+	}
+
+	var shares []Share
+	if err := db.Select("id", "is_temporary").Find(&shares).Error; err != nil {
+		return rep, err
+	}
+	var attachments []Attachment
+	if err := db.Find(&attachments).Error; err != nil {
+		return rep, err
+	}
+	rep.Shares, rep.Attachments = len(shares), len(attachments)
+
+	byShare := make(map[uuid.UUID]Share, len(shares))
+	for _, sh := range shares {
+		byShare[sh.ID] = sh
+	}
+	byAttachment := make(map[uuid.UUID]Attachment, len(attachments))
+	for _, att := range attachments {
+		byAttachment[att.ID] = att
+	}
+	// where the directory of a share actually is
+	location := make(map[uuid.UUID]string, len(shares))
+
+	// walk the file system
+	for _, state := range []string{"data", "temp"} {
+		root := filepath.Join(MediaDir(), state)
+		entries, err := ioutil.ReadDir(root)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return rep, err
+		}
+		for _, e := range entries {
+			path := filepath.Join(root, e.Name())
+			id, err := uuid.Parse(e.Name())
+			sh, ok := byShare[id]
+			if err != nil || !e.IsDir() || !ok {
+				p := FsckProblem{Kind: OrphanedDirectory, Path: path}
+				if !e.IsDir() {
+					p.Kind = OrphanedFile
+				}
+				if repair {
+					remove(&p, e, state == "temp")
+				}
+				rep.Problems = append(rep.Problems, p)
+				continue
+			}
+			if sh.state() != state {
+				p := FsckProblem{Kind: MisplacedShare, Path: path, ShareID: id.String(), Detail: fmt.Sprintf("belongs in %s", sh.state())}
+				target := sh.Dir()
+				if repair {
+					if _, err := os.Stat(target); os.IsNotExist(err) {
+						if os.Rename(path, target) == nil {
+							p.Repaired = true
+							path = target
+						}
+					}
+				}
+				rep.Problems = append(rep.Problems, p)
+			}
+			location[id] = path
+
+			files, err := ioutil.ReadDir(path)
+			if err != nil {
+				return rep, err
+			}
+			for _, f := range files {
+				rep.Files++
+				attID, err := uuid.Parse(f.Name())
+				att, ok := byAttachment[attID]
+				if err != nil || !ok || att.ShareID != id || f.IsDir() {
+					p := FsckProblem{Kind: OrphanedFile, Path: filepath.Join(path, f.Name()), ShareID: id.String()}
+					if repair {
+						remove(&p, f, sh.IsTemporary)
+					}
+					rep.Problems = append(rep.Problems, p)
+					continue
+				}
+				if f.Size() != att.Filesize {
+					p := FsckProblem{Kind: SizeMismatch, Path: filepath.Join(path, f.Name()), ShareID: id.String(), AttachmentID: attID.String(),
+						Detail: fmt.Sprintf("database says %d bytes, file has %d bytes", att.Filesize, f.Size())}
+					if repair {
+						p.Repaired = db.Model(&att).Update("filesize", f.Size()).Error == nil
+					}
+					rep.Problems = append(rep.Problems, p)
+				}
+			}
+		}
+	}
+
+	// walk the database
+	for _, sh := range shares {
+		if _, ok := location[sh.ID]; !ok {
+			p := FsckProblem{Kind: MissingDirectory, Path: sh.Dir(), ShareID: sh.ID.String()}
+			if repair {
+				p.Repaired = os.MkdirAll(p.Path, os.ModePerm) == nil
+			}
+			rep.Problems = append(rep.Problems, p)
+		}
+	}
+	for _, att := range attachments {
+		sh, ok := byShare[att.ShareID]
+		if !ok {
+			// share doesn't exist anymore
+			p := FsckProblem{Kind: DanglingRow, ShareID: att.ShareID.String(), AttachmentID: att.ID.String(), Detail: "share doesn't exist"}
+			if repair {
+				p.Repaired = db.Session(&gorm.Session{SkipHooks: true}).Delete(&att).Error == nil
+			}
+			rep.Problems = append(rep.Problems, p)
+			continue
+		}
+		dir, ok := location[sh.ID]
+		if !ok {
+			dir = sh.Dir()
+		}
+		path := filepath.Join(dir, att.ID.String())
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			p := FsckProblem{Kind: MissingBlob, Path: path, ShareID: sh.ID.String(), AttachmentID: att.ID.String()}
+			if repair {
+				p.Repaired = db.Session(&gorm.Session{SkipHooks: true}).Delete(&att).Error == nil
+			}
+			rep.Problems = append(rep.Problems, p)
+		}
+	}
+
+	return rep, nil
+}
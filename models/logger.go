@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/chiefsend/api/logging"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"time"
+)
+
+// slowQuery is the duration after which queries are logged as slow
+const slowQuery = 200 * time.Millisecond
+
+// dbLogger writes the logs of gorm through the logger of the context, so they carry the request id. Queries are only
+// logged at LevelDebug, their SQL contains the values.
+type dbLogger struct{}
+
+func (l dbLogger) LogMode(logger.LogLevel) logger.Interface { return l }
+
+func (dbLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	logging.FromContext(ctx).Info(fmt.Sprintf(msg, data...), "component", "gorm")
+}
+
+func (dbLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	logging.FromContext(ctx).Warn(fmt.Sprintf(msg, data...), "component", "gorm")
+}
+
+func (dbLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	logging.FromContext(ctx).Error(fmt.Sprintf(msg, data...), "component", "gorm")
+}
+
+func (dbLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	log := logging.FromContext(ctx)
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		_, rows := fc()
+		log.Error("query failed", "component", "gorm", "error", err, "rows", rows, "duration", elapsed)
+	case elapsed > slowQuery:
+		_, rows := fc()
+		log.Warn("slow query", "component", "gorm", "rows", rows, "duration", elapsed)
+	}
+	if log.Enabled(logging.LevelDebug) {
+		sql, rows := fc()
+		log.Debug("query", "component", "gorm", "sql", sql, "rows", rows, "duration", elapsed)
+	}
+}
@@ -1,37 +1,140 @@
 package models
 
 import (
+	"context"
 	"errors"
-	"gorm.io/driver/clickhouse"
+	"fmt"
+	"github.com/chiefsend/api/config"
+	"github.com/chiefsend/api/logging"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
-	"os"
+	"sync"
+	"time"
 )
 
 var db *gorm.DB = nil
+var dbMu sync.Mutex
+
+var conf config.Config
+
+var ErrFreeSpaceUnsupported = errors.New("free space can't be determined on this platform")
+
+// Configure sets the database, the media directory and the share policy
+func Configure(c config.Config) {
+	conf = c
+}
+
+// MediaDir returns the directory the files are stored in
+func MediaDir() string {
+	return conf.MediaDir
+}
 
 // returns the database connection. Opens one if doesn't exist.
 func GetDatabase() (*gorm.DB, error) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
 	if db != nil {
 		return db, nil
 	}
+	conn, err := open(conf.Database)
+	if err != nil {
+		return nil, err
+	}
+	db = conn
+	return db, nil
+}
+
+// GetDatabaseContext returns the database connection, queries are canceled with the context
+func GetDatabaseContext(ctx context.Context) (*gorm.DB, error) {
+	conn, err := GetDatabase()
+	if err != nil {
+		return nil, err
+	}
+	return conn.WithContext(ctx), nil
+}
+
+// Connect opens the database connection and pings it until it answers, backing off between the attempts.
+// Gives up when ctx is done.
+func Connect(ctx context.Context) error {
+	backoff := 500 * time.Millisecond
+	for {
+		err := ping(ctx)
+		if err == nil {
+			return nil
+		}
+		logging.FromContext(ctx).Warn("database not reachable, retrying", "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
 
-	dsn := os.Getenv("DATABASE_URI")
-	switch os.Getenv("DATABASE_DIALECT") {
+func ping(ctx context.Context) error {
+	conn, err := GetDatabase()
+	if err != nil {
+		return err
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+// CloseDatabase closes the connection pool, the next GetDatabase opens a new one
+func CloseDatabase() error {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	if db == nil {
+		return nil
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	db = nil
+	return sqlDB.Close()
+}
+
+// open connects to the database and sets up the pool. Doesn't wait for the database to answer.
+func open(c config.Database) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch c.Dialect {
 	case "mysql":
-		return gorm.Open(mysql.Open(dsn), &gorm.Config{})
+		dialector = mysql.Open(c.URI)
 	case "postgres":
-		return gorm.Open(postgres.Open(dsn), &gorm.Config{})
+		dialector = postgres.Open(c.URI)
 	case "sqlite":
-		return gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+		dialector = sqlite.Open(c.URI)
 	case "mssql":
-		return gorm.Open(sqlserver.Open(dsn), &gorm.Config{})
-	case "clickhouse":
-		return gorm.Open(clickhouse.Open(dsn), &gorm.Config{})
+		dialector = sqlserver.Open(c.URI)
 	default:
-		return nil, errors.New("invalid DSN")
+		return nil, fmt.Errorf("unsupported database dialect %q", c.Dialect)
+	}
+	conn, err := gorm.Open(dialector, &gorm.Config{Logger: dbLogger{}})
+	if err != nil {
+		return nil, err
+	}
+	if err := countErrors(conn); err != nil {
+		return nil, err
+	}
+	if err := conn.Use(tracePlugin{}); err != nil {
+		return nil, err
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return nil, err
 	}
+	sqlDB.SetMaxOpenConns(c.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(c.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(c.ConnMaxLifetime)
+	return conn, nil
 }
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"errors"
+	"github.com/chiefsend/api/metrics"
+	"gorm.io/gorm"
+)
+
+// countErrors registers callbacks after each kind of operation which count the failed ones
+func countErrors(conn *gorm.DB) error {
+	count := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				metrics.DBErrors.WithLabelValues(operation).Inc()
+			}
+		}
+	}
+	cb := conn.Callback()
+	for _, err := range []error{
+		cb.Create().After("gorm:create").Register("metrics:create", count("create")),
+		cb.Query().After("gorm:query").Register("metrics:query", count("query")),
+		cb.Update().After("gorm:update").Register("metrics:update", count("update")),
+		cb.Delete().After("gorm:delete").Register("metrics:delete", count("delete")),
+		cb.Row().After("gorm:row").Register("metrics:row", count("row")),
+		cb.Raw().After("gorm:raw").Register("metrics:raw", count("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
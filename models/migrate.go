@@ -0,0 +1,280 @@
+package models
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrSchemaOutdated = errors.New("database schema is outdated, run `chiefsend-api migrate up`")
+	ErrSchemaNewer    = errors.New("database schema is newer than this version of chiefsend-api")
+)
+
+//go:embed migrations
+var migrationFiles embed.FS // <dialect>/<version>_<name>.up.sql and .down.sql, statements end with ; at the end of a line
+
+// Migration changes the schema from the version before to Version (Up) and back (Down)
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// SchemaMigration is a row of schema_migrations, one for each applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey; autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// MigrationStatus tells if a migration is applied to the database
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Migrations returns the migrations of the dialect of db, ordered by version
+func Migrations(db *gorm.DB) ([]Migration, error) {
+	dir := db.Dialector.Name()
+	if dir == "sqlserver" {
+		dir = "mssql"
+	}
+	return loadMigrations(path.Join("migrations", dir))
+}
+
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s: %w", path.Base(dir), err)
+	}
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+		parts := strings.SplitN(strings.TrimSuffix(name, "."+direction+".sql"), "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 || version <= 0 {
+			return nil, fmt.Errorf("migration file %s isn't named <version>_<name>.%s.sql", name, direction)
+		}
+		content, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = mig
+		}
+		if mig.Name != parts[1] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, parts[1])
+		}
+		if direction == "up" {
+			mig.Up = string(content)
+		} else {
+			mig.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs an up and a down file", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// statements splits a migration file into its statements
+func statements(sql string) []string {
+	var stmts []string
+	var current strings.Builder
+	for _, line := range strings.Split(sql, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line + "\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
+
+// applied returns the applied migrations by version, creates schema_migrations if it's missing
+func applied(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		if err := db.Migrator().CreateTable(&SchemaMigration{}); err != nil {
+			return nil, err
+		}
+	}
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]SchemaMigration, len(rows))
+	for _, row := range rows {
+		byVersion[row.Version] = row
+	}
+	return byVersion, nil
+}
+
+// MigrateUp applies all pending migrations in order, each in its own transaction. Returns the applied ones.
+func MigrateUp(db *gorm.DB) ([]Migration, error) {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return nil, err
+	}
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	var ran []Migration
+	for _, mig := range migrations {
+		if _, ok := done[mig.Version]; ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, stmt := range statements(mig.Up) {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Create(&SchemaMigration{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return ran, fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+		}
+		ran = append(ran, mig)
+	}
+	return ran, nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first. Returns the reverted ones.
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return nil, err
+	}
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	var reverted []Migration
+	for i := len(migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		mig := migrations[i]
+		if _, ok := done[mig.Version]; !ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, stmt := range statements(mig.Down) {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Delete(&SchemaMigration{Version: mig.Version}).Error
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("migration %04d_%s: %w", mig.Version, mig.Name, err)
+		}
+		reverted = append(reverted, mig)
+	}
+	return reverted, nil
+}
+
+// GetMigrationStatus returns all known migrations and when they were applied
+func GetMigrationStatus(db *gorm.DB) ([]MigrationStatus, error) {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return nil, err
+	}
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, len(migrations))
+	for i, mig := range migrations {
+		status[i] = MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if row, ok := done[mig.Version]; ok {
+			appliedAt := row.AppliedAt
+			status[i].AppliedAt = &appliedAt
+		}
+	}
+	return status, nil
+}
+
+// CheckSchema returns ErrSchemaOutdated if a migration is pending, ErrSchemaNewer if the database has migrations this
+// binary doesn't know
+func CheckSchema(db *gorm.DB) error {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return err
+	}
+	done, err := applied(db)
+	if err != nil {
+		return err
+	}
+	known := make(map[int]bool, len(migrations))
+	for _, mig := range migrations {
+		known[mig.Version] = true
+		if _, ok := done[mig.Version]; !ok {
+			return fmt.Errorf("%w: %04d_%s is pending", ErrSchemaOutdated, mig.Version, mig.Name)
+		}
+	}
+	for version := range done {
+		if !known[version] {
+			return fmt.Errorf("%w: unknown migration %d", ErrSchemaNewer, version)
+		}
+	}
+	return nil
+}
+
+// Baseline records the migrations up to version as applied without running them, for databases whose schema was
+// created by gorm's AutoMigrate before there were migrations. Only works on databases without applied migrations.
+func Baseline(db *gorm.DB, version int) ([]Migration, error) {
+	migrations, err := Migrations(db)
+	if err != nil {
+		return nil, err
+	}
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(done) > 0 {
+		return nil, errors.New("database already has applied migrations")
+	}
+	var marked []Migration
+	for _, mig := range migrations {
+		if mig.Version > version {
+			break
+		}
+		if err := db.Create(&SchemaMigration{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now()}).Error; err != nil {
+			return marked, err
+		}
+		marked = append(marked, mig)
+	}
+	return marked, nil
+}
@@ -0,0 +1,22 @@
+CREATE TABLE shares (
+    id                nvarchar(256) NOT NULL,
+    created_at        datetimeoffset,
+    updated_at        datetimeoffset,
+    name              nvarchar(MAX),
+    expires           datetimeoffset,
+    download_limit    bigint,
+    is_public         bit           NOT NULL DEFAULT 0,
+    password          nvarchar(MAX),
+    is_temporary      bit,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_shares_is_public ON shares (is_public);
+
+CREATE TABLE attachments (
+    id       nvarchar(256) NOT NULL,
+    filename nvarchar(MAX) NOT NULL,
+    filesize bigint        NOT NULL DEFAULT 0,
+    share_id nvarchar(256) NOT NULL,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_shares_attachments FOREIGN KEY (share_id) REFERENCES shares (id) ON DELETE CASCADE
+);
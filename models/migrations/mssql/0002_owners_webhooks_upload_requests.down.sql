@@ -0,0 +1,8 @@
+DROP TABLE upload_requests;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+DROP INDEX idx_shares_owner ON shares;
+DROP INDEX idx_shares_upload_request_id ON shares;
+ALTER TABLE shares DROP CONSTRAINT df_shares_downloads, df_shares_reminder_sent;
+ALTER TABLE shares DROP COLUMN owner, downloads, deletion_task, owner_email, reminder_sent, upload_request_id,
+    management_hash;
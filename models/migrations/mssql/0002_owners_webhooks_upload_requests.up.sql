@@ -0,0 +1,59 @@
+-- owners, download counts, scheduled deletions, webhooks, email notifications, upload requests and management
+-- tokens: the schema -auto-migrate created before there were migrations
+-- the defaults are named, sql server can't drop their columns otherwise
+ALTER TABLE shares ADD
+    owner             nvarchar(256),
+    downloads         bigint        NOT NULL CONSTRAINT df_shares_downloads DEFAULT 0,
+    deletion_task     nvarchar(MAX),
+    owner_email       nvarchar(MAX),
+    reminder_sent     bit           NOT NULL CONSTRAINT df_shares_reminder_sent DEFAULT 0,
+    upload_request_id nvarchar(256),
+    management_hash   nvarchar(64);
+CREATE INDEX idx_shares_owner ON shares (owner);
+CREATE INDEX idx_shares_upload_request_id ON shares (upload_request_id);
+
+CREATE TABLE webhooks (
+    id         nvarchar(256) NOT NULL,
+    created_at datetimeoffset,
+    updated_at datetimeoffset,
+    url        nvarchar(MAX) NOT NULL,
+    events     nvarchar(255) NOT NULL,
+    secret     nvarchar(MAX) NOT NULL,
+    active     bit           NOT NULL DEFAULT 1,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE webhook_deliveries (
+    id          nvarchar(256) NOT NULL,
+    created_at  datetimeoffset,
+    webhook_id  nvarchar(256),
+    event_id    nvarchar(256),
+    event       nvarchar(MAX),
+    payload     nvarchar(MAX),
+    attempt     bigint,
+    status_code bigint,
+    error       nvarchar(MAX),
+    duration    bigint,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_webhooks_deliveries FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhook_deliveries_created_at ON webhook_deliveries (created_at);
+CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id);
+
+CREATE TABLE upload_requests (
+    id          nvarchar(256) NOT NULL,
+    created_at  datetimeoffset,
+    updated_at  datetimeoffset,
+    name        nvarchar(MAX),
+    owner       nvarchar(256),
+    owner_email nvarchar(MAX),
+    expires     datetimeoffset,
+    max_shares  bigint,
+    max_files   bigint,
+    max_size    bigint,
+    shares      bigint        NOT NULL DEFAULT 0,
+    token_hash  nvarchar(64)  NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_upload_requests_owner ON upload_requests (owner);
+CREATE UNIQUE INDEX idx_upload_requests_token_hash ON upload_requests (token_hash);
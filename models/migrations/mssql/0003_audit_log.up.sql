@@ -0,0 +1,18 @@
+-- who changed or deleted which share, entries outlive their shares
+CREATE TABLE audit_entries (
+    id            nvarchar(256) NOT NULL,
+    created_at    datetimeoffset,
+    actor         nvarchar(32),
+    actor_id      nvarchar(MAX),
+    action        nvarchar(32),
+    share_id      nvarchar(256),
+    attachment_id nvarchar(MAX),
+    changes       nvarchar(MAX),
+    ip            nvarchar(MAX),
+    request_id    nvarchar(MAX),
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_audit_entries_created_at ON audit_entries (created_at);
+CREATE INDEX idx_audit_entries_actor ON audit_entries (actor);
+CREATE INDEX idx_audit_entries_action ON audit_entries (action);
+CREATE INDEX idx_audit_entries_share_id ON audit_entries (share_id);
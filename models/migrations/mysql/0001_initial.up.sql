@@ -0,0 +1,22 @@
+CREATE TABLE shares (
+    id                varchar(191) NOT NULL,
+    created_at        datetime(3),
+    updated_at        datetime(3),
+    name              longtext,
+    expires           datetime(3),
+    download_limit    bigint,
+    is_public         boolean      NOT NULL DEFAULT false,
+    password          longtext,
+    is_temporary      boolean,
+    PRIMARY KEY (id),
+    INDEX idx_shares_is_public (is_public)
+);
+
+CREATE TABLE attachments (
+    id       varchar(191) NOT NULL,
+    filename longtext     NOT NULL,
+    filesize bigint       NOT NULL DEFAULT 0,
+    share_id varchar(191) NOT NULL,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_shares_attachments FOREIGN KEY (share_id) REFERENCES shares (id) ON DELETE CASCADE
+);
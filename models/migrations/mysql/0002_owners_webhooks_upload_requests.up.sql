@@ -0,0 +1,58 @@
+-- owners, download counts, scheduled deletions, webhooks, email notifications, upload requests and management
+-- tokens: the schema -auto-migrate created before there were migrations
+ALTER TABLE shares
+    ADD COLUMN owner             varchar(191),
+    ADD COLUMN downloads         bigint       NOT NULL DEFAULT 0,
+    ADD COLUMN deletion_task     longtext,
+    ADD COLUMN owner_email       longtext,
+    ADD COLUMN reminder_sent     boolean      NOT NULL DEFAULT false,
+    ADD COLUMN upload_request_id varchar(191),
+    ADD COLUMN management_hash   varchar(64),
+    ADD INDEX idx_shares_owner (owner),
+    ADD INDEX idx_shares_upload_request_id (upload_request_id);
+
+CREATE TABLE webhooks (
+    id         varchar(191) NOT NULL,
+    created_at datetime(3),
+    updated_at datetime(3),
+    url        longtext     NOT NULL,
+    events     varchar(255) NOT NULL,
+    secret     longtext     NOT NULL,
+    active     boolean      NOT NULL DEFAULT true,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE webhook_deliveries (
+    id          varchar(191) NOT NULL,
+    created_at  datetime(3),
+    webhook_id  varchar(191),
+    event_id    varchar(191),
+    event       longtext,
+    payload     longtext,
+    attempt     bigint,
+    status_code bigint,
+    error       longtext,
+    duration    bigint,
+    PRIMARY KEY (id),
+    INDEX idx_webhook_deliveries_created_at (created_at),
+    INDEX idx_webhook_deliveries_webhook_id (webhook_id),
+    CONSTRAINT fk_webhooks_deliveries FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+
+CREATE TABLE upload_requests (
+    id          varchar(191) NOT NULL,
+    created_at  datetime(3),
+    updated_at  datetime(3),
+    name        longtext,
+    owner       varchar(191),
+    owner_email longtext,
+    expires     datetime(3),
+    max_shares  bigint,
+    max_files   bigint,
+    max_size    bigint,
+    shares      bigint       NOT NULL DEFAULT 0,
+    token_hash  varchar(64)  NOT NULL,
+    PRIMARY KEY (id),
+    INDEX idx_upload_requests_owner (owner),
+    UNIQUE INDEX idx_upload_requests_token_hash (token_hash)
+);
@@ -0,0 +1,18 @@
+-- who changed or deleted which share, entries outlive their shares
+CREATE TABLE audit_entries (
+    id            varchar(191) NOT NULL,
+    created_at    datetime(3),
+    actor         varchar(32),
+    actor_id      longtext,
+    action        varchar(32),
+    share_id      varchar(191),
+    attachment_id longtext,
+    changes       longtext,
+    ip            longtext,
+    request_id    longtext,
+    PRIMARY KEY (id),
+    INDEX idx_audit_entries_created_at (created_at),
+    INDEX idx_audit_entries_actor (actor),
+    INDEX idx_audit_entries_action (action),
+    INDEX idx_audit_entries_share_id (share_id)
+);
@@ -0,0 +1,22 @@
+CREATE TABLE shares (
+    id                text,
+    created_at        timestamptz,
+    updated_at        timestamptz,
+    name              text,
+    expires           timestamptz,
+    download_limit    bigint,
+    is_public         boolean NOT NULL DEFAULT false,
+    password          text,
+    is_temporary      boolean,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_shares_is_public ON shares (is_public);
+
+CREATE TABLE attachments (
+    id       text,
+    filename text   NOT NULL,
+    filesize bigint NOT NULL DEFAULT 0,
+    share_id text   NOT NULL,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_shares_attachments FOREIGN KEY (share_id) REFERENCES shares (id) ON DELETE CASCADE
+);
@@ -0,0 +1,13 @@
+DROP TABLE upload_requests;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+DROP INDEX idx_shares_owner;
+DROP INDEX idx_shares_upload_request_id;
+ALTER TABLE shares
+    DROP COLUMN owner,
+    DROP COLUMN downloads,
+    DROP COLUMN deletion_task,
+    DROP COLUMN owner_email,
+    DROP COLUMN reminder_sent,
+    DROP COLUMN upload_request_id,
+    DROP COLUMN management_hash;
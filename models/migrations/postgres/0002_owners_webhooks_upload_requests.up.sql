@@ -0,0 +1,58 @@
+-- owners, download counts, scheduled deletions, webhooks, email notifications, upload requests and management
+-- tokens: the schema -auto-migrate created before there were migrations
+ALTER TABLE shares
+    ADD COLUMN owner             text,
+    ADD COLUMN downloads         bigint  NOT NULL DEFAULT 0,
+    ADD COLUMN deletion_task     text,
+    ADD COLUMN owner_email       text,
+    ADD COLUMN reminder_sent     boolean NOT NULL DEFAULT false,
+    ADD COLUMN upload_request_id text,
+    ADD COLUMN management_hash   varchar(64);
+CREATE INDEX idx_shares_owner ON shares (owner);
+CREATE INDEX idx_shares_upload_request_id ON shares (upload_request_id);
+
+CREATE TABLE webhooks (
+    id         text,
+    created_at timestamptz,
+    updated_at timestamptz,
+    url        text         NOT NULL,
+    events     varchar(255) NOT NULL,
+    secret     text         NOT NULL,
+    active     boolean      NOT NULL DEFAULT true,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE webhook_deliveries (
+    id          text,
+    created_at  timestamptz,
+    webhook_id  text,
+    event_id    text,
+    event       text,
+    payload     text,
+    attempt     bigint,
+    status_code bigint,
+    error       text,
+    duration    bigint,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_webhooks_deliveries FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhook_deliveries_created_at ON webhook_deliveries (created_at);
+CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id);
+
+CREATE TABLE upload_requests (
+    id          text,
+    created_at  timestamptz,
+    updated_at  timestamptz,
+    name        text,
+    owner       text,
+    owner_email text,
+    expires     timestamptz,
+    max_shares  bigint,
+    max_files   bigint,
+    max_size    bigint,
+    shares      bigint      NOT NULL DEFAULT 0,
+    token_hash  varchar(64) NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_upload_requests_owner ON upload_requests (owner);
+CREATE UNIQUE INDEX idx_upload_requests_token_hash ON upload_requests (token_hash);
@@ -0,0 +1,18 @@
+-- who changed or deleted which share, entries outlive their shares
+CREATE TABLE audit_entries (
+    id            text,
+    created_at    timestamptz,
+    actor         varchar(32),
+    actor_id      text,
+    action        varchar(32),
+    share_id      text,
+    attachment_id text,
+    changes       text,
+    ip            text,
+    request_id    text,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_audit_entries_created_at ON audit_entries (created_at);
+CREATE INDEX idx_audit_entries_actor ON audit_entries (actor);
+CREATE INDEX idx_audit_entries_action ON audit_entries (action);
+CREATE INDEX idx_audit_entries_share_id ON audit_entries (share_id);
@@ -0,0 +1,24 @@
+DROP TABLE upload_requests;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;
+-- sqlite can't drop columns before 3.35, the table is copied instead
+DROP INDEX idx_shares_owner;
+DROP INDEX idx_shares_upload_request_id;
+DROP INDEX idx_shares_is_public;
+CREATE TABLE shares_0001 (
+    id             text,
+    created_at     datetime,
+    updated_at     datetime,
+    name           text,
+    expires        datetime,
+    download_limit integer,
+    is_public      numeric NOT NULL DEFAULT false,
+    password       text,
+    is_temporary   numeric,
+    PRIMARY KEY (id)
+);
+INSERT INTO shares_0001 (id, created_at, updated_at, name, expires, download_limit, is_public, password, is_temporary)
+SELECT id, created_at, updated_at, name, expires, download_limit, is_public, password, is_temporary FROM shares;
+DROP TABLE shares;
+ALTER TABLE shares_0001 RENAME TO shares;
+CREATE INDEX idx_shares_is_public ON shares (is_public);
@@ -0,0 +1,57 @@
+-- owners, download counts, scheduled deletions, webhooks, email notifications, upload requests and management
+-- tokens: the schema -auto-migrate created before there were migrations
+ALTER TABLE shares ADD COLUMN owner text;
+ALTER TABLE shares ADD COLUMN downloads integer NOT NULL DEFAULT 0;
+ALTER TABLE shares ADD COLUMN deletion_task text;
+ALTER TABLE shares ADD COLUMN owner_email text;
+ALTER TABLE shares ADD COLUMN reminder_sent numeric NOT NULL DEFAULT false;
+ALTER TABLE shares ADD COLUMN upload_request_id text;
+ALTER TABLE shares ADD COLUMN management_hash varchar(64);
+CREATE INDEX idx_shares_owner ON shares (owner);
+CREATE INDEX idx_shares_upload_request_id ON shares (upload_request_id);
+
+CREATE TABLE webhooks (
+    id         text,
+    created_at datetime,
+    updated_at datetime,
+    url        text         NOT NULL,
+    events     varchar(255) NOT NULL,
+    secret     text         NOT NULL,
+    active     numeric      NOT NULL DEFAULT true,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE webhook_deliveries (
+    id          text,
+    created_at  datetime,
+    webhook_id  text,
+    event_id    text,
+    event       text,
+    payload     text,
+    attempt     integer,
+    status_code integer,
+    error       text,
+    duration    integer,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_webhooks_deliveries FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_webhook_deliveries_created_at ON webhook_deliveries (created_at);
+CREATE INDEX idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id);
+
+CREATE TABLE upload_requests (
+    id          text,
+    created_at  datetime,
+    updated_at  datetime,
+    name        text,
+    owner       text,
+    owner_email text,
+    expires     datetime,
+    max_shares  integer,
+    max_files   integer,
+    max_size    integer,
+    shares      integer     NOT NULL DEFAULT 0,
+    token_hash  varchar(64) NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_upload_requests_owner ON upload_requests (owner);
+CREATE UNIQUE INDEX idx_upload_requests_token_hash ON upload_requests (token_hash);
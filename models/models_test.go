@@ -1,23 +1,36 @@
 package models
 
 import (
+	"context"
+	"errors"
+	"github.com/chiefsend/api/config"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/guregu/null.v4"
+	"gorm.io/gorm"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestMain(m *testing.M) {
+	c, err := config.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	Configure(c)
 	db, err := GetDatabase()
 	if err != nil {
 		log.Fatal("database brok")
 	}
-	_ = db.AutoMigrate(&Share{})
-	_ = db.AutoMigrate(&Attachment{})
+	if _, err := MigrateUp(db); err != nil {
+		log.Fatal(err)
+	}
 
 	os.Exit(m.Run())
 }
@@ -62,7 +75,51 @@ func TestReadShare(t *testing.T) {
 }
 
 func TestUpdateShare(t *testing.T) {
-	return
+	now := time.Date(2020, 01, 01, 17, 17, 17, 0, time.UTC)
+
+	t.Run("happy path", func(t *testing.T) {
+		sh := Share{Name: null.StringFrom("Old"), DownloadLimit: null.IntFrom(5)}
+		err := sh.ApplyPatch([]byte(`{"name": " New ", "expires": "2020-01-02T00:00:00Z", "download_limit": null, "is_public": true}`), now)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, null.StringFrom("New"), sh.Name)
+		assert.Equal(t, null.TimeFrom(time.Date(2020, 01, 02, 0, 0, 0, 0, time.UTC)), sh.Expires)
+		assert.False(t, sh.DownloadLimit.Valid)
+		assert.True(t, sh.IsPublic)
+	})
+
+	t.Run("password", func(t *testing.T) {
+		sh := Share{}
+		err := sh.ApplyPatch([]byte(`{"password": "test123"}`), now)
+		assert.Nil(t, err)
+		assert.Nil(t, bcrypt.CompareHashAndPassword([]byte(sh.Password.String), []byte("test123")))
+		// remove it again
+		err = sh.ApplyPatch([]byte(`{"password": null}`), now)
+		assert.Nil(t, err)
+		assert.False(t, sh.Password.Valid)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, patch := range []string{
+			`{"id": "f43b0e48-13cc-4c6c-8a23-3a18a670effd"}`,
+			`{"is_temporary": true}`,
+			`{"created_at": "2020-01-01T00:00:00Z"}`,
+			`{"files": []}`,
+			`{"name": ""}`,
+			`{"name": 5}`,
+			`{"expires": "2019-01-01T00:00:00Z"}`,
+			`{"download_limit": -1}`,
+			`{"is_public": null}`,
+			`{"password": ""}`,
+			`{"owner_email": "Alice <alice@example.com>"}`,
+			`{"owner_email": "alice"}`,
+			`[]`,
+			`null`,
+		} {
+			sh := Share{}
+			assert.ErrorIs(t, sh.ApplyPatch([]byte(patch), now), ErrInvalidPatch, patch)
+		}
+	})
 }
 
 func TestDeleteShare(t *testing.T) {
@@ -76,6 +133,396 @@ func TestDeleteShare(t *testing.T) {
 	assert.NoDirExists(t, filepath.Join(os.Getenv("MEDIA_DIR"), "temp", sh.ID.String()))
 }
 
+func TestPolicyApply(t *testing.T) {
+	policy := Policy{
+		DefaultExpiry:        24 * time.Hour,
+		MaxExpiry:            7 * 24 * time.Hour,
+		DefaultDownloadLimit: 10,
+		MaxDownloadLimit:     100,
+		RequirePassword:      true,
+	}
+	uhr := time.Date(2020, 01, 01, 17, 17, 17, 0, time.UTC)
+
+	t.Run("defaults", func(t *testing.T) {
+		sh := Share{CreatedAt: uhr, IsPublic: true}
+		err := policy.Apply(&sh, uhr)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, null.TimeFrom(uhr.Add(24*time.Hour)), sh.Expires)
+		assert.Equal(t, null.IntFrom(10), sh.DownloadLimit)
+	})
+
+	t.Run("default expiry of an old share", func(t *testing.T) {
+		// expires removed later on, counts from now
+		now := uhr.Add(3 * 24 * time.Hour)
+		sh := Share{CreatedAt: uhr, IsPublic: true}
+		assert.Nil(t, policy.Apply(&sh, now))
+		assert.Equal(t, null.TimeFrom(now.Add(24*time.Hour)), sh.Expires)
+		// but not past the maximum
+		now = uhr.Add(6*24*time.Hour + 12*time.Hour)
+		sh = Share{CreatedAt: uhr, IsPublic: true}
+		assert.Nil(t, policy.Apply(&sh, now))
+		assert.Equal(t, null.TimeFrom(uhr.Add(7*24*time.Hour)), sh.Expires)
+	})
+
+	t.Run("max expiry without default", func(t *testing.T) {
+		sh := Share{CreatedAt: uhr, IsPublic: true}
+		assert.Nil(t, Policy{MaxExpiry: 48 * time.Hour}.Apply(&sh, uhr))
+		assert.Equal(t, null.TimeFrom(uhr.Add(48*time.Hour)), sh.Expires)
+	})
+
+	t.Run("expiry too far", func(t *testing.T) {
+		sh := Share{CreatedAt: uhr, IsPublic: true, Expires: null.TimeFrom(uhr.Add(8 * 24 * time.Hour))}
+		err := policy.Apply(&sh, uhr)
+		assert.ErrorIs(t, err, ErrPolicyViolation)
+	})
+
+	t.Run("expiry in the past", func(t *testing.T) {
+		sh := Share{CreatedAt: uhr, IsPublic: true, Expires: null.TimeFrom(uhr.Add(-time.Hour))}
+		assert.ErrorIs(t, Policy{}.Apply(&sh, uhr), ErrPolicyViolation)
+		// old share past its maximum
+		sh = Share{CreatedAt: uhr, IsPublic: true}
+		assert.ErrorIs(t, Policy{MaxExpiry: time.Hour}.Apply(&sh, uhr.Add(2*time.Hour)), ErrPolicyViolation)
+	})
+
+	t.Run("download limit too high", func(t *testing.T) {
+		sh := Share{CreatedAt: uhr, IsPublic: true, DownloadLimit: null.IntFrom(101)}
+		err := policy.Apply(&sh, uhr)
+		assert.ErrorIs(t, err, ErrPolicyViolation)
+	})
+
+	t.Run("negative download limit", func(t *testing.T) {
+		sh := Share{CreatedAt: uhr, IsPublic: true, DownloadLimit: null.IntFrom(-1)}
+		assert.ErrorIs(t, Policy{}.Apply(&sh, uhr), ErrPolicyViolation)
+	})
+
+	t.Run("password required", func(t *testing.T) {
+		sh := Share{CreatedAt: uhr, IsPublic: false}
+		assert.ErrorIs(t, policy.Apply(&sh, uhr), ErrPolicyViolation)
+		sh.Password = null.StringFrom("test123")
+		assert.Nil(t, policy.Apply(&sh, uhr))
+	})
+
+	t.Run("no limits", func(t *testing.T) {
+		sh := Share{}
+		err := Policy{}.Apply(&sh, uhr)
+		// assertions
+		assert.Nil(t, err)
+		assert.False(t, sh.Expires.Valid)
+		assert.False(t, sh.DownloadLimit.Valid)
+	})
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := Policy{
+		DefaultExpiry:        24 * time.Hour,
+		MaxExpiry:            7 * 24 * time.Hour,
+		DefaultDownloadLimit: 10,
+		MaxDownloadLimit:     100,
+		RequirePassword:      true,
+	}
+	uhr := time.Date(2020, 01, 01, 17, 17, 17, 0, time.UTC)
+
+	t.Run("untouched fields", func(t *testing.T) {
+		// a share from before the policy, way older than its maximum
+		before := Share{CreatedAt: uhr.AddDate(-1, 0, 0)}
+		after := before
+		after.Name = null.StringFrom("renamed")
+		assert.Nil(t, policy.Check(before, after, uhr))
+		assert.False(t, after.Expires.Valid)
+		assert.False(t, after.DownloadLimit.Valid)
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		before := Share{CreatedAt: uhr, IsPublic: true, Expires: null.TimeFrom(uhr.Add(time.Hour))}
+		after := before
+		after.Expires = null.TimeFrom(uhr.Add(8 * 24 * time.Hour))
+		assert.ErrorIs(t, policy.Check(before, after, uhr), ErrPolicyViolation)
+		after.Expires = null.Time{}
+		assert.ErrorIs(t, policy.Check(before, after, uhr), ErrPolicyViolation)
+		after.Expires = null.TimeFrom(uhr.Add(48 * time.Hour))
+		assert.Nil(t, policy.Check(before, after, uhr))
+	})
+
+	t.Run("download limit", func(t *testing.T) {
+		before := Share{CreatedAt: uhr, IsPublic: true}
+		after := before
+		after.DownloadLimit = null.IntFrom(101)
+		assert.ErrorIs(t, policy.Check(before, after, uhr), ErrPolicyViolation)
+		after.DownloadLimit = null.IntFrom(-1)
+		assert.ErrorIs(t, policy.Check(before, after, uhr), ErrPolicyViolation)
+	})
+
+	t.Run("password", func(t *testing.T) {
+		before := Share{CreatedAt: uhr, IsPublic: true}
+		after := before
+		after.IsPublic = false
+		assert.ErrorIs(t, policy.Check(before, after, uhr), ErrPolicyViolation)
+		after.Password = null.StringFrom("hash")
+		assert.Nil(t, policy.Check(before, after, uhr))
+		removed := after
+		removed.Password = null.String{}
+		assert.ErrorIs(t, policy.Check(after, removed, uhr), ErrPolicyViolation)
+	})
+}
+
+func TestFsck(t *testing.T) {
+	db, _ := GetDatabase()
+	final := Share{
+		ID: uuid.MustParse("c1e5e3a8-0f0b-4a47-9c6a-6a0d3b6a2f01"),
+		Attachments: []Attachment{
+			{ID: uuid.MustParse("4f9a0e7c-9d0a-4e0c-8f5f-2a4f0c9b3e01"), Filename: "missing.txt", Filesize: 3},
+			{ID: uuid.MustParse("4f9a0e7c-9d0a-4e0c-8f5f-2a4f0c9b3e02"), Filename: "wrongsize.txt", Filesize: 3},
+		},
+	}
+	misplaced := Share{
+		ID:          uuid.MustParse("c1e5e3a8-0f0b-4a47-9c6a-6a0d3b6a2f02"),
+		IsTemporary: true,
+	}
+	db.Create(&final)
+	db.Create(&misplaced)
+	defer db.Delete(&final)
+	defer db.Delete(&misplaced)
+	dataDir := filepath.Join(os.Getenv("MEDIA_DIR"), "data")
+	// size mismatch
+	_ = ioutil.WriteFile(filepath.Join(dataDir, final.ID.String(), final.Attachments[1].ID.String()), []byte("KEKW"), os.ModePerm)
+	// orphaned file
+	orphanFile := filepath.Join(dataDir, final.ID.String(), "a6b2b0f4-5d1e-4f3a-b7c1-0e6f2d9c8a01")
+	_ = ioutil.WriteFile(orphanFile, []byte("KEKW"), os.ModePerm)
+	// orphaned directory
+	orphanDir := filepath.Join(dataDir, "a6b2b0f4-5d1e-4f3a-b7c1-0e6f2d9c8a02")
+	_ = os.MkdirAll(orphanDir, os.ModePerm)
+	// old enough to be removed
+	old := time.Now().Add(-2 * time.Hour)
+	_ = os.Chtimes(orphanFile, old, old)
+	_ = os.Chtimes(orphanDir, old, old)
+	// uploads in progress
+	recentFile := filepath.Join(dataDir, final.ID.String(), "a6b2b0f4-5d1e-4f3a-b7c1-0e6f2d9c8a03")
+	_ = ioutil.WriteFile(recentFile, []byte("KEKW"), os.ModePerm)
+	defer os.Remove(recentFile)
+	uploading := filepath.Join(os.Getenv("MEDIA_DIR"), "temp", "a6b2b0f4-5d1e-4f3a-b7c1-0e6f2d9c8a04")
+	_ = os.MkdirAll(uploading, os.ModePerm)
+	_ = os.Chtimes(uploading, old, old)
+	defer os.RemoveAll(uploading)
+	// attachment of a deleted share
+	dangling := Attachment{ID: uuid.MustParse("4f9a0e7c-9d0a-4e0c-8f5f-2a4f0c9b3e03"), Filename: "dangling.txt",
+		ShareID: uuid.MustParse("c1e5e3a8-0f0b-4a47-9c6a-6a0d3b6a2f03")}
+	db.Session(&gorm.Session{SkipHooks: true}).Create(&dangling)
+	// misplaced share
+	_ = os.Rename(filepath.Join(os.Getenv("MEDIA_DIR"), "temp", misplaced.ID.String()), filepath.Join(dataDir, misplaced.ID.String()))
+
+	kinds := func(rep FsckReport) map[string]bool {
+		res := make(map[string]bool)
+		for _, p := range rep.Problems {
+			if p.ShareID == final.ID.String() || p.ShareID == misplaced.ID.String() || p.Path == orphanDir ||
+				p.AttachmentID == dangling.ID.String() {
+				res[p.Kind] = res[p.Kind] || p.Repaired
+			}
+		}
+		return res
+	}
+
+	t.Run("report", func(t *testing.T) {
+		rep, err := Fsck(db, false)
+		// assertions
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]bool{
+			MissingBlob:       false,
+			DanglingRow:       false,
+			SizeMismatch:      false,
+			OrphanedFile:      false,
+			OrphanedDirectory: false,
+			MisplacedShare:    false,
+		}, kinds(rep))
+		assert.FileExists(t, orphanFile)
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		rep, err := Fsck(db, true)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]bool{
+			MissingBlob:       true,
+			DanglingRow:       true,
+			SizeMismatch:      true,
+			OrphanedFile:      true,
+			OrphanedDirectory: true,
+			MisplacedShare:    true,
+		}, kinds(rep))
+		// assertions
+		assert.NoFileExists(t, orphanFile)
+		assert.NoDirExists(t, orphanDir)
+		assert.FileExists(t, recentFile)
+		assert.DirExists(t, uploading)
+		assert.DirExists(t, filepath.Join(os.Getenv("MEDIA_DIR"), "temp", misplaced.ID.String()))
+		var atts []Attachment
+		db.Where("share_id = ?", final.ID.String()).Find(&atts)
+		assert.Len(t, atts, 1)
+		assert.EqualValues(t, 4, atts[0].Filesize)
+		// nothing left to do, but the upload in progress
+		rep, err = Fsck(db, false)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]bool{OrphanedFile: false}, kinds(rep))
+	})
+}
+
+func TestFindShares(t *testing.T) {
+	db, _ := GetDatabase()
+	uhr := time.Date(2020, 01, 01, 17, 17, 17, 0, time.UTC)
+	owner := null.StringFrom("findshares")
+	shares := []Share{
+		{ID: uuid.MustParse("8d1f3a52-6b8e-4f1c-9a0e-2c3d4e5f6a01"), Owner: owner, CreatedAt: uhr, Name: null.StringFrom("Bravo"), IsPublic: true},
+		{ID: uuid.MustParse("8d1f3a52-6b8e-4f1c-9a0e-2c3d4e5f6a02"), Owner: owner, CreatedAt: uhr.Add(time.Hour), Name: null.StringFrom("alpha 100%"), Expires: null.TimeFrom(uhr.Add(48 * time.Hour))},
+		{ID: uuid.MustParse("8d1f3a52-6b8e-4f1c-9a0e-2c3d4e5f6a03"), Owner: owner, CreatedAt: uhr.Add(time.Hour), Password: null.StringFrom("test123"), Expires: null.TimeFrom(uhr.Add(24 * time.Hour))},
+		{ID: uuid.MustParse("8d1f3a52-6b8e-4f1c-9a0e-2c3d4e5f6a04"), Owner: owner, CreatedAt: uhr.Add(2 * time.Hour), Name: null.StringFrom("Charlie"), IsTemporary: true},
+	}
+	for i := range shares {
+		db.Create(&shares[i])
+		defer db.Delete(&shares[i])
+	}
+	ids := func(shares []Share) []string {
+		var res []string
+		for _, sh := range shares {
+			res = append(res, sh.ID.String()[34:])
+		}
+		return res
+	}
+	// walks through all pages
+	all := func(t *testing.T, f ShareFilter) []string {
+		var res []string
+		for i := 0; i < 10; i++ {
+			page, next, err := FindShares(db, f)
+			assert.Nil(t, err)
+			res = append(res, ids(page)...)
+			if next == "" {
+				break
+			}
+			f.Cursor = next
+		}
+		return res
+	}
+
+	t.Run("sort and paginate", func(t *testing.T) {
+		assert.Equal(t, []string{"01", "02", "03", "04"}, all(t, ShareFilter{Owner: owner, Limit: 1}))
+		assert.Equal(t, []string{"04", "03", "02", "01"}, all(t, ShareFilter{Owner: owner, Limit: 3, Sort: "-created_at"}))
+		assert.Equal(t, []string{"03", "01", "04", "02"}, all(t, ShareFilter{Owner: owner, Limit: 2, Sort: "name"}))
+		assert.Equal(t, []string{"03", "02", "01", "04"}, all(t, ShareFilter{Owner: owner, Limit: 2, Sort: "expires"}))
+		assert.Equal(t, []string{"04", "01", "02", "03"}, all(t, ShareFilter{Owner: owner, Limit: 2, Sort: "-expires"}))
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		assert.Equal(t, []string{"02"}, all(t, ShareFilter{Owner: owner, Search: "0%"}))
+		assert.Equal(t, []string{"01"}, all(t, ShareFilter{Owner: owner, Public: null.BoolFrom(true)}))
+		assert.Equal(t, []string{"04"}, all(t, ShareFilter{Owner: owner, Temporary: null.BoolFrom(true)}))
+		assert.Equal(t, []string{"03"}, all(t, ShareFilter{Owner: owner, HasPassword: null.BoolFrom(true)}))
+		assert.Equal(t, []string{"02", "03"}, all(t, ShareFilter{Owner: owner, CreatedAfter: null.TimeFrom(uhr.Add(time.Hour)), CreatedBefore: null.TimeFrom(uhr.Add(2 * time.Hour))}))
+		assert.Equal(t, []string{"03"}, all(t, ShareFilter{Owner: owner, ExpiresBefore: null.TimeFrom(uhr.Add(30 * time.Hour))}))
+		assert.Empty(t, all(t, ShareFilter{Owner: null.StringFrom("nobody")}))
+	})
+
+	t.Run("without attachments", func(t *testing.T) {
+		page, _, err := FindShares(db, ShareFilter{Owner: owner, WithAttachments: false})
+		assert.Nil(t, err)
+		assert.Len(t, page, 4)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := FindShares(db, ShareFilter{Sort: "password"})
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+		_, _, err = FindShares(db, ShareFilter{Cursor: "kekw"})
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+		_, next, _ := FindShares(db, ShareFilter{Owner: owner, Limit: 1})
+		_, _, err = FindShares(db, ShareFilter{Owner: owner, Sort: "name", Cursor: next})
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+	})
+}
+
+func TestGetStats(t *testing.T) {
+	db, _ := GetDatabase()
+	before, err := GetStats(db)
+	assert.Nil(t, err)
+	shares := []Share{
+		{
+			ID:        uuid.MustParse("2e6c1f0a-3b5d-4e7f-8a9b-0c1d2e3f4a01"),
+			Name:      null.StringFrom("big"),
+			Password:  null.StringFrom("test123"),
+			Expires:   null.TimeFrom(time.Now().Add(time.Hour)),
+			Downloads: 3,
+			Attachments: []Attachment{
+				{ID: uuid.MustParse("2e6c1f0a-3b5d-4e7f-8a9b-0c1d2e3f4b01"), Filename: "a", Filesize: 1000},
+				{ID: uuid.MustParse("2e6c1f0a-3b5d-4e7f-8a9b-0c1d2e3f4b02"), Filename: "b", Filesize: 2000},
+			},
+		},
+		{
+			ID:          uuid.MustParse("2e6c1f0a-3b5d-4e7f-8a9b-0c1d2e3f4a02"),
+			IsTemporary: true,
+			Attachments: []Attachment{
+				{ID: uuid.MustParse("2e6c1f0a-3b5d-4e7f-8a9b-0c1d2e3f4b03"), Filename: "c", Filesize: 500},
+			},
+		},
+	}
+	for i := range shares {
+		db.Create(&shares[i])
+		defer db.Delete(&shares[i])
+	}
+
+	t.Run("happy path", func(t *testing.T) {
+		actual, err := GetStats(db)
+		// assertions
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, actual.NumberOfShares-before.NumberOfShares)
+		assert.EqualValues(t, 3, actual.NumberOfAttachments-before.NumberOfAttachments)
+		assert.EqualValues(t, 3500, actual.TotalSize-before.TotalSize)
+		assert.EqualValues(t, 3000, actual.FinalSize-before.FinalSize)
+		assert.EqualValues(t, 500, actual.TemporarySize-before.TemporarySize)
+		assert.EqualValues(t, 1, actual.PasswordProtected-before.PasswordProtected)
+		assert.EqualValues(t, 1, actual.ExpiringSoon-before.ExpiringSoon)
+		assert.NotEmpty(t, actual.SharesPerDay)
+		assert.Equal(t, time.Now().Format("2006-01-02"), actual.SharesPerDay[len(actual.SharesPerDay)-1].Day)
+		assert.Equal(t, shares[0].ID, actual.TopBySize[0].ID)
+		assert.EqualValues(t, 3000, actual.TopBySize[0].Size)
+		assert.Equal(t, shares[0].ID, actual.TopByDownloads[0].ID)
+		assert.EqualValues(t, 3, actual.TopByDownloads[0].Downloads)
+	})
+}
+
+func TestGetShareStats(t *testing.T) {
+	now := time.Now()
+
+	t.Run("happy path", func(t *testing.T) {
+		sh := Share{
+			Downloads:     3,
+			DownloadLimit: null.IntFrom(2),
+			Expires:       null.TimeFrom(now.Add(time.Hour)),
+			Attachments:   []Attachment{{Filesize: 1000}, {Filesize: 2000}},
+		}
+		actual := GetShareStats(sh, now)
+		// assertions
+		assert.EqualValues(t, 3, actual.Downloads)
+		assert.Equal(t, null.IntFrom(2), actual.RemainingDownloads)
+		assert.Equal(t, 2, actual.NumberOfAttachments)
+		assert.EqualValues(t, 3000, actual.TotalSize)
+		assert.Equal(t, 1500.0, actual.AverageFileSize)
+		assert.Equal(t, null.IntFrom(2000), actual.LargestFile)
+		assert.Equal(t, null.IntFrom(3600), actual.ExpiresIn)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		actual := GetShareStats(Share{}, now)
+		// assertions
+		assert.False(t, actual.RemainingDownloads.Valid)
+		assert.False(t, actual.LargestFile.Valid)
+		assert.False(t, actual.ExpiresIn.Valid)
+		assert.Zero(t, actual.AverageFileSize)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		actual := GetShareStats(Share{Expires: null.TimeFrom(now.Add(-time.Hour)), DownloadLimit: null.IntFrom(0)}, now)
+		// assertions
+		assert.Equal(t, null.IntFrom(0), actual.ExpiresIn)
+		assert.Equal(t, null.IntFrom(0), actual.RemainingDownloads)
+	})
+}
+
 ////////////////////////////////////////////
 ///////////// Attachment////////////////////
 ////////////////////////////////////////////
@@ -94,3 +541,466 @@ func TestUpdateAttachment(t *testing.T) {
 func TestDeleteAttachment(t *testing.T) {
 	return
 }
+
+////////////////////////////////////////////
+///////////// Unit of Work /////////////////
+////////////////////////////////////////////
+
+// faultyFS fails renames to or from paths containing failOn
+type faultyFS struct {
+	osFS
+	failOn string
+}
+
+func (f faultyFS) Rename(oldpath, newpath string) error {
+	if strings.Contains(oldpath, f.failOn) || strings.Contains(newpath, f.failOn) {
+		return errors.New("injected fault")
+	}
+	return f.osFS.Rename(oldpath, newpath)
+}
+
+func TestUnitOfWork(t *testing.T) {
+	db, _ := GetDatabase()
+	staging := filepath.Join(os.Getenv("MEDIA_DIR"), "staging")
+	stagingEmpty := func(t *testing.T) {
+		entries, _ := ioutil.ReadDir(staging)
+		assert.Empty(t, entries)
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		sh := Share{ID: uuid.MustParse("7b0e2f4c-8a61-4d4b-9d3e-1f2a3b4c5d01"), IsTemporary: true}
+		att := Attachment{ID: uuid.MustParse("7b0e2f4c-8a61-4d4b-9d3e-1f2a3b4c5d02"), ShareID: sh.ID, Filename: "pog.txt"}
+		err := Transaction(db, func(uow *UnitOfWork) error {
+			if err := uow.DB().Create(&sh).Error; err != nil {
+				return err
+			}
+			assert.NoDirExists(t, sh.Dir()) // not before commit
+			if err := uow.DB().Create(&att).Error; err != nil {
+				return err
+			}
+			_, err := uow.WriteFile(filepath.Join(sh.Dir(), att.ID.String()), strings.NewReader("POG"))
+			return err
+		})
+		defer db.Delete(&sh)
+		// assertions
+		assert.Nil(t, err)
+		assert.FileExists(t, filepath.Join(sh.Dir(), att.ID.String()))
+		stagingEmpty(t)
+	})
+
+	t.Run("failing function", func(t *testing.T) {
+		sh := Share{ID: uuid.MustParse("7b0e2f4c-8a61-4d4b-9d3e-1f2a3b4c5d03"), IsTemporary: true}
+		err := Transaction(db, func(uow *UnitOfWork) error {
+			if err := uow.DB().Create(&sh).Error; err != nil {
+				return err
+			}
+			if _, err := uow.WriteFile(filepath.Join(sh.Dir(), "file"), strings.NewReader("POG")); err != nil {
+				return err
+			}
+			return errors.New("something went wrong")
+		})
+		// assertions
+		assert.NotNil(t, err)
+		assert.NoDirExists(t, sh.Dir())
+		var count int64
+		db.Model(&Share{}).Where("id = ?", sh.ID.String()).Count(&count)
+		assert.EqualValues(t, 0, count)
+		stagingEmpty(t)
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		sh := Share{ID: uuid.MustParse("7b0e2f4c-8a61-4d4b-9d3e-1f2a3b4c5d06"), IsTemporary: true}
+		db.Create(&sh)
+		defer db.Delete(&sh)
+		// finalized or deleted while uploading
+		_ = os.RemoveAll(sh.Dir())
+		err := Transaction(db, func(uow *UnitOfWork) error {
+			_, err := uow.WriteFile(filepath.Join(sh.Dir(), "file"), strings.NewReader("POG"))
+			return err
+		})
+		// assertions
+		assert.ErrorIs(t, err, ErrMissingDirectory)
+		assert.NoDirExists(t, sh.Dir())
+		stagingEmpty(t)
+	})
+
+	t.Run("failing file operation", func(t *testing.T) {
+		sh := Share{ID: uuid.MustParse("7b0e2f4c-8a61-4d4b-9d3e-1f2a3b4c5d04"), IsTemporary: true}
+		db.Create(&sh)
+		defer db.Delete(&sh)
+		temp := sh.Dir()
+		_ = ioutil.WriteFile(filepath.Join(temp, "file"), []byte("POG"), os.ModePerm)
+		// the upload succeeds, finalizing fails
+		fs = faultyFS{failOn: filepath.Join("data", sh.ID.String())}
+		defer func() { fs = osFS{} }()
+		err := Transaction(db, func(uow *UnitOfWork) error {
+			if err := uow.DB().Model(&sh).Update("is_temporary", false).Error; err != nil {
+				return err
+			}
+			if _, err := uow.WriteFile(filepath.Join(temp, "file2"), strings.NewReader("POG")); err != nil {
+				return err
+			}
+			uow.Rename(temp, sh.Dir())
+			return nil
+		})
+		// assertions
+		assert.NotNil(t, err)
+		var actual Share
+		db.Where("id = ?", sh.ID.String()).First(&actual)
+		assert.True(t, actual.IsTemporary)
+		assert.FileExists(t, filepath.Join(temp, "file"))
+		assert.NoFileExists(t, filepath.Join(temp, "file2")) // compensated
+		assert.NoDirExists(t, filepath.Join(os.Getenv("MEDIA_DIR"), "data", sh.ID.String()))
+		stagingEmpty(t)
+		sh.IsTemporary = true
+	})
+
+	t.Run("failing delete", func(t *testing.T) {
+		sh := Share{ID: uuid.MustParse("7b0e2f4c-8a61-4d4b-9d3e-1f2a3b4c5d05")}
+		db.Create(&sh)
+		defer db.Delete(&sh)
+		// the directory gets moved away, but the next operation fails
+		fs = faultyFS{failOn: "never-there"}
+		defer func() { fs = osFS{} }()
+		err := Transaction(db, func(uow *UnitOfWork) error {
+			if err := uow.DB().Delete(&sh).Error; err != nil {
+				return err
+			}
+			uow.Rename(filepath.Join(os.Getenv("MEDIA_DIR"), "never-there"), filepath.Join(os.Getenv("MEDIA_DIR"), "x"))
+			return nil
+		})
+		// assertions
+		assert.NotNil(t, err)
+		assert.DirExists(t, sh.Dir())
+		var count int64
+		db.Model(&Share{}).Where("id = ?", sh.ID.String()).Count(&count)
+		assert.EqualValues(t, 1, count)
+		stagingEmpty(t)
+	})
+
+	t.Run("failing mkdir", func(t *testing.T) {
+		// a file where the directory should be
+		sh := Share{ID: uuid.MustParse("7b0e2f4c-8a61-4d4b-9d3e-1f2a3b4c5d06"), IsTemporary: true}
+		_ = ioutil.WriteFile(sh.Dir(), []byte("in the way"), os.ModePerm)
+		defer os.Remove(sh.Dir())
+		// without unit of work
+		err := db.Create(&sh).Error
+		assert.NotNil(t, err)
+		// with unit of work
+		err = Transaction(db, func(uow *UnitOfWork) error {
+			return uow.DB().Create(&sh).Error
+		})
+		assert.NotNil(t, err)
+		var count int64
+		db.Model(&Share{}).Where("id = ?", sh.ID.String()).Count(&count)
+		assert.EqualValues(t, 0, count)
+	})
+}
+
+func TestUploadRequest(t *testing.T) {
+	db, _ := GetDatabase()
+	now := time.Date(2020, 01, 01, 17, 17, 17, 0, time.UTC)
+
+	t.Run("happy path", func(t *testing.T) {
+		ur := UploadRequest{MaxShares: null.IntFrom(2)}
+		err := db.Create(&ur).Error
+		defer db.Delete(&ur)
+		// assertions
+		assert.Nil(t, err)
+		assert.NotEmpty(t, ur.Token)
+		assert.NotEqual(t, ur.Token, ur.TokenHash)
+		found, err := FindUploadRequest(db, ur.Token)
+		assert.Nil(t, err)
+		assert.Equal(t, ur.ID, found.ID)
+		_, err = FindUploadRequest(db, ur.TokenHash)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	})
+
+	t.Run("open", func(t *testing.T) {
+		assert.Nil(t, UploadRequest{}.Open(now))
+		assert.Nil(t, UploadRequest{MaxShares: null.IntFrom(2), Shares: 1, Expires: null.TimeFrom(now.Add(time.Hour))}.Open(now))
+		assert.ErrorIs(t, UploadRequest{MaxShares: null.IntFrom(2), Shares: 2}.Open(now), ErrUploadRequestClosed)
+		assert.ErrorIs(t, UploadRequest{Expires: null.TimeFrom(now)}.Open(now), ErrUploadRequestClosed)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, ur := range []UploadRequest{
+			{Expires: null.TimeFrom(now.Add(-time.Hour))},
+			{MaxFiles: null.IntFrom(0)},
+			{MaxSize: null.IntFrom(-1)},
+			{OwnerEmail: null.StringFrom("nope")},
+		} {
+			assert.ErrorIs(t, ur.Validate(now), ErrInvalidUploadRequest)
+		}
+	})
+}
+
+func TestConnect(t *testing.T) {
+	// own database, closing the shared one would drop the tables of the other tests
+	saved, old := db, conf
+	defer func() {
+		db = saved
+		Configure(old)
+	}()
+	db = nil
+	c := old
+	c.Database.Dialect, c.Database.URI = "sqlite", "file:connect?mode=memory&cache=shared"
+	Configure(c)
+
+	t.Run("happy path", func(t *testing.T) {
+		err := Connect(context.Background())
+		assert.Nil(t, err)
+		first, _ := GetDatabase()
+		second, _ := GetDatabase()
+		assert.Same(t, first, second)
+		// closed pool gets replaced
+		assert.Nil(t, CloseDatabase())
+		third, _ := GetDatabase()
+		assert.NotSame(t, first, third)
+		assert.Nil(t, CloseDatabase())
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		defer CloseDatabase()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		conn, err := GetDatabaseContext(ctx)
+		assert.Nil(t, err)
+		var n int
+		err = conn.Raw("SELECT 1").Scan(&n).Error
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		defer CloseDatabase()
+		c.Database.Dialect, c.Database.URI = "postgres", "host=127.0.0.1 port=1 user=nobody dbname=none sslmode=disable connect_timeout=1"
+		Configure(c)
+		ctx, cancel := context.WithTimeout(context.Background(), 1200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := Connect(ctx)
+		assert.NotNil(t, err)
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Second)) // retried until the deadline
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	models := []interface{}{&Share{}, &Attachment{}, &Webhook{}, &WebhookDelivery{}, &UploadRequest{}, &AuditEntry{}}
+	// own database, the shared one is migrated already
+	conn, err := open(config.Database{Dialect: "sqlite", URI: "file:migrations?mode=memory&cache=shared", MaxIdleConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		sqlDB, _ := conn.DB()
+		_ = sqlDB.Close()
+	}()
+
+	t.Run("every dialect", func(t *testing.T) {
+		sqlite, err := loadMigrations("migrations/sqlite")
+		assert.Nil(t, err)
+		assert.NotEmpty(t, sqlite)
+		for _, dialect := range []string{"postgres", "mysql", "mssql"} {
+			migrations, err := loadMigrations("migrations/" + dialect)
+			assert.Nil(t, err)
+			assert.Equal(t, len(sqlite), len(migrations), dialect)
+			for i := range migrations {
+				assert.Equal(t, sqlite[i].Version, migrations[i].Version, dialect)
+				assert.Equal(t, sqlite[i].Name, migrations[i].Name, dialect)
+				// sqlite copies tables instead of dropping columns, the downs differ in length
+				assert.NotEmpty(t, statements(migrations[i].Down), dialect)
+			}
+		}
+	})
+
+	t.Run("statements", func(t *testing.T) {
+		stmts := statements("-- comment\nCREATE TABLE a (\n    id text\n);\n\nDROP TABLE b;\nSELECT 1")
+		assert.Equal(t, []string{"CREATE TABLE a (\n    id text\n);", "DROP TABLE b;", "SELECT 1"}, stmts)
+	})
+
+	t.Run("up", func(t *testing.T) {
+		assert.ErrorIs(t, CheckSchema(conn), ErrSchemaOutdated)
+		ran, err := MigrateUp(conn)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, ran)
+		assert.Nil(t, CheckSchema(conn))
+		// nothing left to do
+		ran, err = MigrateUp(conn)
+		assert.Nil(t, err)
+		assert.Empty(t, ran)
+		status, err := GetMigrationStatus(conn)
+		assert.Nil(t, err)
+		for _, s := range status {
+			assert.NotNil(t, s.AppliedAt, s.Name)
+		}
+	})
+
+	t.Run("schema matches the models", func(t *testing.T) {
+		for _, model := range models {
+			stmt := &gorm.Statement{DB: conn}
+			if err := stmt.Parse(model); err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, conn.Migrator().HasTable(model), stmt.Schema.Table)
+			for _, field := range stmt.Schema.Fields {
+				if field.DBName != "" {
+					assert.True(t, conn.Migrator().HasColumn(model, field.DBName), stmt.Schema.Table+"."+field.DBName)
+				}
+			}
+			for name := range stmt.Schema.ParseIndexes() {
+				assert.True(t, conn.Migrator().HasIndex(model, name), name)
+			}
+		}
+	})
+
+	t.Run("down", func(t *testing.T) {
+		all, _ := Migrations(conn)
+		reverted, err := MigrateDown(conn, len(all)+1)
+		assert.Nil(t, err)
+		assert.Len(t, reverted, len(all))
+		for _, model := range models {
+			assert.False(t, conn.Migrator().HasTable(model))
+		}
+		assert.ErrorIs(t, CheckSchema(conn), ErrSchemaOutdated)
+		// and up again
+		_, err = MigrateUp(conn)
+		assert.Nil(t, err)
+		assert.Nil(t, CheckSchema(conn))
+	})
+
+	t.Run("newer schema", func(t *testing.T) {
+		future := SchemaMigration{Version: 9999, Name: "future", AppliedAt: time.Now()}
+		conn.Create(&future)
+		defer conn.Delete(&future)
+		assert.ErrorIs(t, CheckSchema(conn), ErrSchemaNewer)
+	})
+
+	t.Run("baseline", func(t *testing.T) {
+		_, err := Baseline(conn, 1)
+		assert.NotNil(t, err) // has migrations already
+		all, _ := Migrations(conn)
+		_, _ = MigrateDown(conn, len(all))
+
+		// schema of -auto-migrate before owners, webhooks and upload requests
+		type legacyShare struct {
+			ID            string `gorm:"primaryKey"`
+			CreatedAt     time.Time
+			UpdatedAt     time.Time
+			Name          string
+			Expires       *time.Time
+			DownloadLimit *int
+			IsPublic      bool `gorm:"not null;default:false;index:idx_shares_is_public"`
+			Password      string
+			IsTemporary   bool
+		}
+		type legacyAttachment struct {
+			ID       string `gorm:"primaryKey"`
+			Filename string `gorm:"not null"`
+			Filesize int64  `gorm:"not null;default:0"`
+			ShareID  string `gorm:"not null"`
+		}
+		assert.Nil(t, conn.Table("shares").AutoMigrate(&legacyShare{}))
+		assert.Nil(t, conn.Table("attachments").AutoMigrate(&legacyAttachment{}))
+		assert.Nil(t, conn.Table("shares").Create(&legacyShare{ID: "5713d228-a042-446d-a5e4-183b19fa832a", Name: "old"}).Error)
+		marked, err := Baseline(conn, 1)
+		assert.Nil(t, err)
+		assert.Len(t, marked, 1)
+		_, err = MigrateUp(conn)
+		assert.Nil(t, err)
+		assert.Nil(t, CheckSchema(conn))
+		var sh Share
+		assert.Nil(t, conn.First(&sh, "id = ?", "5713d228-a042-446d-a5e4-183b19fa832a").Error)
+		assert.Equal(t, "old", sh.Name.String)
+		assert.Equal(t, int64(0), sh.Downloads)
+		assert.True(t, conn.Migrator().HasTable(&UploadRequest{}))
+
+		// schema of -auto-migrate of a build with them, before the audit log
+		all, _ = Migrations(conn)
+		_, _ = MigrateDown(conn, len(all))
+		assert.Nil(t, conn.AutoMigrate(models[:5]...))
+		marked, err = Baseline(conn, 2)
+		assert.Nil(t, err)
+		assert.Len(t, marked, 2)
+		_, err = MigrateUp(conn)
+		assert.Nil(t, err)
+		assert.Nil(t, CheckSchema(conn))
+		assert.True(t, conn.Migrator().HasTable(&AuditEntry{}))
+	})
+}
+
+func TestAudit(t *testing.T) {
+	db, _ := GetDatabase()
+	uhr := time.Date(2020, 01, 01, 17, 17, 17, 0, time.UTC)
+	shareID := uuid.MustParse("c4a1e3b2-7d5f-4e6a-9b8c-0d1e2f3a4b01")
+	entries := []AuditEntry{
+		{ID: uuid.MustParse("c4a1e3b2-7d5f-4e6a-9b8c-0d1e2f3a4c01"), CreatedAt: uhr, Actor: ActorOwner, Action: AuditShareFinalize, ShareID: shareID},
+		{ID: uuid.MustParse("c4a1e3b2-7d5f-4e6a-9b8c-0d1e2f3a4c02"), CreatedAt: uhr.Add(time.Hour), Actor: ActorAdmin, Action: AuditShareUpdate, ShareID: shareID, Changes: Changes{"name": {Before: "a", After: "b"}}},
+		{ID: uuid.MustParse("c4a1e3b2-7d5f-4e6a-9b8c-0d1e2f3a4c03"), CreatedAt: uhr.Add(time.Hour), Actor: ActorAdmin, Action: AuditShareDelete, ShareID: shareID},
+		{ID: uuid.MustParse("c4a1e3b2-7d5f-4e6a-9b8c-0d1e2f3a4c04"), CreatedAt: uhr.Add(2 * time.Hour), Actor: ActorSystem, Action: AuditShareDeleted, ShareID: shareID},
+	}
+	for i := range entries {
+		assert.Nil(t, Audit(db, entries[i]))
+	}
+	defer db.Where("share_id = ?", shareID.String()).Delete(&AuditEntry{})
+	// walks through all pages
+	all := func(t *testing.T, f AuditFilter) []string {
+		var res []string
+		f.ShareID = null.StringFrom(shareID.String())
+		for i := 0; i < 10; i++ {
+			page, next, err := FindAuditEntries(db, f)
+			assert.Nil(t, err)
+			for _, e := range page {
+				res = append(res, e.ID.String()[34:])
+			}
+			if next == "" {
+				break
+			}
+			f.Cursor = next
+		}
+		return res
+	}
+
+	t.Run("diff", func(t *testing.T) {
+		before := Share{ID: shareID, Name: null.StringFrom("a"), Password: null.StringFrom("$2a$10$hash")}
+		after := before
+		after.Name = null.StringFrom("b")
+		after.Password = null.StringFrom("$2a$10$other")
+		changes, err := ShareDiff(&before, &after)
+		assert.Nil(t, err)
+		assert.Equal(t, Change{Before: "a", After: "b"}, changes["name"])
+		assert.Equal(t, Change{Before: "[REDACTED]", After: "[REDACTED]"}, changes["password"])
+		after.Password = before.Password
+		unchanged, err := ShareDiff(&before, &after)
+		assert.Nil(t, err)
+		assert.NotContains(t, unchanged, "password")
+		deleted, err := ShareDiff(&before, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, Change{Before: "[REDACTED]"}, deleted["password"])
+	})
+
+	t.Run("sort and paginate", func(t *testing.T) {
+		assert.Equal(t, []string{"04", "03", "02", "01"}, all(t, AuditFilter{Limit: 1}))
+		assert.Equal(t, []string{"04", "03", "02", "01"}, all(t, AuditFilter{Limit: 3}))
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		assert.Equal(t, []string{"03", "02"}, all(t, AuditFilter{Actor: null.StringFrom(ActorAdmin)}))
+		assert.Equal(t, []string{"01"}, all(t, AuditFilter{Action: null.StringFrom(AuditShareFinalize)}))
+		assert.Equal(t, []string{"03", "02"}, all(t, AuditFilter{Since: null.TimeFrom(uhr.Add(time.Hour)), Until: null.TimeFrom(uhr.Add(2 * time.Hour))}))
+		_, _, err := FindAuditEntries(db, AuditFilter{Cursor: "kekw"})
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+	})
+
+	t.Run("changes", func(t *testing.T) {
+		var e AuditEntry
+		assert.Nil(t, db.First(&e, "id = ?", entries[1].ID.String()).Error)
+		assert.Equal(t, entries[1].Changes, e.Changes)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		n, err := PruneAuditLog(db, time.Since(uhr.Add(90*time.Minute)))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(3), n)
+		assert.Equal(t, []string{"04"}, all(t, AuditFilter{}))
+	})
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/guregu/null.v4"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const maxNameLength = 255
+
+var (
+	ErrInvalidPatch = errors.New("invalid patch")
+	ErrInvalidEmail = errors.New("invalid email address")
+)
+
+// PatchableFields are the columns ApplyPatch can change
+var PatchableFields = []string{"name", "expires", "download_limit", "is_public", "password", "owner_email"}
+
+// ApplyPatch applies a JSON merge patch (RFC 7386) to the share. Only the PatchableFields can be changed,
+// null removes a value. A new password gets hashed.
+func (sh *Share) ApplyPatch(patch []byte, now time.Time) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil || fields == nil {
+		return fmt.Errorf("%w: body has to be a JSON object", ErrInvalidPatch)
+	}
+	for key, value := range fields {
+		isNull := bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+		switch key {
+		case "name":
+			var name null.String
+			if err := json.Unmarshal(value, &name); err != nil {
+				return fmt.Errorf("%w: name has to be a string", ErrInvalidPatch)
+			}
+			name.String = strings.TrimSpace(name.String)
+			if name.Valid && (name.String == "" || len(name.String) > maxNameLength) {
+				return fmt.Errorf("%w: name has to have 1 to %d characters", ErrInvalidPatch, maxNameLength)
+			}
+			sh.Name = name
+		case "expires":
+			var expires null.Time
+			if err := json.Unmarshal(value, &expires); err != nil {
+				return fmt.Errorf("%w: expires has to be an RFC 3339 timestamp", ErrInvalidPatch)
+			}
+			if expires.Valid && !expires.Time.After(now) {
+				return fmt.Errorf("%w: expires has to be in the future", ErrInvalidPatch)
+			}
+			if !expires.Equal(sh.Expires) {
+				sh.ReminderSent = false
+			}
+			sh.Expires = expires
+		case "download_limit":
+			var limit null.Int
+			if err := json.Unmarshal(value, &limit); err != nil {
+				return fmt.Errorf("%w: download_limit has to be an integer", ErrInvalidPatch)
+			}
+			if limit.Valid && limit.Int64 < 0 {
+				return fmt.Errorf("%w: download_limit can't be negative", ErrInvalidPatch)
+			}
+			sh.DownloadLimit = limit
+		case "is_public":
+			var public bool
+			if err := json.Unmarshal(value, &public); err != nil || isNull {
+				return fmt.Errorf("%w: is_public has to be a boolean", ErrInvalidPatch)
+			}
+			sh.IsPublic = public
+		case "password":
+			var password null.String
+			if err := json.Unmarshal(value, &password); err != nil {
+				return fmt.Errorf("%w: password has to be a string", ErrInvalidPatch)
+			}
+			if password.Valid && password.String == "" {
+				return fmt.Errorf("%w: password can't be empty, use null to remove it", ErrInvalidPatch)
+			}
+			if password.Valid {
+				hash, err := hashPassword(password.String)
+				if err != nil {
+					return err
+				}
+				password.String = hash
+			}
+			sh.Password = password
+		case "owner_email":
+			var email null.String
+			if err := json.Unmarshal(value, &email); err != nil {
+				return fmt.Errorf("%w: owner_email has to be a string", ErrInvalidPatch)
+			}
+			if email.Valid {
+				if err := ValidateEmail(email.String); err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+				}
+			}
+			sh.OwnerEmail = email
+		default:
+			return fmt.Errorf("%w: %s can't be changed", ErrInvalidPatch, key)
+		}
+	}
+	return nil
+}
+
+// ValidateEmail accepts plain addresses like "user@example.com" only
+func ValidateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return fmt.Errorf("%w: %q", ErrInvalidEmail, email)
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Policy holds the server side limits every share has to obey. Zero values mean "no limit".
+type Policy struct {
+	DefaultExpiry        time.Duration
+	MaxExpiry            time.Duration
+	DefaultDownloadLimit int64
+	MaxDownloadLimit     int64
+	RequirePassword      bool
+}
+
+var ErrPolicyViolation = errors.New("share violates the server policy")
+
+// GetPolicy returns the configured share policy
+func GetPolicy() Policy {
+	return Policy(conf.Policy)
+}
+
+// Apply fills in the defaults and checks the limits of the policy at the time now, for new shares. Returns an error
+// wrapping ErrPolicyViolation if the share can't be accepted.
+func (p Policy) Apply(sh *Share, now time.Time) error {
+	// the maximum is measured from the creation of the share, the default from now
+	base := sh.CreatedAt
+	if base.IsZero() {
+		base = now
+	}
+	if !sh.Expires.Valid {
+		switch {
+		case p.DefaultExpiry > 0:
+			sh.Expires.SetValid(now.Add(p.DefaultExpiry))
+		case p.MaxExpiry > 0:
+			sh.Expires.SetValid(base.Add(p.MaxExpiry)) // no share lives forever
+		}
+		if p.MaxExpiry > 0 && sh.Expires.Time.After(base.Add(p.MaxExpiry)) {
+			sh.Expires.SetValid(base.Add(p.MaxExpiry))
+		}
+	}
+	if err := p.checkExpiry(*sh, base, now); err != nil {
+		return err
+	}
+	if !sh.DownloadLimit.Valid && p.DefaultDownloadLimit > 0 {
+		sh.DownloadLimit.SetValid(p.DefaultDownloadLimit)
+	}
+	if err := p.checkDownloadLimit(*sh); err != nil {
+		return err
+	}
+	return p.checkPassword(*sh)
+}
+
+// Check checks the limits of the policy at the time now for the fields an update changed from before to sh. Unlike
+// Apply it fills in no defaults, shares created before the policy keep what they have until they are changed.
+func (p Policy) Check(before, sh Share, now time.Time) error {
+	base := sh.CreatedAt
+	if base.IsZero() {
+		base = now
+	}
+	if !sh.Expires.Equal(before.Expires) {
+		if !sh.Expires.Valid && p.MaxExpiry > 0 {
+			return fmt.Errorf("%w: expiry can't be removed", ErrPolicyViolation)
+		}
+		if err := p.checkExpiry(sh, base, now); err != nil {
+			return err
+		}
+	}
+	if !sh.DownloadLimit.Equal(before.DownloadLimit) {
+		if err := p.checkDownloadLimit(sh); err != nil {
+			return err
+		}
+	}
+	if sh.IsPublic != before.IsPublic || !sh.Password.Equal(before.Password) {
+		return p.checkPassword(sh)
+	}
+	return nil
+}
+
+func (p Policy) checkExpiry(sh Share, base, now time.Time) error {
+	if sh.Expires.Valid && !sh.Expires.Time.After(now) {
+		return fmt.Errorf("%w: expiry has to be in the future", ErrPolicyViolation)
+	}
+	if sh.Expires.Valid && p.MaxExpiry > 0 && sh.Expires.Time.After(base.Add(p.MaxExpiry)) {
+		return fmt.Errorf("%w: expiry can't be more than %s after creation", ErrPolicyViolation, p.MaxExpiry)
+	}
+	return nil
+}
+
+func (p Policy) checkDownloadLimit(sh Share) error {
+	if sh.DownloadLimit.Valid && sh.DownloadLimit.Int64 < 0 {
+		return fmt.Errorf("%w: download limit can't be negative", ErrPolicyViolation)
+	}
+	if sh.DownloadLimit.Valid && p.MaxDownloadLimit > 0 && sh.DownloadLimit.Int64 > p.MaxDownloadLimit {
+		return fmt.Errorf("%w: download limit can't be more than %d", ErrPolicyViolation, p.MaxDownloadLimit)
+	}
+	return nil
+}
+
+func (p Policy) checkPassword(sh Share) error {
+	if p.RequirePassword && !sh.IsPublic && (!sh.Password.Valid || sh.Password.String == "") {
+		return fmt.Errorf("%w: non-public shares need a password", ErrPolicyViolation)
+	}
+	return nil
+}
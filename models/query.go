@@ -0,0 +1,201 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"gopkg.in/guregu/null.v4"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ShareFilter describes which shares FindShares returns and in which order. Unset fields don't filter.
+type ShareFilter struct {
+	Search        string // case insensitive, part of the name
+	CreatedAfter  null.Time
+	CreatedBefore null.Time
+	ExpiresAfter  null.Time
+	ExpiresBefore null.Time
+	Public        null.Bool
+	Temporary     null.Bool
+	HasPassword   null.Bool
+	Owner         null.String
+
+	Sort            string // created_at, name or expires, prefixed with "-" for descending order
+	Limit           int
+	Cursor          string // returned by the previous FindShares call
+	WithAttachments bool
+}
+
+// sortable columns with the value NULLs are sorted as
+var sortColumns = map[string]interface{}{
+	"created_at": nil,
+	"name":       "",
+	"expires":    time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC),
+}
+
+type cursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    uuid.UUID       `json:"id"`
+}
+
+// FindShares returns one page of shares matching the filter and the cursor of the next page ("" if it's the last one)
+func FindShares(db *gorm.DB, f ShareFilter) ([]Share, string, error) {
+	// sorting
+	if f.Sort == "" {
+		f.Sort = "created_at"
+	}
+	column, desc := strings.TrimPrefix(f.Sort, "-"), strings.HasPrefix(f.Sort, "-")
+	nullValue, ok := sortColumns[column]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: can't sort by %q", ErrInvalidQuery, column)
+	}
+	expr := column
+	if nullValue != nil {
+		expr = fmt.Sprintf("COALESCE(%s, ?)", column)
+	}
+	order, cmp := "ASC", ">"
+	if desc {
+		order, cmp = "DESC", "<"
+	}
+	if f.Limit <= 0 {
+		f.Limit = DefaultPageSize
+	}
+	if f.Limit > MaxPageSize {
+		f.Limit = MaxPageSize
+	}
+
+	// filters
+	tx := db.Model(&Share{})
+	if f.Search != "" {
+		pattern := "%" + strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(f.Search)) + "%"
+		tx = tx.Where("LOWER(name) LIKE ? ESCAPE '!'", pattern)
+	}
+	if f.CreatedAfter.Valid {
+		tx = tx.Where("created_at >= ?", f.CreatedAfter.Time)
+	}
+	if f.CreatedBefore.Valid {
+		tx = tx.Where("created_at < ?", f.CreatedBefore.Time)
+	}
+	if f.ExpiresAfter.Valid {
+		tx = tx.Where("expires >= ?", f.ExpiresAfter.Time)
+	}
+	if f.ExpiresBefore.Valid {
+		tx = tx.Where("expires < ?", f.ExpiresBefore.Time)
+	}
+	if f.Public.Valid {
+		tx = tx.Where("is_public = ?", f.Public.Bool)
+	}
+	if f.Temporary.Valid {
+		tx = tx.Where("is_temporary = ?", f.Temporary.Bool)
+	}
+	if f.HasPassword.Valid {
+		if f.HasPassword.Bool {
+			tx = tx.Where("password IS NOT NULL")
+		} else {
+			tx = tx.Where("password IS NULL")
+		}
+	}
+	if f.Owner.Valid {
+		tx = tx.Where("owner = ?", f.Owner.String)
+	}
+
+	// keyset pagination: continue after the last row of the previous page
+	var exprVars []interface{}
+	if nullValue != nil {
+		exprVars = []interface{}{nullValue}
+	}
+	if f.Cursor != "" {
+		value, id, err := decodeCursor(f.Cursor, column)
+		if err != nil {
+			return nil, "", err
+		}
+		var vars []interface{}
+		vars = append(vars, exprVars...)
+		vars = append(vars, value)
+		vars = append(vars, exprVars...)
+		vars = append(vars, value, id.String())
+		tx = tx.Where(fmt.Sprintf("((%s %s ?) OR (%s = ? AND id %s ?))", expr, cmp, expr, cmp), vars...)
+	}
+	tx = tx.Clauses(clause.OrderBy{Expression: clause.Expr{
+		SQL:  fmt.Sprintf("%s %s, id %s", expr, order, order),
+		Vars: exprVars,
+	}})
+	if f.WithAttachments {
+		tx = tx.Preload("Attachments")
+	}
+
+	// fetch one more to know if there is a next page
+	var shares []Share
+	if err := tx.Limit(f.Limit + 1).Find(&shares).Error; err != nil {
+		return nil, "", err
+	}
+	if len(shares) <= f.Limit {
+		return shares, "", nil
+	}
+	shares = shares[:f.Limit]
+	next, err := encodeCursor(shares[len(shares)-1], column)
+	return shares, next, err
+}
+
+func encodeCursor(sh Share, column string) (string, error) {
+	var value interface{}
+	switch column {
+	case "created_at":
+		value = sh.CreatedAt
+	case "name":
+		value = sh.Name.ValueOrZero()
+	case "expires":
+		value = sortColumns["expires"]
+		if sh.Expires.Valid {
+			value = sh.Expires.Time
+		}
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(cursor{Sort: column, Value: v, ID: sh.ID})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(s string, column string) (interface{}, uuid.UUID, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return nil, uuid.Nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	if c.Sort != column {
+		return nil, uuid.Nil, fmt.Errorf("%w: cursor doesn't match sort order", ErrInvalidQuery)
+	}
+	if column == "name" {
+		var name string
+		if err := json.Unmarshal(c.Value, &name); err != nil {
+			return nil, uuid.Nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+		}
+		return name, c.ID, nil
+	}
+	var t time.Time
+	if err := json.Unmarshal(c.Value, &t); err != nil {
+		return nil, uuid.Nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+	return t, c.ID, nil
+}
@@ -3,10 +3,8 @@ package models
 import (
 	"encoding/json"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/guregu/null.v4"
 	"gorm.io/gorm"
-	"os"
 	"path/filepath"
 	"time"
 )
@@ -17,12 +15,19 @@ type Share struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"-"`
 
-	Name          null.String `json:"name,omitempty"`
-	Expires       null.Time   `json:"expires,omitempty"`
-	DownloadLimit null.Int    `json:"download_limit,omitempty"`
-	IsPublic      bool        `json:"is_public"  gorm:"not null; default:false; index"`
-	Password      null.String `json:"password,omitempty"`
-	IsTemporary   bool        `json:"is_temporary,omitempty"`
+	Name            null.String `json:"name,omitempty"`
+	Expires         null.Time   `json:"expires,omitempty"`
+	DownloadLimit   null.Int    `json:"download_limit,omitempty"`
+	IsPublic        bool        `json:"is_public"  gorm:"not null; default:false; index"`
+	Password        null.String `json:"password,omitempty"`
+	IsTemporary     bool        `json:"is_temporary,omitempty"`
+	Owner           null.String `json:"owner,omitempty"  gorm:"index"`
+	Downloads       int64       `json:"downloads"  gorm:"not null; default:0"`
+	DeletionTask    null.String `json:"-"` // key of the scheduled share:delete task
+	OwnerEmail      null.String `json:"owner_email,omitempty"`
+	ReminderSent    bool        `json:"-"  gorm:"not null; default:false"` // owner got the expiry reminder
+	UploadRequestID null.String `json:"upload_request_id,omitempty"  gorm:"index"`
+	ManagementHash  string      `json:"-"  gorm:"size:64"` // hash of the token returned by OpenShare
 
 	Attachments []Attachment `json:"files,omitempty"  gorm:"constraint:OnDelete:CASCADE"`
 }
@@ -39,6 +44,25 @@ func (sh *Share) Secure() {
 	if sh.Password.Valid {
 		sh.Password.SetValid("")
 	}
+	sh.OwnerEmail = null.String{}
+}
+
+// state returns the name of the directory the share has to be in
+func (sh Share) state() string {
+	if sh.IsTemporary {
+		return "temp"
+	}
+	return "data"
+}
+
+// Dir returns the path of the directory holding the attachments of the share
+func (sh Share) Dir() string {
+	return filepath.Join(MediaDir(), sh.state(), sh.ID.String())
+}
+
+// IsExpired returns true if the share has an expiry which is before now
+func (sh Share) IsExpired(now time.Time) bool {
+	return sh.Expires.Valid && sh.Expires.Time.Before(now)
 }
 
 func (sh *Share) BeforeCreate(tx *gorm.DB) error {
@@ -46,29 +70,20 @@ func (sh *Share) BeforeCreate(tx *gorm.DB) error {
 	if sh.ID.String() == "00000000-0000-0000-0000-000000000000" {
 		uid, err := uuid.NewRandom()
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 		sh.ID = uid
 	}
-	// create temporary dir
-	if sh.IsTemporary == true {
-		if err := os.MkdirAll(filepath.Join(os.Getenv("MEDIA_DIR"), "temp", sh.ID.String()), os.ModePerm); err != nil {
-			tx.Rollback()
-			return nil
-		}
-	} else {
-		if err := os.MkdirAll(filepath.Join(os.Getenv("MEDIA_DIR"), "data", sh.ID.String()), os.ModePerm); err != nil {
-			tx.Rollback()
-			return nil
-		}
+	// create (temporary) dir
+	if err := mkdirAll(tx, sh.Dir()); err != nil {
+		return err
 	}
 	// hash password
 	if sh.Password.Valid {
-		if hash, err := bcrypt.GenerateFromPassword([]byte(sh.Password.ValueOrZero()), bcrypt.DefaultCost); err != nil {
+		if hash, err := hashPassword(sh.Password.ValueOrZero()); err != nil {
 			return err
 		} else {
-			sh.Password.SetValid(string(hash))
+			sh.Password.SetValid(hash)
 		}
 	}
 	// return
@@ -76,16 +91,9 @@ func (sh *Share) BeforeCreate(tx *gorm.DB) error {
 }
 
 func (sh *Share) BeforeDelete(tx *gorm.DB) error {
-	if sh.IsTemporary == false {
-		if err := os.RemoveAll(filepath.Join(os.Getenv("MEDIA_DIR"), "data", sh.ID.String())); err != nil {
-			tx.Rollback()
-			return err
-		}
-	} else {
-		if err := os.RemoveAll(filepath.Join(os.Getenv("MEDIA_DIR"), "temp", sh.ID.String())); err != nil {
-			tx.Rollback()
-			return err
-		}
+	// the attachment rows go with the share, their files with the directory
+	if err := tx.Exec("DELETE FROM attachments WHERE share_id = ?", sh.ID.String()).Error; err != nil {
+		return err
 	}
-	return nil
+	return removeAll(tx, sh.Dir())
 }
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gopkg.in/guregu/null.v4"
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	statsDays       = 30             // how far back shares per day go
+	statsTop        = 10             // length of the top lists
+	statsExpiringIn = 24 * time.Hour // what counts as expiring soon
+)
+
+type DayCount struct {
+	Day   string `json:"day"`
+	Count int64  `json:"count"`
+}
+
+type TopShare struct {
+	ID        uuid.UUID   `json:"id"`
+	Name      null.String `json:"name"`
+	Size      int64       `json:"size"`
+	Downloads int64       `json:"downloads"`
+}
+
+type Stats struct {
+	NumberOfShares      int64      `json:"number_of_shares"`
+	NumberOfAttachments int64      `json:"number_of_attachments"`
+	TotalSize           int64      `json:"total_size"`
+	TemporarySize       int64      `json:"temporary_size"`
+	FinalSize           int64      `json:"final_size"`
+	AverageFileSize     float64    `json:"average_file_size"`
+	PasswordProtected   int64      `json:"password_protected"`
+	ExpiringSoon        int64      `json:"expiring_soon"` // within the next 24 hours
+	SharesPerDay        []DayCount `json:"shares_per_day"`
+	TopBySize           []TopShare `json:"top_by_size"`
+	TopByDownloads      []TopShare `json:"top_by_downloads"`
+	GeneratedAt         time.Time  `json:"generated_at"`
+}
+
+// GetStats computes the global statistics with aggregate queries
+func GetStats(db *gorm.DB) (Stats, error) {
+	now := time.Now()
+	st := Stats{GeneratedAt: now, SharesPerDay: []DayCount{}, TopBySize: []TopShare{}, TopByDownloads: []TopShare{}}
+
+	if err := db.Model(&Share{}).Count(&st.NumberOfShares).Error; err != nil {
+		return st, err
+	}
+	if err := db.Model(&Share{}).Where("password IS NOT NULL").Count(&st.PasswordProtected).Error; err != nil {
+		return st, err
+	}
+	if err := db.Model(&Share{}).Where("is_temporary = ? AND expires >= ? AND expires < ?", false, now, now.Add(statsExpiringIn)).
+		Count(&st.ExpiringSoon).Error; err != nil {
+		return st, err
+	}
+
+	// attachments
+	var files struct {
+		Count   int64
+		Average float64
+	}
+	if err := db.Model(&Attachment{}).Select("COUNT(*) AS count, COALESCE(AVG(filesize), 0) AS average").Scan(&files).Error; err != nil {
+		return st, err
+	}
+	st.NumberOfAttachments, st.AverageFileSize = files.Count, files.Average
+
+	// bytes by state
+	var states []struct {
+		IsTemporary bool
+		Size        int64
+	}
+	err := db.Model(&Attachment{}).
+		Select("shares.is_temporary AS is_temporary, COALESCE(SUM(attachments.filesize), 0) AS size").
+		Joins("JOIN shares ON shares.id = attachments.share_id").
+		Group("shares.is_temporary").
+		Scan(&states).Error
+	if err != nil {
+		return st, err
+	}
+	for _, s := range states {
+		if s.IsTemporary {
+			st.TemporarySize += s.Size
+		} else {
+			st.FinalSize += s.Size
+		}
+	}
+	st.TotalSize = st.TemporarySize + st.FinalSize
+
+	// shares per day
+	day := dayExpression(db)
+	err = db.Model(&Share{}).
+		Select(day+" AS day, COUNT(*) AS count").
+		Where("created_at >= ?", now.AddDate(0, 0, -statsDays)).
+		Group(day).
+		Order("day").
+		Scan(&st.SharesPerDay).Error
+	if err != nil {
+		return st, err
+	}
+
+	// top lists
+	err = db.Model(&Share{}).
+		Select("shares.id AS id, shares.name AS name, shares.downloads AS downloads, SUM(attachments.filesize) AS size").
+		Joins("JOIN attachments ON attachments.share_id = shares.id").
+		Group("shares.id, shares.name, shares.downloads").
+		Order("size DESC").
+		Limit(statsTop).
+		Scan(&st.TopBySize).Error
+	if err != nil {
+		return st, err
+	}
+	err = db.Model(&Share{}).
+		Select("shares.id AS id, shares.name AS name, shares.downloads AS downloads, COALESCE(SUM(attachments.filesize), 0) AS size").
+		Joins("LEFT JOIN attachments ON attachments.share_id = shares.id").
+		Where("shares.downloads > ?", 0).
+		Group("shares.id, shares.name, shares.downloads").
+		Order("downloads DESC").
+		Limit(statsTop).
+		Scan(&st.TopByDownloads).Error
+	if err != nil {
+		return st, err
+	}
+
+	return st, nil
+}
+
+type ShareStats struct {
+	Downloads           int64     `json:"downloads"`
+	RemainingDownloads  null.Int  `json:"remaining_downloads"` // null = unlimited
+	NumberOfAttachments int       `json:"number_of_attachments"`
+	TotalSize           int64     `json:"total_size"`
+	AverageFileSize     float64   `json:"average_file_size"`
+	LargestFile         null.Int  `json:"largest_file"` // null without attachments
+	ExpiresIn           null.Int  `json:"expires_in"`   // seconds, null = never, 0 = expired
+	GeneratedAt         time.Time `json:"generated_at"`
+}
+
+// GetShareStats computes the statistics of a single share, its attachments have to be loaded
+func GetShareStats(sh Share, now time.Time) ShareStats {
+	st := ShareStats{Downloads: sh.Downloads, NumberOfAttachments: len(sh.Attachments), GeneratedAt: now}
+	if sh.DownloadLimit.Valid {
+		remaining := sh.DownloadLimit.Int64
+		if remaining < 0 {
+			remaining = 0
+		}
+		st.RemainingDownloads = null.IntFrom(remaining)
+	}
+	for _, att := range sh.Attachments {
+		st.TotalSize += att.Filesize
+		if !st.LargestFile.Valid || att.Filesize > st.LargestFile.Int64 {
+			st.LargestFile = null.IntFrom(att.Filesize)
+		}
+	}
+	if st.NumberOfAttachments > 0 {
+		st.AverageFileSize = float64(st.TotalSize) / float64(st.NumberOfAttachments)
+	}
+	if sh.Expires.Valid {
+		left := sh.Expires.Time.Sub(now)
+		if left < 0 {
+			left = 0
+		}
+		st.ExpiresIn = null.IntFrom(int64(left.Seconds()))
+	}
+	return st
+}
+
+// dayExpression returns the SQL formatting created_at as YYYY-MM-DD for the dialect of db
+func dayExpression(db *gorm.DB) string {
+	switch db.Dialector.Name() {
+	case "postgres":
+		return "TO_CHAR(created_at, 'YYYY-MM-DD')"
+	case "mysql":
+		return "DATE_FORMAT(created_at, '%Y-%m-%d')"
+	case "sqlserver":
+		return "CONVERT(VARCHAR(10), created_at, 23)"
+	default: // sqlite
+		return "date(created_at)"
+	}
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"errors"
+	"github.com/chiefsend/api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// tracePlugin records a span of each query, as child of the span in the context of the statement
+type tracePlugin struct{}
+
+const spanKey = "tracing:span"
+
+func (tracePlugin) Name() string {
+	return "tracing"
+}
+
+func (p tracePlugin) Initialize(conn *gorm.DB) error {
+	system := systemNames[conn.Dialector.Name()]
+	cb := conn.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("tracing:before_create", p.before("create", system)),
+		cb.Create().After("gorm:create").Register("tracing:after_create", p.after),
+		cb.Query().Before("gorm:query").Register("tracing:before_query", p.before("select", system)),
+		cb.Query().After("gorm:query").Register("tracing:after_query", p.after),
+		cb.Update().Before("gorm:update").Register("tracing:before_update", p.before("update", system)),
+		cb.Update().After("gorm:update").Register("tracing:after_update", p.after),
+		cb.Delete().Before("gorm:delete").Register("tracing:before_delete", p.before("delete", system)),
+		cb.Delete().After("gorm:delete").Register("tracing:after_delete", p.after),
+		cb.Row().Before("gorm:row").Register("tracing:before_row", p.before("row", system)),
+		cb.Row().After("gorm:row").Register("tracing:after_row", p.after),
+		cb.Raw().Before("gorm:raw").Register("tracing:before_raw", p.before("raw", system)),
+		cb.Raw().After("gorm:raw").Register("tracing:after_raw", p.after),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// systemNames maps the dialects to the db.system.name of the semantic conventions
+var systemNames = map[string]attribute.KeyValue{
+	"mysql":     semconv.DBSystemNameMySQL,
+	"postgres":  semconv.DBSystemNamePostgreSQL,
+	"sqlite":    semconv.DBSystemNameSQLite,
+	"sqlserver": semconv.DBSystemNameMicrosoftSQLServer,
+}
+
+func (tracePlugin) before(operation string, system attribute.KeyValue) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		name := operation
+		if tx.Statement.Table != "" {
+			name += " " + tx.Statement.Table
+		}
+		_, span := tracing.StartKind(tx.Statement.Context, name, trace.SpanKindClient,
+			system, semconv.DBOperationName(operation), semconv.DBCollectionName(tx.Statement.Table))
+		tx.InstanceSet(spanKey, span)
+	}
+}
+
+func (tracePlugin) after(tx *gorm.DB) {
+	v, ok := tx.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	// the statement with placeholders, never the values
+	span.SetAttributes(semconv.DBQueryText(tx.Statement.SQL.String()), attribute.Int64("db.rows_affected", tx.RowsAffected))
+	err := tx.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	tracing.End(span, err)
+}
@@ -0,0 +1,243 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// fileSystem is the part of the os package the unit of work uses. Tests swap it out to inject faults.
+type fileSystem interface {
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	RemoveAll(path string) error
+	Stat(name string) (os.FileInfo, error)
+}
+
+type osFS struct{}
+
+func (osFS) Create(name string) (io.WriteCloser, error)   { return os.Create(name) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+
+var fs fileSystem = osFS{}
+
+type uowKey struct{}
+
+// ErrMissingDirectory is returned if the directory a file is written to is gone, e.g. its share was finalized or deleted
+var ErrMissingDirectory = errors.New("directory doesn't exist")
+
+// fileOp is a staged file system operation
+type fileOp struct {
+	apply   func() error // done on commit
+	undo    func() error // reverts apply if the unit of work fails afterwards
+	finish  func() error // done after the database transaction has been committed (optional)
+	discard func() error // cleans up if apply never ran (optional)
+}
+
+// UnitOfWork pairs a database transaction with file operations. Files are written to MEDIA_DIR/staging first and
+// moved into place by a rename when the unit of work commits. Removed files are moved to staging and only deleted
+// once the database transaction is committed, so every step can be compensated if a later one fails.
+type UnitOfWork struct {
+	tx      *gorm.DB
+	staging string
+	staged  []fileOp
+	applied []fileOp
+}
+
+// Transaction runs fn in a unit of work. If fn returns an error, a staged file operation fails or the commit fails,
+// the database transaction is rolled back and all file operations are undone.
+func Transaction(db *gorm.DB, fn func(uow *UnitOfWork) error) error {
+	uow := &UnitOfWork{staging: filepath.Join(MediaDir(), "staging")}
+	if err := fs.MkdirAll(uow.staging, os.ModePerm); err != nil {
+		return err
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		ctx := tx.Statement.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		uow.tx = tx.WithContext(context.WithValue(ctx, uowKey{}, uow))
+		if err := fn(uow); err != nil {
+			return err
+		}
+		return uow.apply()
+	})
+	if err != nil {
+		uow.rollback()
+		return err
+	}
+	uow.finish()
+	return nil
+}
+
+// DB returns the database handle of the transaction. Hooks run through it stage their file operations on the unit of work.
+func (uow *UnitOfWork) DB() *gorm.DB {
+	return uow.tx
+}
+
+// WriteFile writes r to staging right away and moves it to path on commit. Returns the number of bytes written.
+// The directory of path has to exist by then, it is created with its share.
+func (uow *UnitOfWork) WriteFile(path string, r io.Reader) (int64, error) {
+	tmp := uow.tempPath()
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	discard := func() error { return fs.RemoveAll(tmp) }
+	if err != nil {
+		_ = discard()
+		return n, err
+	}
+	uow.staged = append(uow.staged, fileOp{
+		apply: func() error {
+			dir := filepath.Dir(path)
+			if fi, err := fs.Stat(dir); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+				return fmt.Errorf("%w: %s", ErrMissingDirectory, dir)
+			}
+			return fs.Rename(tmp, path)
+		},
+		undo:    func() error { return fs.Rename(path, tmp) },
+		discard: discard,
+	})
+	return n, nil
+}
+
+// Rename moves oldpath to newpath on commit
+func (uow *UnitOfWork) Rename(oldpath, newpath string) {
+	uow.staged = append(uow.staged, fileOp{
+		apply: func() error { return fs.Rename(oldpath, newpath) },
+		undo:  func() error { return fs.Rename(newpath, oldpath) },
+	})
+}
+
+// RemoveAll moves path to staging on commit and deletes it for good once the transaction is committed.
+// Paths that don't exist are ignored.
+func (uow *UnitOfWork) RemoveAll(path string) {
+	trash := uow.tempPath()
+	var moved bool
+	uow.staged = append(uow.staged, fileOp{
+		apply: func() error {
+			if _, err := fs.Stat(path); os.IsNotExist(err) {
+				return nil
+			}
+			if err := fs.Rename(path, trash); err != nil {
+				return err
+			}
+			moved = true
+			return nil
+		},
+		undo: func() error {
+			if !moved {
+				return nil
+			}
+			return fs.Rename(trash, path)
+		},
+		finish: func() error { return fs.RemoveAll(trash) },
+	})
+}
+
+// MkdirAll creates path on commit. Only directories which didn't exist before are removed again on failure.
+func (uow *UnitOfWork) MkdirAll(path string) {
+	var created bool
+	uow.staged = append(uow.staged, fileOp{
+		apply: func() error {
+			if fi, err := fs.Stat(path); err == nil && fi.IsDir() {
+				return nil
+			}
+			if err := fs.MkdirAll(path, os.ModePerm); err != nil {
+				return err
+			}
+			created = true
+			return nil
+		},
+		undo: func() error {
+			if !created {
+				return nil
+			}
+			return fs.RemoveAll(path)
+		},
+	})
+}
+
+func (uow *UnitOfWork) tempPath() string {
+	return filepath.Join(uow.staging, uuid.New().String())
+}
+
+// apply runs the staged operations in order
+func (uow *UnitOfWork) apply() error {
+	for len(uow.staged) > 0 {
+		op := uow.staged[0]
+		if err := op.apply(); err != nil {
+			return err
+		}
+		uow.staged = uow.staged[1:]
+		uow.applied = append(uow.applied, op)
+	}
+	return nil
+}
+
+// rollback undoes the applied operations in reverse order and discards the ones that never ran
+func (uow *UnitOfWork) rollback() {
+	for i := len(uow.applied) - 1; i >= 0; i-- {
+		op := uow.applied[i]
+		if op.undo() == nil && op.discard != nil {
+			_ = op.discard()
+		}
+	}
+	for _, op := range uow.staged {
+		if op.discard != nil {
+			_ = op.discard()
+		}
+	}
+	uow.applied, uow.staged = nil, nil
+}
+
+// finish runs the clean up of the applied operations after the commit. Failures only leave garbage in staging.
+func (uow *UnitOfWork) finish() {
+	for _, op := range uow.applied {
+		if op.finish != nil {
+			_ = op.finish()
+		}
+	}
+	uow.applied = nil
+}
+
+// unitOfWork returns the unit of work the statement runs in, nil if there is none
+func unitOfWork(tx *gorm.DB) *UnitOfWork {
+	if tx.Statement.Context == nil {
+		return nil
+	}
+	uow, _ := tx.Statement.Context.Value(uowKey{}).(*UnitOfWork)
+	return uow
+}
+
+// mkdirAll creates path as part of the unit of work of tx, or right away if there is none
+func mkdirAll(tx *gorm.DB, path string) error {
+	if uow := unitOfWork(tx); uow != nil {
+		uow.MkdirAll(path)
+		return nil
+	}
+	return fs.MkdirAll(path, os.ModePerm)
+}
+
+// removeAll removes path as part of the unit of work of tx, or right away if there is none
+func removeAll(tx *gorm.DB, path string) error {
+	if uow := unitOfWork(tx); uow != nil {
+		uow.RemoveAll(path)
+		return nil
+	}
+	return fs.RemoveAll(path)
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"gopkg.in/guregu/null.v4"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	ErrInvalidUploadRequest = errors.New("invalid upload request")
+	ErrUploadRequestClosed  = errors.New("upload request is expired or used up")
+)
+
+// UploadRequest lets anonymous uploaders open and finalize shares for the owner of the request ("file drop").
+// The uploader presents the token, only its hash is stored.
+type UploadRequest struct {
+	ID        uuid.UUID `json:"id"  gorm:"primary_key"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	Name       null.String `json:"name,omitempty"`
+	Owner      null.String `json:"owner,omitempty"  gorm:"index"`
+	OwnerEmail null.String `json:"owner_email,omitempty"`
+	Expires    null.Time   `json:"expires,omitempty"`
+	MaxShares  null.Int    `json:"max_shares,omitempty"` // how often the link can be used
+	MaxFiles   null.Int    `json:"max_files,omitempty"`  // per share
+	MaxSize    null.Int    `json:"max_size,omitempty"`   // bytes per share
+	Shares     int64       `json:"shares"  gorm:"not null; default:0"`
+
+	TokenHash string `json:"-"  gorm:"not null; uniqueIndex; size:64"`
+	Token     string `json:"token,omitempty"  gorm:"-"` // only set right after creation
+}
+
+// Validate checks the limits of the request
+func (ur UploadRequest) Validate(now time.Time) error {
+	if ur.Expires.Valid && !ur.Expires.Time.After(now) {
+		return fmt.Errorf("%w: expires has to be in the future", ErrInvalidUploadRequest)
+	}
+	for name, v := range map[string]null.Int{"max_shares": ur.MaxShares, "max_files": ur.MaxFiles, "max_size": ur.MaxSize} {
+		if v.Valid && v.Int64 <= 0 {
+			return fmt.Errorf("%w: %s has to be positive", ErrInvalidUploadRequest, name)
+		}
+	}
+	if ur.OwnerEmail.Valid {
+		if err := ValidateEmail(ur.OwnerEmail.String); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidUploadRequest, err)
+		}
+	}
+	return nil
+}
+
+// Open returns an error if no more shares can be opened with the request
+func (ur UploadRequest) Open(now time.Time) error {
+	if ur.Expires.Valid && !ur.Expires.Time.After(now) {
+		return ErrUploadRequestClosed
+	}
+	if ur.MaxShares.Valid && ur.Shares >= ur.MaxShares.Int64 {
+		return ErrUploadRequestClosed
+	}
+	return nil
+}
+
+func (ur *UploadRequest) BeforeCreate(tx *gorm.DB) error {
+	// set uuid
+	if ur.ID == uuid.Nil {
+		uid, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		ur.ID = uid
+	}
+	// generate token
+	if ur.TokenHash == "" {
+		token, hash, err := NewToken()
+		if err != nil {
+			return err
+		}
+		ur.Token, ur.TokenHash = token, hash
+	}
+	return nil
+}
+
+// FindUploadRequest returns the upload request of the token
+func FindUploadRequest(db *gorm.DB, token string) (UploadRequest, error) {
+	var ur UploadRequest
+	err := db.Where("token_hash = ?", HashToken(token)).First(&ur).Error
+	return ur, err
+}
+
+// NewToken returns a random token and its hash, store only the hash
+func NewToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex SHA-256 of a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
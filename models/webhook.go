@@ -0,0 +1,144 @@
+package models
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// share lifecycle events webhooks can subscribe to
+const (
+	EventShareFinalized       = "share.finalized"
+	EventShareDownloaded      = "share.downloaded"
+	EventDownloadLimitReached = "share.download_limit_reached"
+	EventShareExpired         = "share.expired"
+	EventShareDeleted         = "share.deleted"
+)
+
+var Events = []string{EventShareFinalized, EventShareDownloaded, EventDownloadLimitReached, EventShareExpired, EventShareDeleted}
+
+var ErrInvalidWebhook = errors.New("invalid webhook")
+
+// EventList is stored as comma separated list
+type EventList []string
+
+func (l EventList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *EventList) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("can't scan %T into EventList", value)
+	}
+	*l = EventList{}
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// Contains returns true if the event is in the list
+func (l EventList) Contains(event string) bool {
+	for _, e := range l {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook is a subscription of a URL to share events. Deliveries are signed with the Secret.
+type Webhook struct {
+	ID        uuid.UUID `json:"id"  gorm:"primary_key"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+
+	URL    string    `json:"url"  gorm:"not null"`
+	Events EventList `json:"events"  gorm:"type:varchar(255); not null"`
+	Secret string    `json:"secret,omitempty"  gorm:"not null"`
+	Active bool      `json:"active"  gorm:"not null; default:true"`
+
+	Deliveries []WebhookDelivery `json:"-"  gorm:"constraint:OnDelete:CASCADE"`
+}
+
+// WebhookDelivery is one attempt to deliver an event
+type WebhookDelivery struct {
+	ID        uuid.UUID `json:"id"  gorm:"primary_key"`
+	CreatedAt time.Time `json:"created_at"  gorm:"index"`
+	WebhookID uuid.UUID `json:"webhook_id"  gorm:"index"`
+
+	EventID    uuid.UUID `json:"event_id"`
+	Event      string    `json:"event"`
+	Payload    string    `json:"payload"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	Duration   int64     `json:"duration_ms"`
+}
+
+// Secure hides the secret, it's only shown once after creating the webhook
+func (wh *Webhook) Secure() {
+	wh.Secret = ""
+}
+
+// Validate checks URL and events
+func (wh Webhook) Validate() error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url has to be an absolute http(s) URL", ErrInvalidWebhook)
+	}
+	if len(wh.Events) == 0 {
+		return fmt.Errorf("%w: subscribe to at least one event", ErrInvalidWebhook)
+	}
+	for _, e := range wh.Events {
+		if !EventList(Events).Contains(e) {
+			return fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, e)
+		}
+	}
+	return nil
+}
+
+func (wh *Webhook) BeforeCreate(tx *gorm.DB) error {
+	// set uuid
+	if wh.ID == uuid.Nil {
+		uid, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		wh.ID = uid
+	}
+	// generate secret
+	if wh.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		wh.Secret = hex.EncodeToString(b)
+	}
+	return nil
+}
+
+func (d *WebhookDelivery) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		uid, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		d.ID = uid
+	}
+	return nil
+}
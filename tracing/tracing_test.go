@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"net/http"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	stop, err := Setup("", "chiefsend-api", 1)
+	assert.Nil(t, err)
+	assert.Nil(t, stop(context.Background()))
+	// no-op
+	ctx, span := Start(context.Background(), "nothing")
+	assert.False(t, span.IsRecording())
+	assert.Empty(t, Inject(ctx))
+	assert.Equal(t, "", TraceID(ctx))
+}
+
+func TestPropagation(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	ctx, parent := Start(context.Background(), "request")
+	carrier := Inject(ctx)
+	assert.Contains(t, carrier, "traceparent")
+	assert.Equal(t, parent.SpanContext().TraceID().String(), TraceID(ctx))
+	End(parent, nil)
+
+	t.Run("payload", func(t *testing.T) {
+		_, child := Start(Extract(context.Background(), carrier), "task")
+		End(child, errors.New("refused"))
+		spans := rec.Ended()
+		last := spans[len(spans)-1]
+		assert.Equal(t, parent.SpanContext().SpanID(), last.Parent().SpanID())
+		assert.Equal(t, codes.Error, last.Status().Code)
+		assert.Len(t, last.Events(), 1) // the error
+	})
+
+	t.Run("header", func(t *testing.T) {
+		header := http.Header{"Traceparent": {carrier["traceparent"]}}
+		ctx := ExtractHeader(context.Background(), header)
+		assert.Equal(t, parent.SpanContext().TraceID().String(), TraceID(ctx))
+	})
+}